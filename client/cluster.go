@@ -0,0 +1,351 @@
+package memcached
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// ErrTimeout is returned when no server answered a read in time.
+var ErrTimeout = errors.New("timed out waiting for a response")
+
+// VBucketServerMap describes which servers hold which vbuckets.
+//
+// This is the vBucketServerMap section of a couchbase bucket
+// configuration.  Each row of VBucketMap holds indexes into
+// ServerList: the master first, then each replica.  -1 means there
+// is no server for that position.
+type VBucketServerMap struct {
+	HashAlgorithm string   `json:"hashAlgorithm"`
+	NumReplicas   int      `json:"numReplicas"`
+	ServerList    []string `json:"serverList"`
+	VBucketMap    [][]int  `json:"vBucketMap"`
+}
+
+// VBHash finds the vbucket for the given key.
+func (m *VBucketServerMap) VBHash(key string) uint16 {
+	crc := crc32.ChecksumIEEE([]byte(key))
+	return uint16((crc >> 16) & 0x7fff & uint32(len(m.VBucketMap)-1))
+}
+
+// servers returns the master and replicas of a vbucket, in order,
+// using "" for missing ones.
+func (m *VBucketServerMap) servers(vb uint16) []string {
+	if int(vb) >= len(m.VBucketMap) {
+		return nil
+	}
+	row := m.VBucketMap[vb]
+	rv := make([]string, len(row))
+	for i, idx := range row {
+		if idx >= 0 && idx < len(m.ServerList) {
+			rv[i] = m.ServerList[idx]
+		}
+	}
+	return rv
+}
+
+// ReplicaResponse is the result of a read that may have been served
+// by a replica.
+type ReplicaResponse struct {
+	*gomemcached.MCResponse
+	// The server that answered.
+	Server string
+	// Which copy answered: 0 for the master, n for the nth replica,
+	// whose value may be stale.
+	Replica int
+}
+
+// Cluster is a client for a set of servers sharing a vbucket map.
+//
+// A Cluster is safe for concurrent use.  It keeps a small pool of
+// connections to each server.
+type Cluster struct {
+	// How long a HedgedGet waits for the master before also
+	// asking a replica.  Zero only asks replicas after the master
+	// fails.
+	HedgeDelay time.Duration
+	// How long a HedgedGet waits for any answer at all.  Zero
+	// waits forever.  Connections that haven't answered by then
+	// are closed.
+	Timeout time.Duration
+
+	dial     DialFunc
+	poolSize int
+
+	mu         sync.RWMutex
+	vbmap      *VBucketServerMap
+	pools      map[string]*connPool
+	threshold  int
+	probeEvery time.Duration
+}
+
+// NewCluster builds a cluster client for the given map, connecting to
+// servers with dial (DefaultDial if nil).
+func NewCluster(m *VBucketServerMap, dial DialFunc) *Cluster {
+	if dial == nil {
+		dial = DefaultDial
+	}
+	cl := &Cluster{
+		dial:       dial,
+		poolSize:   4,
+		pools:      map[string]*connPool{},
+		threshold:  DefaultBreakerThreshold,
+		probeEvery: DefaultBreakerProbeInterval,
+	}
+	cl.SetMap(m)
+	return cl
+}
+
+// Map returns the vbucket map currently in use.
+func (cl *Cluster) Map() *VBucketServerMap {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.vbmap
+}
+
+// SetMap replaces the vbucket map, dropping connections to servers
+// that are no longer in it.
+func (cl *Cluster) SetMap(m *VBucketServerMap) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.vbmap = m
+	inuse := map[string]bool{}
+	for _, s := range m.ServerList {
+		inuse[s] = true
+		if cl.pools[s] == nil {
+			cl.pools[s] = newConnPool(s, cl.poolSize, cl.dial,
+				cl.threshold, cl.probeEvery)
+		}
+	}
+	for s, p := range cl.pools {
+		if !inuse[s] {
+			p.close()
+			delete(cl.pools, s)
+		}
+	}
+}
+
+// SetBreaker sets the number of consecutive communication failures
+// after which a server is ejected, and how often an ejected server
+// is checked to see whether it may be reinstated.
+func (cl *Cluster) SetBreaker(threshold int, probeEvery time.Duration) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.threshold, cl.probeEvery = threshold, probeEvery
+	for _, p := range cl.pools {
+		p.setBreaker(threshold, probeEvery)
+	}
+}
+
+// Ejected lists the servers currently considered down.
+//
+// Requests for vbuckets mastered by these fail immediately with
+// ErrNodeDown (and HedgedGet goes straight to a replica) until they
+// are found healthy again.
+func (cl *Cluster) Ejected() []string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	rv := []string{}
+	for s, p := range cl.pools {
+		if p.isDown() {
+			rv = append(rv, s)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Close all connections to all servers.
+func (cl *Cluster) Close() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	for s, p := range cl.pools {
+		p.close()
+		delete(cl.pools, s)
+	}
+}
+
+func (cl *Cluster) pool(server string) *connPool {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	return cl.pools[server]
+}
+
+// Do runs f against a pooled connection to the given server.
+func (cl *Cluster) Do(server string, f func(*Client) error) error {
+	p := cl.pool(server)
+	if p == nil {
+		return fmt.Errorf("no such server: %q", server)
+	}
+	return p.use(f)
+}
+
+// route finds the vbucket and servers for a key.
+func (cl *Cluster) route(key string) (uint16, []string, error) {
+	m := cl.Map()
+	if len(m.VBucketMap) == 0 {
+		return 0, nil, errors.New("empty vbucket map")
+	}
+	vb := m.VBHash(key)
+	servers := m.servers(vb)
+	if len(servers) == 0 || servers[0] == "" {
+		return vb, servers, fmt.Errorf("no master for vbucket %d", vb)
+	}
+	return vb, servers, nil
+}
+
+// Get the value for a key from its master.
+func (cl *Cluster) Get(key string) (rv *gomemcached.MCResponse, err error) {
+	vb, servers, err := cl.route(key)
+	if err != nil {
+		return nil, err
+	}
+	err = cl.Do(servers[0], func(c *Client) error {
+		rv, err = c.Get(vb, key)
+		return err
+	})
+	return rv, err
+}
+
+type replicaResult struct {
+	replica int
+	res     *ReplicaResponse // nil if there was no response at all
+	err     error
+}
+
+// Whether a failed read is worth trying on another copy.
+func isRetryable(err error) bool {
+	if res, ok := err.(*gomemcached.MCResponse); ok {
+		return res.Status == gomemcached.TMPFAIL ||
+			res.Status == gomemcached.NOT_MY_VBUCKET
+	}
+	return true
+}
+
+func (cl *Cluster) getCopy(vb uint16, key, server string, replica int,
+	deadline time.Time, ch chan<- replicaResult) {
+
+	opcode := gomemcached.GET
+	if replica > 0 {
+		opcode = gomemcached.GET_REPLICA
+	}
+	var res *gomemcached.MCResponse
+	err := cl.Do(server, func(c *Client) (err error) {
+		if !deadline.IsZero() {
+			// Hang up if there's no answer by the time HedgedGet
+			// gives up, so a stalled connection isn't reused.
+			hungUp := false
+			var once sync.Once
+			t := time.AfterFunc(deadline.Sub(time.Now()), func() {
+				once.Do(func() {
+					hungUp = true
+					c.Close()
+				})
+			})
+			defer func() {
+				t.Stop()
+				once.Do(func() {})
+				if hungUp {
+					c.healthy = false
+				}
+			}()
+		}
+		res, err = c.Send(&gomemcached.MCRequest{
+			Opcode:  opcode,
+			VBucket: vb,
+			Key:     []byte(key),
+		})
+		return err
+	})
+	rv := replicaResult{replica: replica, err: err}
+	if res != nil {
+		rv.res = &ReplicaResponse{
+			MCResponse: res,
+			Server:     server,
+			Replica:    replica,
+		}
+	}
+	ch <- rv
+}
+
+// HedgedGet gets the value for a key from its master, falling back
+// to replicas if the master is slow or failing.
+//
+// A replica is asked after HedgeDelay, or as soon as the master
+// answers with TMPFAIL or fails to communicate, and so on down the
+// replica list.  The first successful answer wins; check Replica to
+// see whether it may be stale.  A definitive answer from the
+// master (such as not found) is returned as is.
+func (cl *Cluster) HedgedGet(key string) (*ReplicaResponse, error) {
+	vb, servers, err := cl.route(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var deadline time.Time
+	if cl.Timeout > 0 {
+		deadline = time.Now().Add(cl.Timeout)
+	}
+	ch := make(chan replicaResult, len(servers))
+	next, pending := 0, 0
+	launch := func() bool {
+		for next < len(servers) {
+			s, i := servers[next], next
+			next++
+			if s != "" {
+				pending++
+				go cl.getCopy(vb, key, s, i, deadline, ch)
+				return true
+			}
+		}
+		return false
+	}
+	launch()
+
+	var hedge <-chan time.Time
+	if cl.HedgeDelay > 0 {
+		t := time.NewTicker(cl.HedgeDelay)
+		defer t.Stop()
+		hedge = t.C
+	}
+	var timeout <-chan time.Time
+	if cl.Timeout > 0 {
+		t := time.NewTimer(cl.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var masterErr, lastErr error
+	var masterRes *ReplicaResponse
+	for {
+		select {
+		case r := <-ch:
+			pending--
+			if r.err == nil {
+				return r.res, nil
+			}
+			if r.replica == 0 {
+				if !isRetryable(r.err) {
+					return r.res, r.err
+				}
+				masterRes, masterErr = r.res, r.err
+			}
+			lastErr = r.err
+			if !launch() && pending == 0 {
+				if masterErr != nil {
+					return masterRes, masterErr
+				}
+				return r.res, lastErr
+			}
+		case <-hedge:
+			launch()
+		case <-timeout:
+			return nil, ErrTimeout
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package memcached
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestVBHash(t *testing.T) {
+	m := &VBucketServerMap{VBucketMap: make([][]int, 1024)}
+	tests := map[string]uint16{
+		"hello":   0x210,
+		"world":   0x277,
+		"":        0,
+		"a-bit-l": 0x195,
+	}
+	for k, exp := range tests {
+		if got := m.VBHash(k); got != exp {
+			t.Errorf("Expected vbucket %#x for %q, got %#x", exp, k, got)
+		}
+	}
+}
+
+type fakeCluster map[string]func(*gomemcached.MCRequest) *gomemcached.MCResponse
+
+func (fc fakeCluster) dial(server string) (*Client, error) {
+	h, ok := fc[server]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	return serveFake(h), nil
+}
+
+func answer(body string, delay time.Duration) func(*gomemcached.MCRequest) *gomemcached.MCResponse {
+	return func(*gomemcached.MCRequest) *gomemcached.MCResponse {
+		time.Sleep(delay)
+		return &gomemcached.MCResponse{
+			Extras: []byte{0, 0, 0, 0},
+			Body:   []byte(body),
+		}
+	}
+}
+
+func status(st gomemcached.Status) func(*gomemcached.MCRequest) *gomemcached.MCResponse {
+	return func(*gomemcached.MCRequest) *gomemcached.MCResponse {
+		return &gomemcached.MCResponse{Status: st}
+	}
+}
+
+func testCluster(fc fakeCluster) *Cluster {
+	return NewCluster(&VBucketServerMap{
+		ServerList: []string{"a", "b", "c"},
+		VBucketMap: [][]int{{0, 1, 2}},
+	}, fc.dial)
+}
+
+func TestClusterGet(t *testing.T) {
+	cl := testCluster(fakeCluster{"a": answer("master", 0)})
+	defer cl.Close()
+	res, err := cl.Get("k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "master" {
+		t.Errorf("Expected master's answer, got %v", res)
+	}
+}
+
+func TestHedgedGetMaster(t *testing.T) {
+	cl := testCluster(fakeCluster{
+		"a": answer("master", 0),
+		"b": answer("replica", 0),
+	})
+	defer cl.Close()
+	cl.HedgeDelay = time.Second
+	res, err := cl.HedgedGet("k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if res.Replica != 0 || string(res.Body) != "master" {
+		t.Errorf("Expected master's answer, got %#v", res)
+	}
+}
+
+func TestHedgedGetSlowMaster(t *testing.T) {
+	cl := testCluster(fakeCluster{
+		"a": answer("master", time.Second),
+		"b": answer("replica", 0),
+	})
+	defer cl.Close()
+	cl.HedgeDelay = time.Millisecond
+	res, err := cl.HedgedGet("k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if res.Replica != 1 || res.Server != "b" ||
+		string(res.Body) != "replica" {
+		t.Errorf("Expected replica's answer, got %#v", res)
+	}
+	if res.Opcode != gomemcached.GET_REPLICA {
+		t.Errorf("Expected a GET_REPLICA, got %v", res.Opcode)
+	}
+}
+
+func TestHedgedGetFailover(t *testing.T) {
+	cl := testCluster(fakeCluster{
+		"a": status(gomemcached.TMPFAIL),
+		"c": answer("replica2", 0),
+	})
+	defer cl.Close()
+	res, err := cl.HedgedGet("k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if res.Replica != 2 || string(res.Body) != "replica2" {
+		t.Errorf("Expected second replica's answer, got %#v", res)
+	}
+}
+
+func TestHedgedGetNotFound(t *testing.T) {
+	cl := testCluster(fakeCluster{
+		"a": status(gomemcached.KEY_ENOENT),
+		"b": answer("replica", 0),
+	})
+	defer cl.Close()
+	_, err := cl.HedgedGet("k")
+	if !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected master's not found, got %v", err)
+	}
+}
+
+func TestHedgedGetAllFail(t *testing.T) {
+	cl := testCluster(fakeCluster{"a": status(gomemcached.TMPFAIL)})
+	defer cl.Close()
+	res, err := cl.HedgedGet("k")
+	if res == nil || res.Status != gomemcached.TMPFAIL {
+		t.Errorf("Expected master's TMPFAIL, got %v/%v", res, err)
+	}
+}
+
+func TestHedgedGetTimeout(t *testing.T) {
+	cl := testCluster(fakeCluster{"a": answer("master", time.Second)})
+	defer cl.Close()
+	cl.Timeout = time.Millisecond
+	_, err := cl.HedgedGet("k")
+	if err != ErrTimeout {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+}
+
+func TestHedgedGetTimeoutHangsUp(t *testing.T) {
+	release := make(chan bool)
+	defer close(release)
+	var mu sync.Mutex
+	calls := 0
+	cl := testCluster(fakeCluster{"a": func(*gomemcached.MCRequest) *gomemcached.MCResponse {
+		mu.Lock()
+		calls++
+		stall := calls == 1
+		mu.Unlock()
+		if stall {
+			<-release
+		}
+		return &gomemcached.MCResponse{Extras: []byte{0, 0, 0, 0}}
+	}})
+	defer cl.Close()
+	cl.Timeout = 20 * time.Millisecond
+	if _, err := cl.HedgedGet("k"); err != ErrTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+	if _, err := cl.Get("k"); err != nil {
+		t.Fatalf("Expected a new connection to answer, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	p := cl.pool("a")
+	p.mu.Lock()
+	idle := len(p.idle)
+	p.mu.Unlock()
+	if idle != 1 {
+		t.Errorf("Expected only the answering connection to be pooled, have %v", idle)
+	}
+}
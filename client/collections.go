@@ -0,0 +1,121 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/dustin/gomemcached"
+)
+
+// hasDocumentKey is true if the key of a request names a document,
+// and so belongs to a collection.
+func hasDocumentKey(req *gomemcached.MCRequest) bool {
+	switch req.Opcode {
+	case gomemcached.HELLO, gomemcached.STAT,
+		gomemcached.SASL_LIST_MECHS, gomemcached.SASL_AUTH,
+		gomemcached.SASL_STEP, gomemcached.TAP_CONNECT,
+		gomemcached.DCP_OPEN, gomemcached.DCP_CONTROL,
+		gomemcached.GET_COLLECTIONS_MANIFEST,
+		gomemcached.GET_COLLECTION_ID:
+		return false
+	}
+	return len(req.Key) > 0
+}
+
+// withCollection returns the request with its collection ID prefixed
+// to its key if collections were negotiated.  Requests in the default
+// collection go to the client's collection instead.
+func (c *Client) withCollection(req *gomemcached.MCRequest) *gomemcached.MCRequest {
+	if !c.features[gomemcached.FEATURE_COLLECTIONS] || !hasDocumentKey(req) {
+		return req
+	}
+	id := req.CollId
+	if id == gomemcached.DEFAULT_COLLECTION_ID {
+		id = c.collection
+	}
+	rv := *req
+	rv.Key = gomemcached.EncodeCollectionKey(id, req.Key)
+	return &rv
+}
+
+// received strips collection IDs from returned keys, and forgets
+// cached collection IDs when the server says they're out of date.
+func (c *Client) received(res *gomemcached.MCResponse, err error) {
+	if res == nil || !c.features[gomemcached.FEATURE_COLLECTIONS] {
+		return
+	}
+	if res.Status == gomemcached.UNKNOWN_COLLECTION ||
+		res.Status == gomemcached.UNKNOWN_SCOPE {
+		c.collections = nil
+	}
+	if len(res.Key) > 0 {
+		if _, key, err := gomemcached.DecodeCollectionKey(res.Key); err == nil {
+			res.Key = key
+		}
+	}
+}
+
+// CollectionsManifest gets the bucket's collections manifest.
+func (c *Client) CollectionsManifest() (*gomemcached.CollectionsManifest, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET_COLLECTIONS_MANIFEST,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rv := &gomemcached.CollectionsManifest{}
+	err = json.Unmarshal(res.Body, rv)
+	return rv, err
+}
+
+// CollectionID resolves a scope and collection name to the ID to put
+// in MCRequest.CollId.  Empty names mean "_default".
+//
+// IDs are cached until the server reports an unknown collection or
+// scope, or Hello is called again.
+func (c *Client) CollectionID(scope, collection string) (uint32, error) {
+	if scope == "" {
+		scope = "_default"
+	}
+	if collection == "" {
+		collection = "_default"
+	}
+	path := scope + "." + collection
+	if id, ok := c.collections[path]; ok {
+		return id, nil
+	}
+
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET_COLLECTION_ID,
+		Key:    []byte(path),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Extras) < 12 {
+		return 0, fmt.Errorf("short GET_COLLECTION_ID response: %v", res)
+	}
+	id := binary.BigEndian.Uint32(res.Extras[8:])
+	if c.collections == nil {
+		c.collections = map[string]uint32{}
+	}
+	c.collections[path] = id
+	return id, nil
+}
+
+// UseCollection makes Get, Set, GetBulk, CAS and the client's other
+// key based requests use the named collection rather than the
+// default, unless they give their own MCRequest.CollId.  Empty names
+// mean "_default".
+//
+// The collection's ID is kept until the next call, so if the server
+// later reports it unknown, call UseCollection again to look it up.
+func (c *Client) UseCollection(scope, collection string) error {
+	id, err := c.CollectionID(scope, collection)
+	if err != nil {
+		return err
+	}
+	c.collection = id
+	return nil
+}
@@ -0,0 +1,180 @@
+package memcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func collectionsServer(lookups *int, keys *[]string) *Client {
+	return serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		switch req.Opcode {
+		case gomemcached.HELLO:
+			return &gomemcached.MCResponse{Body: req.Body}
+		case gomemcached.GET_COLLECTIONS_MANIFEST:
+			return &gomemcached.MCResponse{
+				Body: []byte(`{"uid": "1", "scopes": [{"name": "app", "uid": "8",
+					"collections": [{"name": "users", "uid": "a"}]}]}`),
+			}
+		case gomemcached.GET_COLLECTION_ID:
+			*lookups++
+			if string(req.Key) != "app.users" {
+				return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COLLECTION}
+			}
+			extras := make([]byte, 12)
+			binary.BigEndian.PutUint32(extras[8:], 10)
+			return &gomemcached.MCResponse{Extras: extras}
+		}
+		*keys = append(*keys, string(req.Key))
+		if string(req.Key) == "\x0bgone" {
+			return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COLLECTION}
+		}
+		if bytes.HasSuffix(req.Key, []byte("missing")) {
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT, Key: req.Key}
+		}
+		return &gomemcached.MCResponse{Key: req.Key, Extras: make([]byte, 4)}
+	})
+}
+
+func TestCollectionKeys(t *testing.T) {
+	lookups, keys := 0, []string{}
+	c := collectionsServer(&lookups, &keys)
+	defer c.Close()
+
+	c.Get(0, "before")
+	if _, err := c.Hello("test", gomemcached.FEATURE_COLLECTIONS); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	}
+	c.Get(0, "default")
+
+	id, err := c.CollectionID("app", "users")
+	if err != nil || id != 10 {
+		t.Fatalf("Expected collection 10, got %v/%v", id, err)
+	}
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GETK,
+		Key:    []byte("user"),
+		CollId: id,
+	})
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Key) != "user" {
+		t.Errorf("Expected the collection stripped from the key, got %q", res.Key)
+	}
+
+	// Including when it's an error.
+	_, err = c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GETK,
+		Key:    []byte("missing"),
+		CollId: id,
+	})
+	if res, ok := err.(*gomemcached.MCResponse); !ok || string(res.Key) != "missing" {
+		t.Errorf("Expected the collection stripped from the error's key, got %v", err)
+	}
+	c.Transmit(&gomemcached.MCRequest{
+		Opcode: gomemcached.GETK,
+		Key:    []byte("missing"),
+		CollId: id,
+	})
+	if res, _ := c.Receive(); res == nil || string(res.Key) != "missing" {
+		t.Errorf("Expected the collection stripped from a received key, got %v", res)
+	}
+
+	exp := []string{"before", "\x00default", "\x0auser", "\x0amissing", "\x0amissing"}
+	if len(keys) != len(exp) {
+		t.Fatalf("Expected keys %q, got %q", exp, keys)
+	}
+	for i := range exp {
+		if keys[i] != exp[i] {
+			t.Errorf("Expected keys %q, got %q", exp, keys)
+			break
+		}
+	}
+}
+
+func TestCollectionIDCache(t *testing.T) {
+	lookups, keys := 0, []string{}
+	c := collectionsServer(&lookups, &keys)
+	defer c.Close()
+	c.Hello("test", gomemcached.FEATURE_COLLECTIONS)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.CollectionID("app", "users"); err != nil {
+			t.Fatalf("Error looking up collection: %v", err)
+		}
+	}
+	if lookups != 1 {
+		t.Errorf("Expected one lookup, got %v", lookups)
+	}
+
+	_, err := c.CollectionID("", "")
+	if errStatus(err) != gomemcached.UNKNOWN_COLLECTION {
+		t.Errorf("Expected an unknown collection, got %v", err)
+	}
+
+	c.CollectionID("app", "users")
+	c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("gone"),
+		CollId: 11,
+	})
+	c.CollectionID("app", "users")
+	if lookups != 4 {
+		t.Errorf("Expected the cache to be dropped after an unknown collection, got %v lookups",
+			lookups)
+	}
+
+	m, err := c.CollectionsManifest()
+	if err != nil {
+		t.Fatalf("Error getting manifest: %v", err)
+	}
+	if id, ok := m.CollectionID("app", "users"); !ok || id != 10 {
+		t.Errorf("Expected app.users to be 10, got %v/%v", id, ok)
+	}
+}
+
+func TestUseCollection(t *testing.T) {
+	lookups, keys := 0, []string{}
+	c := collectionsServer(&lookups, &keys)
+	defer c.Close()
+	c.Hello("test", gomemcached.FEATURE_COLLECTIONS)
+
+	if err := c.UseCollection("app", "missing"); errStatus(err) != gomemcached.UNKNOWN_COLLECTION {
+		t.Fatalf("Expected an unknown collection, got %v", err)
+	}
+	c.Get(0, "a")
+	if err := c.UseCollection("app", "users"); err != nil {
+		t.Fatalf("Error using collection: %v", err)
+	}
+	c.Get(0, "b")
+	c.Set(0, "c", 0, 0, []byte("C"))
+	if _, err := c.GetBulk(0, []string{"d", "e"}); err != nil {
+		t.Fatalf("Error getting bulk: %v", err)
+	}
+	c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("f"),
+		CollId: 12,
+	})
+
+	exp := []string{"\x00a", "\x0ab", "\x0ac", "\x0ad", "\x0ae", "\x0cf"}
+	if len(keys) != len(exp) {
+		t.Fatalf("Expected keys %q, got %q", exp, keys)
+	}
+	for i := range exp {
+		if keys[i] != exp[i] {
+			t.Errorf("Expected keys %q, got %q", exp, keys)
+			break
+		}
+	}
+}
+
+func errStatus(err error) gomemcached.Status {
+	if res, ok := err.(*gomemcached.MCResponse); ok {
+		return res.Status
+	}
+	return 0xffff
+}
@@ -0,0 +1,428 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/dustin/gomemcached"
+)
+
+// DCP protocol docs: <https://github.com/couchbase/kv_engine/tree/master/docs/dcp>
+
+// Snapshot marker types (found in DcpEvent.SnapshotType)
+const (
+	DcpSnapshotMemory     = uint32(0x01)
+	DcpSnapshotDisk       = uint32(0x02)
+	DcpSnapshotCheckpoint = uint32(0x04)
+	DcpSnapshotAck        = uint32(0x08)
+)
+
+// Stream end reasons (found in DcpEvent.Flags of a DCP_STREAM_END)
+const (
+	DcpStreamEndOK = uint32(iota)
+	DcpStreamEndClosed
+	DcpStreamEndStateChanged
+	DcpStreamEndDisconnected
+	DcpStreamEndTooSlow
+)
+
+// Value for DcpStreamArguments.EndSeqno to keep streaming forever.
+const DcpNoEnd = math.MaxUint64
+
+// Buffer acknowledgements are sent once this fraction of the flow
+// control buffer has been consumed.
+var DcpBufferAckThreshold = 0.2
+
+// FailoverEntry is a branch in a vbucket's history: its UUID and the
+// seqno it started at.
+type FailoverEntry struct {
+	VBUUID, Seqno uint64
+}
+
+// FailoverLog is a vbucket's history, newest entry first.
+type FailoverLog []FailoverEntry
+
+func parseFailoverLog(body []byte) (FailoverLog, error) {
+	if len(body)%16 != 0 {
+		return nil, fmt.Errorf("invalid failover log length %d", len(body))
+	}
+	rv := make(FailoverLog, 0, len(body)/16)
+	for i := 0; i < len(body); i += 16 {
+		rv = append(rv, FailoverEntry{
+			VBUUID: binary.BigEndian.Uint64(body[i:]),
+			Seqno:  binary.BigEndian.Uint64(body[i+8:]),
+		})
+	}
+	return rv, nil
+}
+
+// DcpEvent is a DCP notification from the server.
+type DcpEvent struct {
+	Opcode     gomemcached.CommandCode // Type of event
+	Status     gomemcached.Status      // Result of a stream or failover log request
+	VBucket    uint16                  // VBucket this event applies to
+	Flags      uint32                  // Item flags, stream end reason or vbucket state
+	Expiry     uint32                  // Item expiration time
+	Key, Value []byte                  // Item key/value
+	Cas        uint64
+	DataType   gomemcached.DataType
+
+	Seqno    uint64 // Item seqno, or where to roll back to
+	RevSeqno uint64 // Item revision
+
+	SnapStart, SnapEnd uint64 // Snapshot range
+	SnapshotType       uint32
+
+	FailoverLog FailoverLog // From a successful stream request
+}
+
+func makeDcpEvent(req gomemcached.MCRequest) *DcpEvent {
+	event := DcpEvent{
+		Opcode:   req.Opcode,
+		VBucket:  req.VBucket,
+		Cas:      req.Cas,
+		DataType: req.DataType,
+	}
+	switch req.Opcode {
+	case gomemcached.DCP_MUTATION:
+		if len(req.Extras) < 28 {
+			return nil
+		}
+		event.Key = req.Key
+		event.Value = req.Body
+		event.Seqno = binary.BigEndian.Uint64(req.Extras)
+		event.RevSeqno = binary.BigEndian.Uint64(req.Extras[8:])
+		event.Flags = binary.BigEndian.Uint32(req.Extras[16:])
+		event.Expiry = binary.BigEndian.Uint32(req.Extras[20:])
+		if len(req.Extras) >= 30 {
+			event.Value = stripDcpMeta(req.Body, req.Extras[28:])
+		}
+	case gomemcached.DCP_DELETION, gomemcached.DCP_EXPIRATION:
+		if len(req.Extras) < 16 {
+			return nil
+		}
+		event.Key = req.Key
+		event.Value = req.Body
+		event.Seqno = binary.BigEndian.Uint64(req.Extras)
+		event.RevSeqno = binary.BigEndian.Uint64(req.Extras[8:])
+		if len(req.Extras) >= 18 {
+			event.Value = stripDcpMeta(req.Body, req.Extras[16:])
+		}
+	case gomemcached.DCP_SNAPSHOT_MARKER:
+		if len(req.Extras) < 20 {
+			return nil
+		}
+		event.SnapStart = binary.BigEndian.Uint64(req.Extras)
+		event.SnapEnd = binary.BigEndian.Uint64(req.Extras[8:])
+		event.SnapshotType = binary.BigEndian.Uint32(req.Extras[16:])
+	case gomemcached.DCP_STREAM_END:
+		if len(req.Extras) >= 4 {
+			event.Flags = binary.BigEndian.Uint32(req.Extras)
+		}
+	case gomemcached.DCP_SET_VBUCKET_STATE:
+		if len(req.Extras) >= 1 {
+			event.Flags = uint32(req.Extras[0])
+		}
+	case gomemcached.DCP_FLUSH:
+	default:
+		log.Printf("DcpFeed: Ignoring %s", req.Opcode)
+		return nil
+	}
+	return &event
+}
+
+// stripDcpMeta removes the extended metadata, whose length is given
+// in the extras, from the end of a body.
+func stripDcpMeta(body, nmeta []byte) []byte {
+	n := int(binary.BigEndian.Uint16(nmeta))
+	if n > len(body) {
+		return body
+	}
+	return body[:len(body)-n]
+}
+
+// Responses on a DCP connection carry the vbucket in the opaque.
+func makeDcpResponseEvent(res *gomemcached.MCResponse) *DcpEvent {
+	event := DcpEvent{
+		Opcode:  res.Opcode,
+		Status:  res.Status,
+		VBucket: uint16(res.Opaque),
+	}
+	switch res.Opcode {
+	case gomemcached.DCP_STREAM_REQ, gomemcached.DCP_FAILOVER_LOG:
+		switch res.Status {
+		case gomemcached.SUCCESS:
+			flog, err := parseFailoverLog(res.Body)
+			if err != nil {
+				log.Printf("DcpFeed: %v", err)
+			}
+			event.FailoverLog = flog
+		case gomemcached.ROLLBACK:
+			if len(res.Body) >= 8 {
+				event.Seqno = binary.BigEndian.Uint64(res.Body)
+			}
+		}
+	case gomemcached.DCP_CLOSE_STREAM:
+	default:
+		if res.Status != gomemcached.SUCCESS {
+			log.Printf("DcpFeed: %s failed: %v", res.Opcode, res.Status)
+		}
+		return nil
+	}
+	return &event
+}
+
+func (event DcpEvent) String() string {
+	switch event.Opcode {
+	case gomemcached.DCP_MUTATION, gomemcached.DCP_DELETION,
+		gomemcached.DCP_EXPIRATION:
+		return fmt.Sprintf("<DcpEvent %s, vbucket=%d, seqno=%d, key=%q (%d bytes)>",
+			event.Opcode, event.VBucket, event.Seqno, event.Key, len(event.Value))
+	case gomemcached.DCP_SNAPSHOT_MARKER:
+		return fmt.Sprintf("<DcpEvent %s, vbucket=%d, %d-%d>",
+			event.Opcode, event.VBucket, event.SnapStart, event.SnapEnd)
+	default:
+		return fmt.Sprintf("<DcpEvent %s, vbucket=%d, status=%v>",
+			event.Opcode, event.VBucket, event.Status)
+	}
+}
+
+// DcpArguments are parameters for opening a DCP feed.
+type DcpArguments struct {
+	// Name of this connection; required by the server.
+	Name string
+	// Bytes the server may send before waiting for a buffer
+	// acknowledgement.  Zero disables flow control.
+	BufferSize uint32
+	// Seconds between server noops on an idle connection.  Zero
+	// leaves noops disabled.
+	NoopInterval uint32
+}
+
+// DcpStreamArguments are parameters for streaming a vbucket.
+//
+// To resume, pass the VBUUID and snapshot from the last event seen.
+// If that history is no longer valid the stream request fails with
+// ROLLBACK and the seqno to restart from.
+type DcpStreamArguments struct {
+	VBucket    uint16
+	Flags      uint32
+	StartSeqno uint64
+	// Use DcpNoEnd to keep streaming new mutations.
+	EndSeqno  uint64
+	VBUUID    uint64
+	SnapStart uint64
+	SnapEnd   uint64
+}
+
+// DcpFeed represents a stream of DCP events from a server.
+type DcpFeed struct {
+	C     <-chan DcpEvent
+	Error error
+
+	mc         *Client
+	closer     chan bool
+	wlock      sync.Mutex
+	bufferSize uint32
+	unacked    uint32
+}
+
+// StartDcpFeed opens a DCP producer on a client connection.
+//
+// Events can be read from the returned feed's channel once streams
+// are requested with StreamRequest.  The connection can no longer be
+// used for other purposes.  To stop receiving events, close the
+// client connection.
+func (mc *Client) StartDcpFeed(args DcpArguments) (*DcpFeed, error) {
+	rq := &gomemcached.MCRequest{
+		Opcode: gomemcached.DCP_OPEN,
+		Key:    []byte(args.Name),
+		Extras: []byte{0, 0, 0, 0, 0, 0, 0, 1}, // seqno, producer
+	}
+	if _, err := mc.Send(rq); err != nil {
+		return nil, err
+	}
+
+	if args.BufferSize > 0 {
+		err := mc.dcpControl("connection_buffer_size",
+			strconv.FormatUint(uint64(args.BufferSize), 10))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if args.NoopInterval > 0 {
+		if err := mc.dcpControl("enable_noop", "true"); err != nil {
+			return nil, err
+		}
+		err := mc.dcpControl("set_noop_interval",
+			strconv.FormatUint(uint64(args.NoopInterval), 10))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ch := make(chan DcpEvent)
+	feed := &DcpFeed{
+		C:          ch,
+		mc:         mc,
+		closer:     make(chan bool),
+		bufferSize: args.BufferSize,
+	}
+	go feed.run(ch)
+	return feed, nil
+}
+
+func (mc *Client) dcpControl(key, value string) error {
+	_, err := mc.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.DCP_CONTROL,
+		Key:    []byte(key),
+		Body:   []byte(value),
+	})
+	return err
+}
+
+func (feed *DcpFeed) transmit(req *gomemcached.MCRequest) error {
+	feed.wlock.Lock()
+	defer feed.wlock.Unlock()
+	return feed.mc.Transmit(req)
+}
+
+// StreamRequest asks the server to stream a vbucket.  The result
+// arrives on the channel as a DCP_STREAM_REQ event.
+func (feed *DcpFeed) StreamRequest(args DcpStreamArguments) error {
+	extras := make([]byte, 48)
+	binary.BigEndian.PutUint32(extras, args.Flags)
+	binary.BigEndian.PutUint64(extras[8:], args.StartSeqno)
+	binary.BigEndian.PutUint64(extras[16:], args.EndSeqno)
+	binary.BigEndian.PutUint64(extras[24:], args.VBUUID)
+	binary.BigEndian.PutUint64(extras[32:], args.SnapStart)
+	binary.BigEndian.PutUint64(extras[40:], args.SnapEnd)
+	return feed.transmit(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DCP_STREAM_REQ,
+		VBucket: args.VBucket,
+		Opaque:  uint32(args.VBucket),
+		Extras:  extras,
+	})
+}
+
+// CloseStream stops streaming a vbucket.
+func (feed *DcpFeed) CloseStream(vb uint16) error {
+	return feed.transmit(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DCP_CLOSE_STREAM,
+		VBucket: vb,
+		Opaque:  uint32(vb),
+	})
+}
+
+// RequestFailoverLog asks for a vbucket's failover log.  It arrives
+// on the channel as a DCP_FAILOVER_LOG event.
+func (feed *DcpFeed) RequestFailoverLog(vb uint16) error {
+	return feed.transmit(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DCP_FAILOVER_LOG,
+		VBucket: vb,
+		Opaque:  uint32(vb),
+	})
+}
+
+// consumed acknowledges n bytes once enough have built up.
+func (feed *DcpFeed) consumed(n int) error {
+	if feed.bufferSize == 0 {
+		return nil
+	}
+	feed.unacked += uint32(n)
+	if float64(feed.unacked) < float64(feed.bufferSize)*DcpBufferAckThreshold {
+		return nil
+	}
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, feed.unacked)
+	feed.unacked = 0
+	return feed.transmit(&gomemcached.MCRequest{
+		Opcode: gomemcached.DCP_BUFFER_ACK,
+		Extras: extras,
+	})
+}
+
+func (feed *DcpFeed) respond(res *gomemcached.MCResponse) error {
+	feed.wlock.Lock()
+	defer feed.wlock.Unlock()
+	_, err := res.Transmit(feed.mc.conn)
+	return err
+}
+
+// Internal goroutine that reads from the socket and writes events to
+// the channel
+func (feed *DcpFeed) run(ch chan DcpEvent) {
+	defer close(ch)
+	r := bufio.NewReader(feed.mc.conn)
+	var headerBuf [gomemcached.HDR_LEN]byte
+loop:
+	for {
+		magic, err := r.Peek(1)
+		if err != nil {
+			if err != io.EOF {
+				feed.Error = err
+			}
+			break loop
+		}
+
+		var event *DcpEvent
+		n := 0
+		if magic[0] == gomemcached.RES_MAGIC ||
+			magic[0] == gomemcached.ALT_RES_MAGIC {
+			var res gomemcached.MCResponse
+			if _, err := res.Receive(r, headerBuf[:]); err != nil {
+				feed.Error = err
+				break loop
+			}
+			event = makeDcpResponseEvent(&res)
+		} else {
+			var pkt gomemcached.MCRequest
+			n, err = pkt.Receive(r, headerBuf[:])
+			if err != nil {
+				feed.Error = err
+				break loop
+			}
+			if pkt.Opcode == gomemcached.DCP_NOOP {
+				err := feed.respond(&gomemcached.MCResponse{
+					Opcode: pkt.Opcode,
+					Opaque: pkt.Opaque,
+				})
+				if err != nil {
+					feed.Error = err
+					break loop
+				}
+				continue
+			}
+			event = makeDcpEvent(pkt)
+		}
+
+		if event != nil {
+			select {
+			case ch <- *event:
+			case <-feed.closer:
+				break loop
+			}
+		}
+
+		if err := feed.consumed(n); err != nil {
+			feed.Error = err
+			break loop
+		}
+	}
+	if err := feed.mc.Close(); err != nil {
+		log.Printf("Error closing memcached client:  %v", err)
+	}
+}
+
+// Close terminates a DcpFeed.
+//
+// Call this if you stop using a DcpFeed before its channel ends.
+func (feed *DcpFeed) Close() {
+	close(feed.closer)
+}
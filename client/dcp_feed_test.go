@@ -0,0 +1,191 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestMakeDcpEvent(t *testing.T) {
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint64(extras, 12)
+	binary.BigEndian.PutUint64(extras[8:], 3)
+	binary.BigEndian.PutUint32(extras[16:], 0xf1a9)
+	binary.BigEndian.PutUint32(extras[20:], 900)
+	binary.BigEndian.PutUint16(extras[28:], 2)
+	e := makeDcpEvent(gomemcached.MCRequest{
+		Opcode:  gomemcached.DCP_MUTATION,
+		VBucket: 4,
+		Key:     []byte("k"),
+		Body:    []byte("valuemm"),
+		Extras:  extras,
+		Cas:     99,
+	})
+	if e.Seqno != 12 || e.RevSeqno != 3 || e.Flags != 0xf1a9 ||
+		e.Expiry != 900 || e.Cas != 99 || e.VBucket != 4 {
+		t.Errorf("Incorrectly parsed mutation: %#v", e)
+	}
+	if string(e.Value) != "value" {
+		t.Errorf("Expected extended metadata stripped, got %q", e.Value)
+	}
+
+	if e := makeDcpEvent(gomemcached.MCRequest{
+		Opcode: gomemcached.DCP_DELETION,
+		Extras: make([]byte, 4),
+	}); e != nil {
+		t.Errorf("Expected short extras to be rejected, got %v", e)
+	}
+
+	e = makeDcpResponseEvent(&gomemcached.MCResponse{
+		Opcode: gomemcached.DCP_STREAM_REQ,
+		Status: gomemcached.ROLLBACK,
+		Opaque: 7,
+		Body:   []byte{0, 0, 0, 0, 0, 0, 0, 42},
+	})
+	if e.VBucket != 7 || e.Seqno != 42 {
+		t.Errorf("Expected a rollback of vbucket 7 to 42, got %v", e)
+	}
+}
+
+func TestDcpFeed(t *testing.T) {
+	cli, srv := net.Pipe()
+	seen := make(chan *gomemcached.MCRequest, 32)
+	got := make(chan *gomemcached.MCRequest, 32)
+	go func() {
+		defer close(got)
+		for {
+			req := &gomemcached.MCRequest{}
+			if _, err := req.Receive(srv, nil); err != nil {
+				return
+			}
+			got <- req
+		}
+	}()
+	go func() {
+		for req := range got {
+			seen <- req
+			switch req.Opcode {
+			case gomemcached.DCP_OPEN, gomemcached.DCP_CONTROL:
+				res := &gomemcached.MCResponse{Opcode: req.Opcode, Opaque: req.Opaque}
+				res.Transmit(srv)
+			case gomemcached.DCP_STREAM_REQ:
+				flog := make([]byte, 16)
+				binary.BigEndian.PutUint64(flog, 0xabc)
+				res := &gomemcached.MCResponse{
+					Opcode: req.Opcode,
+					Opaque: req.Opaque,
+					Body:   flog,
+				}
+				res.Transmit(srv)
+
+				vb := req.VBucket
+				for _, pkt := range []*gomemcached.MCRequest{
+					{Opcode: gomemcached.DCP_SNAPSHOT_MARKER, Extras: make([]byte, 20)},
+					{Opcode: gomemcached.DCP_MUTATION, Key: []byte("key"),
+						Extras: append(make([]byte, 29), 2, 0), Body: []byte("valuemm")},
+					{Opcode: gomemcached.DCP_NOOP, Opaque: 77},
+					{Opcode: gomemcached.DCP_DELETION, Key: []byte("key"),
+						Extras: make([]byte, 18)},
+					{Opcode: gomemcached.DCP_STREAM_END, Extras: make([]byte, 4)},
+				} {
+					if pkt.Opcode != gomemcached.DCP_NOOP {
+						pkt.VBucket = vb
+					}
+					pkt.Transmit(srv)
+				}
+			}
+		}
+	}()
+
+	mc, err := Wrap(cli)
+	must(err)
+	feed, err := mc.StartDcpFeed(DcpArguments{
+		Name:         "test",
+		BufferSize:   100,
+		NoopInterval: 10,
+	})
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	err = feed.StreamRequest(DcpStreamArguments{
+		VBucket:  5,
+		EndSeqno: DcpNoEnd,
+		VBUUID:   0xabc,
+	})
+	if err != nil {
+		t.Fatalf("Error requesting stream: %v", err)
+	}
+
+	exp := []gomemcached.CommandCode{
+		gomemcached.DCP_STREAM_REQ,
+		gomemcached.DCP_SNAPSHOT_MARKER,
+		gomemcached.DCP_MUTATION,
+		gomemcached.DCP_DELETION,
+		gomemcached.DCP_STREAM_END,
+	}
+	for i, op := range exp {
+		e := <-feed.C
+		if e.Opcode != op || e.VBucket != 5 {
+			t.Fatalf("Expected %v on vbucket 5 for event %v, got %v", op, i, e)
+		}
+		if i == 0 && (len(e.FailoverLog) != 1 || e.FailoverLog[0].VBUUID != 0xabc) {
+			t.Errorf("Expected a failover log, got %v", e.FailoverLog)
+		}
+		if op == gomemcached.DCP_MUTATION && string(e.Value) != "value" {
+			t.Errorf("Expected a value, got %q", e.Value)
+		}
+	}
+
+	sent := []string{}
+	acked := []uint32{}
+	for len(sent) < 10 {
+		req := <-seen
+		switch req.Opcode {
+		case gomemcached.DCP_BUFFER_ACK:
+			acked = append(acked, binary.BigEndian.Uint32(req.Extras))
+		case gomemcached.DCP_STREAM_REQ:
+			if binary.BigEndian.Uint64(req.Extras[16:]) != DcpNoEnd ||
+				binary.BigEndian.Uint64(req.Extras[24:]) != 0xabc {
+				t.Errorf("Incorrect stream request extras: %v", req.Extras)
+			}
+		case gomemcached.DCP_NOOP:
+			if req.Opaque != 77 {
+				t.Errorf("Expected the noop's opaque, got %v", req.Opaque)
+			}
+		}
+		sent = append(sent, req.Opcode.String()+":"+string(req.Key)+string(req.Body))
+	}
+	expSent := []string{
+		"DCP_OPEN:test",
+		"DCP_CONTROL:connection_buffer_size100",
+		"DCP_CONTROL:enable_nooptrue",
+		"DCP_CONTROL:set_noop_interval10",
+		"DCP_STREAM_REQ:",
+		"DCP_BUFFER_ACK:",
+		"DCP_BUFFER_ACK:",
+		"DCP_NOOP:",
+		"DCP_BUFFER_ACK:",
+		"DCP_BUFFER_ACK:",
+	}
+	for i := range expSent {
+		if sent[i] != expSent[i] {
+			t.Fatalf("Expected %q, got %q", expSent, sent)
+		}
+	}
+	expAcked := []uint32{44, 65, 45, 28}
+	for i := range expAcked {
+		if acked[i] != expAcked[i] {
+			t.Fatalf("Expected acks of %v, got %v", expAcked, acked)
+		}
+	}
+
+	srv.Close()
+	for e := range feed.C {
+		t.Errorf("Unexpected event: %v", e)
+	}
+	if feed.Error != nil {
+		t.Errorf("Expected a clean end, got %v", feed.Error)
+	}
+}
@@ -16,14 +16,46 @@ import (
 
 const bufsize = 1024
 
+// ClientIface is the set of operations a Client supports.
+//
+// Code written against this rather than *Client can be tested with
+// the in-memory fake in the memcachedtest package.
+type ClientIface interface {
+	Add(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error)
+	Append(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error)
+	Auth(user, pass string) (*gomemcached.MCResponse, error)
+	AuthList() (*gomemcached.MCResponse, error)
+	CAS(vb uint16, k string, f CasFunc, initexp int) (*gomemcached.MCResponse, error)
+	Close() error
+	Del(vb uint16, key string) (*gomemcached.MCResponse, error)
+	Get(vb uint16, key string) (*gomemcached.MCResponse, error)
+	GetBulk(vb uint16, keys []string) (map[string]*gomemcached.MCResponse, error)
+	Incr(vb uint16, key string, amt, def uint64, exp int) (uint64, error)
+	IsHealthy() bool
+	Observe(vb uint16, key string) (ObserveResult, error)
+	Send(req *gomemcached.MCRequest) (*gomemcached.MCResponse, error)
+	Set(vb uint16, key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error)
+	Stats(key string) ([]StatValue, error)
+	StatsMap(key string) (map[string]string, error)
+}
+
+var _ ClientIface = (*Client)(nil)
+
 // The Client itself.
 type Client struct {
 	conn    io.ReadWriteCloser
 	healthy bool
 
-	hdrBuf []byte
+	hdrBuf      []byte
+	features    map[gomemcached.Feature]bool
+	compress    bool
+	collections map[string]uint32
+	collection  uint32
 }
 
+// Values shorter than this aren't worth compressing.
+var CompressionMinSize = 32
+
 var dialFun = net.Dial
 
 // Connect to a memcached server.
@@ -58,21 +90,63 @@ func (c Client) IsHealthy() bool {
 	return c.healthy
 }
 
+// EnableCompression makes the client snappy compress the values it
+// stores once the server has agreed to FEATURE_SNAPPY with Hello.
+//
+// Compressed responses are always decompressed.
+func (c *Client) EnableCompression(on bool) {
+	c.compress = on
+}
+
+// prepare returns the request as it should be sent, with its key
+// prefixed by its collection and its body compressed as negotiated.
+func (c *Client) prepare(req *gomemcached.MCRequest) *gomemcached.MCRequest {
+	return c.compressed(c.withCollection(req))
+}
+
+// compressed returns the request with its body compressed if that's
+// enabled and worthwhile.
+func (c *Client) compressed(req *gomemcached.MCRequest) *gomemcached.MCRequest {
+	if !c.compress || !c.features[gomemcached.FEATURE_SNAPPY] ||
+		req.DataType&gomemcached.DATATYPE_SNAPPY != 0 ||
+		len(req.Body) < CompressionMinSize {
+		return req
+	}
+	switch req.Opcode {
+	case gomemcached.SET, gomemcached.SETQ, gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ,
+		gomemcached.APPEND, gomemcached.APPENDQ,
+		gomemcached.PREPEND, gomemcached.PREPENDQ:
+	default:
+		return req
+	}
+
+	body := gomemcached.SnappyEncode(req.Body)
+	if len(body) >= len(req.Body) {
+		return req
+	}
+	rv := *req
+	rv.Body = body
+	rv.DataType |= gomemcached.DATATYPE_SNAPPY
+	return &rv
+}
+
 // Send a custom request and get the response.
 func (c *Client) Send(req *gomemcached.MCRequest) (rv *gomemcached.MCResponse, err error) {
-	_, err = transmitRequest(c.conn, req)
+	_, err = transmitRequest(c.conn, c.prepare(req))
 	if err != nil {
 		c.healthy = false
 		return
 	}
 	resp, _, err := getResponse(c.conn, c.hdrBuf)
 	c.healthy = !gomemcached.IsFatal(err)
+	c.received(resp, err)
 	return resp, err
 }
 
 // Transmit send a request, but does not wait for a response.
 func (c *Client) Transmit(req *gomemcached.MCRequest) error {
-	_, err := transmitRequest(c.conn, req)
+	_, err := transmitRequest(c.conn, c.prepare(req))
 	if err != nil {
 		c.healthy = false
 	}
@@ -85,6 +159,7 @@ func (c *Client) Receive() (*gomemcached.MCResponse, error) {
 	if err != nil {
 		c.healthy = false
 	}
+	c.received(resp, err)
 	return resp, err
 }
 
@@ -129,6 +204,36 @@ func (c *Client) Auth(user, pass string) (*gomemcached.MCResponse, error) {
 	return res, fmt.Errorf("auth mechanism PLAIN not supported")
 }
 
+// Hello identifies the client by name and asks for the given features.
+//
+// The features the server agreed to are returned and replace any
+// previously negotiated.
+func (c *Client) Hello(name string, features ...gomemcached.Feature) ([]gomemcached.Feature, error) {
+	res, err := c.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.HELLO,
+		Key:    []byte(name),
+		Body:   gomemcached.EncodeFeatures(features),
+	})
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := gomemcached.DecodeFeatures(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.features = map[gomemcached.Feature]bool{}
+	c.collections = nil
+	for _, f := range enabled {
+		c.features[f] = true
+	}
+	return enabled, nil
+}
+
+// HasFeature is true if the feature was negotiated with Hello.
+func (c *Client) HasFeature(f gomemcached.Feature) bool {
+	return c.features[f]
+}
+
 func (c *Client) store(opcode gomemcached.CommandCode, vb uint16,
 	key string, flags int, exp int, body []byte) (*gomemcached.MCResponse, error) {
 
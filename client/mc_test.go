@@ -373,3 +373,126 @@ func TestCasOpError(t *testing.T) {
 		}
 	}
 }
+
+// serveFake returns a client whose requests are answered by h over
+// an in-memory connection.  A nil response from h sends nothing.
+func serveFake(h func(*gomemcached.MCRequest) *gomemcached.MCResponse) *Client {
+	cli, srv := net.Pipe()
+	go func() {
+		defer srv.Close()
+		for {
+			var req gomemcached.MCRequest
+			if _, err := req.Receive(srv, nil); err != nil {
+				return
+			}
+			res := h(&req)
+			if res == nil {
+				continue
+			}
+			res.Opcode = req.Opcode
+			res.Opaque = req.Opaque
+			if _, err := res.Transmit(srv); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := Wrap(cli)
+	must(err)
+	return c
+}
+
+func TestHello(t *testing.T) {
+	var name string
+	c := serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		name = string(req.Key)
+		requested, _ := gomemcached.DecodeFeatures(req.Body)
+		enabled := []gomemcached.Feature{}
+		for _, f := range requested {
+			if f != gomemcached.FEATURE_COLLECTIONS {
+				enabled = append(enabled, f)
+			}
+		}
+		return &gomemcached.MCResponse{Body: gomemcached.EncodeFeatures(enabled)}
+	})
+	defer c.Close()
+
+	if c.HasFeature(gomemcached.FEATURE_JSON) {
+		t.Errorf("Expected no features before negotiating")
+	}
+	got, err := c.Hello("tester", gomemcached.FEATURE_JSON,
+		gomemcached.FEATURE_COLLECTIONS)
+	if err != nil {
+		t.Fatalf("Error saying hello: %v", err)
+	}
+	if name != "tester" {
+		t.Errorf("Expected to be called tester, was %q", name)
+	}
+	exp := []gomemcached.Feature{gomemcached.FEATURE_JSON}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	if !c.HasFeature(gomemcached.FEATURE_JSON) ||
+		c.HasFeature(gomemcached.FEATURE_COLLECTIONS) {
+		t.Errorf("Expected only JSON, got %v", c.features)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	value := bytes.Repeat([]byte("compress me "), 100)
+	var stored *gomemcached.MCRequest
+	c := serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		switch req.Opcode {
+		case gomemcached.HELLO:
+			return &gomemcached.MCResponse{Body: req.Body}
+		case gomemcached.SET:
+			stored = req
+			return &gomemcached.MCResponse{}
+		}
+		return &gomemcached.MCResponse{
+			Extras:   stored.Extras[:4],
+			DataType: stored.DataType,
+			Body:     stored.Body,
+		}
+	})
+	defer c.Close()
+
+	c.EnableCompression(true)
+	c.Set(0, "k", 0, 0, value)
+	if stored.DataType != gomemcached.DATATYPE_RAW {
+		t.Errorf("Expected no compression before negotiating, got %v", stored.DataType)
+	}
+
+	if _, err := c.Hello("test", gomemcached.FEATURE_SNAPPY); err != nil {
+		t.Fatalf("Error negotiating: %v", err)
+	}
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.SET,
+		Key:    []byte("k"),
+		Extras: make([]byte, 8),
+		Body:   value,
+	}
+	if _, err := c.Send(req); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if stored.DataType != gomemcached.DATATYPE_SNAPPY || len(stored.Body) >= len(value) {
+		t.Errorf("Expected a compressed value, got %v with %d bytes",
+			stored.DataType, len(stored.Body))
+	}
+	if !bytes.Equal(req.Body, value) || req.DataType != gomemcached.DATATYPE_RAW {
+		t.Errorf("Expected the caller's request to be left alone")
+	}
+
+	res, err := c.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if !bytes.Equal(res.Body, value) || res.DataType != gomemcached.DATATYPE_RAW {
+		t.Errorf("Expected the value back uncompressed, got %v with %d bytes",
+			res.DataType, len(res.Body))
+	}
+
+	c.Set(0, "k", 0, 0, []byte("short"))
+	if stored.DataType != gomemcached.DATATYPE_RAW {
+		t.Errorf("Expected short values to be left alone, got %v", stored.DataType)
+	}
+}
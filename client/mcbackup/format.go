@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A backup is the magic string followed by item records and an end
+// record.  Every record starts with its type and ends with a CRC32C
+// of the rest of it:
+//
+//	item: type(1) vbucket(2) flags(4) expiry(4) cas(8)
+//	      keylen(2) vallen(4) key value crc(4)
+//	end:  type(1) count(8) crc(4)
+//
+// All numbers are big endian.  A file without an end record was cut
+// short.
+const backupMagic = "GOMCBAK1"
+
+const (
+	recordEnd  = 0
+	recordItem = 1
+)
+
+const itemHeaderLen = 1 + 2 + 4 + 4 + 8 + 2 + 4
+
+var (
+	errBadMagic  = errors.New("not a backup file")
+	errChecksum  = errors.New("checksum mismatch")
+	errBadRecord = errors.New("unknown record type")
+	errBadCount  = errors.New("item count mismatch")
+	errTooLarge  = errors.New("key too large")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// item is a backed up item.
+type item struct {
+	VBucket uint16
+	Flags   uint32
+	Expiry  uint32
+	Cas     uint64
+	Key     []byte
+	Value   []byte
+}
+
+type backupWriter struct {
+	w     *bufio.Writer
+	count uint64
+}
+
+func newBackupWriter(w io.Writer) (*backupWriter, error) {
+	bw := &backupWriter{w: bufio.NewWriter(w)}
+	_, err := bw.w.WriteString(backupMagic)
+	return bw, err
+}
+
+// record writes the given pieces of a record and their checksum.
+func (bw *backupWriter) record(parts ...[]byte) error {
+	crc := uint32(0)
+	for _, p := range parts {
+		crc = crc32.Update(crc, crcTable, p)
+		if _, err := bw.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return binary.Write(bw.w, binary.BigEndian, crc)
+}
+
+func (bw *backupWriter) write(it item) error {
+	if len(it.Key) > 0xffff {
+		return errTooLarge
+	}
+	hdr := make([]byte, itemHeaderLen)
+	hdr[0] = recordItem
+	binary.BigEndian.PutUint16(hdr[1:], it.VBucket)
+	binary.BigEndian.PutUint32(hdr[3:], it.Flags)
+	binary.BigEndian.PutUint32(hdr[7:], it.Expiry)
+	binary.BigEndian.PutUint64(hdr[11:], it.Cas)
+	binary.BigEndian.PutUint16(hdr[19:], uint16(len(it.Key)))
+	binary.BigEndian.PutUint32(hdr[21:], uint32(len(it.Value)))
+	bw.count++
+	return bw.record(hdr, it.Key, it.Value)
+}
+
+// close writes the end record.  It doesn't close the underlying
+// writer.
+func (bw *backupWriter) close() error {
+	end := make([]byte, 9)
+	end[0] = recordEnd
+	binary.BigEndian.PutUint64(end[1:], bw.count)
+	if err := bw.record(end); err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+type backupReader struct {
+	r     *bufio.Reader
+	count uint64
+	done  bool
+}
+
+func newBackupReader(r io.Reader) (*backupReader, error) {
+	br := &backupReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(backupMagic))
+	if _, err := io.ReadFull(br.r, magic); err != nil {
+		return nil, errBadMagic
+	}
+	if string(magic) != backupMagic {
+		return nil, errBadMagic
+	}
+	return br, nil
+}
+
+func (br *backupReader) readFull(b []byte) error {
+	_, err := io.ReadFull(br.r, b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// check reads a record's checksum and compares it to its contents.
+func (br *backupReader) check(parts ...[]byte) error {
+	crc := uint32(0)
+	for _, p := range parts {
+		crc = crc32.Update(crc, crcTable, p)
+	}
+	b := make([]byte, 4)
+	if err := br.readFull(b); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(b) != crc {
+		return errChecksum
+	}
+	return nil
+}
+
+// next returns the next item, or io.EOF after a complete backup.
+func (br *backupReader) next() (item, error) {
+	if br.done {
+		return item{}, io.EOF
+	}
+	typ, err := br.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return item{}, err
+	}
+
+	switch typ {
+	case recordEnd:
+		end := make([]byte, 9)
+		end[0] = typ
+		if err := br.readFull(end[1:]); err != nil {
+			return item{}, err
+		}
+		if err := br.check(end); err != nil {
+			return item{}, err
+		}
+		if binary.BigEndian.Uint64(end[1:]) != br.count {
+			return item{}, errBadCount
+		}
+		br.done = true
+		return item{}, io.EOF
+	case recordItem:
+	default:
+		return item{}, errBadRecord
+	}
+
+	hdr := make([]byte, itemHeaderLen)
+	hdr[0] = typ
+	if err := br.readFull(hdr[1:]); err != nil {
+		return item{}, err
+	}
+	it := item{
+		VBucket: binary.BigEndian.Uint16(hdr[1:]),
+		Flags:   binary.BigEndian.Uint32(hdr[3:]),
+		Expiry:  binary.BigEndian.Uint32(hdr[7:]),
+		Cas:     binary.BigEndian.Uint64(hdr[11:]),
+		Key:     make([]byte, binary.BigEndian.Uint16(hdr[19:])),
+	}
+	vlen := binary.BigEndian.Uint32(hdr[21:])
+	if err := br.readFull(it.Key); err != nil {
+		return item{}, err
+	}
+	// Don't trust the length until the data is there.
+	var value bytes.Buffer
+	if _, err := io.CopyN(&value, br.r, int64(vlen)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return item{}, err
+	}
+	it.Value = value.Bytes()
+	if err := br.check(hdr, it.Key, it.Value); err != nil {
+		return item{}, err
+	}
+	br.count++
+	return it, nil
+}
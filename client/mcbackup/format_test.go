@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+var testItems = []item{
+	{VBucket: 3, Flags: 0xdeadbeef, Expiry: 60, Cas: 1 << 40,
+		Key: []byte("one"), Value: []byte("first value")},
+	{Key: []byte("empty"), Value: []byte{}},
+	{VBucket: 1023, Key: bytes.Repeat([]byte("k"), 250),
+		Value: bytes.Repeat([]byte("v"), 70000)},
+}
+
+func writeBackup(t *testing.T, items []item) []byte {
+	buf := &bytes.Buffer{}
+	bw, err := newBackupWriter(buf)
+	if err != nil {
+		t.Fatalf("Error starting backup: %v", err)
+	}
+	for _, it := range items {
+		if err := bw.write(it); err != nil {
+			t.Fatalf("Error writing %v: %v", it, err)
+		}
+	}
+	if err := bw.close(); err != nil {
+		t.Fatalf("Error closing backup: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func readBackup(data []byte) ([]item, error) {
+	br, err := newBackupReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	rv := []item{}
+	for {
+		it, err := br.next()
+		if err == io.EOF {
+			return rv, nil
+		}
+		if err != nil {
+			return rv, err
+		}
+		if it.Value == nil {
+			it.Value = []byte{}
+		}
+		rv = append(rv, it)
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	for _, items := range [][]item{{}, testItems} {
+		got, err := readBackup(writeBackup(t, items))
+		if err != nil {
+			t.Fatalf("Error reading backup: %v", err)
+		}
+		if !reflect.DeepEqual(got, items) {
+			t.Errorf("Expected %v items back, got %v", len(items), len(got))
+		}
+	}
+}
+
+func TestBackupDamage(t *testing.T) {
+	data := writeBackup(t, testItems)
+
+	if _, err := readBackup([]byte("GOMCBAK9")); err != errBadMagic {
+		t.Errorf("Expected a bad magic error, got %v", err)
+	}
+
+	// Cut short anywhere after the magic.
+	for _, n := range []int{len(backupMagic), len(backupMagic) + 5, len(data) / 2, len(data) - 1} {
+		if _, err := readBackup(data[:n]); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected unexpected EOF at %v, got %v", n, err)
+		}
+	}
+
+	// Flip a bit in the first value.
+	bad := append([]byte{}, data...)
+	bad[len(backupMagic)+itemHeaderLen+len("one")+2] ^= 4
+	got, err := readBackup(bad)
+	if err != errChecksum || len(got) != 0 {
+		t.Errorf("Expected a checksum error, got %v after %v", err, got)
+	}
+
+	// Drop the middle item.
+	first := len(backupMagic) + itemHeaderLen + len("one") + len("first value") + 4
+	second := first + itemHeaderLen + len("empty") + 4
+	bad = append(append([]byte{}, data[:first]...), data[second:]...)
+	if _, err := readBackup(bad); err != errBadCount {
+		t.Errorf("Expected a count error, got %v", err)
+	}
+}
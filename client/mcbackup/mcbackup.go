@@ -0,0 +1,221 @@
+// Mcbackup saves the items of a server to a file and restores them.
+//
+//	mcbackup [flags] backup <file>
+//	mcbackup [flags] restore <file>
+//
+// A backup is a TAP dump of every item, written as checksummed
+// records as they arrive.  The end record is only written once the
+// server says the dump is complete.  A file of "-" is stdout or
+// stdin, so backups can be piped through compression or over the
+// network.
+// Restoring sets every item in the file on the server, with its
+// flags, expiry and vbucket, using pipelined SETQs.  CAS values are
+// saved but a restore can't recreate them.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+)
+
+var prot = flag.String("prot", "tcp", "Layer 3 protocol (tcp, tcp4, tcp6)")
+var server = flag.String("server", "localhost:11210", "Host:port to connect to")
+var u = flag.String("user", "", "SASL plain username")
+var p = flag.String("pass", "", "SASL plain password")
+var batchSize = flag.Int("batch", 100, "Items to pipeline per restore round trip")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] backup|restore <file>\n", os.Args[0])
+	flag.PrintDefaults()
+	os.Exit(64)
+}
+
+func connect() *memcached.Client {
+	client, err := memcached.Connect(*prot, *server)
+	if err != nil {
+		log.Fatalf("Error connecting: %v", err)
+	}
+	if *u != "" {
+		if _, err := client.Auth(*u, *p); err != nil {
+			log.Fatalf("auth error: %v", err)
+		}
+	}
+	return client
+}
+
+func backup(client *memcached.Client, w io.Writer) (uint64, error) {
+	bw, err := newBackupWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	args := memcached.DefaultTapArguments()
+	args.Dump = true
+	args.Backfill = 0
+	feed, err := client.StartTapFeed(args)
+	if err != nil {
+		return 0, err
+	}
+	defer feed.Close()
+
+	for e := range feed.C {
+		if e.Opcode != memcached.TapMutation {
+			continue
+		}
+		err := bw.write(item{
+			VBucket: e.VBucket,
+			Flags:   e.Flags,
+			Expiry:  e.Expiry,
+			Cas:     e.Cas,
+			Key:     e.Key,
+			Value:   e.Value,
+		})
+		if err != nil {
+			return bw.count, err
+		}
+	}
+	err = feed.Error
+	if err == nil && !feed.Ended {
+		err = errors.New("server hung up before the dump finished")
+	}
+	if err != nil {
+		// Keep what we got.  Without an end record, it reads as
+		// cut short.
+		bw.w.Flush()
+		return bw.count, err
+	}
+	return bw.count, bw.close()
+}
+
+// setBatch sets the items on the server, and returns how many failed.
+func setBatch(client *memcached.Client, items []item) (int, error) {
+	for i, it := range items {
+		req := &gomemcached.MCRequest{
+			Opcode:  gomemcached.SETQ,
+			VBucket: it.VBucket,
+			Key:     it.Key,
+			Extras:  make([]byte, 8),
+			Body:    it.Value,
+			Opaque:  uint32(i),
+		}
+		binary.BigEndian.PutUint32(req.Extras, it.Flags)
+		binary.BigEndian.PutUint32(req.Extras[4:], it.Expiry)
+		if err := client.Transmit(req); err != nil {
+			return 0, err
+		}
+	}
+	err := client.Transmit(&gomemcached.MCRequest{Opcode: gomemcached.NOOP})
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for {
+		res, err := client.Receive()
+		if _, ok := err.(*gomemcached.MCResponse); err != nil && !ok {
+			return failed, err
+		}
+		if res.Opcode == gomemcached.NOOP {
+			return failed, nil
+		}
+		failed++
+		if int(res.Opaque) < len(items) {
+			log.Printf("Error restoring %s: %v", items[res.Opaque].Key, res)
+		}
+	}
+}
+
+func restore(client *memcached.Client, r io.Reader) (uint64, int, error) {
+	br, err := newBackupReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	failed := 0
+	batch := []item{}
+	flush := func() error {
+		n, err := setBatch(client, batch)
+		failed += n
+		batch = batch[:0]
+		return err
+	}
+	for {
+		it, err := br.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Still restore what was read intact.
+			flush()
+			return br.count, failed, err
+		}
+		batch = append(batch, it)
+		if len(batch) >= *batchSize {
+			if err := flush(); err != nil {
+				return br.count, failed, err
+			}
+		}
+	}
+	return br.count, failed, flush()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 2 {
+		usage()
+	}
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+	cmd, fn := flag.Arg(0), flag.Arg(1)
+
+	switch cmd {
+	case "backup":
+		w := os.Stdout
+		if fn != "-" {
+			f, err := os.Create(fn)
+			if err != nil {
+				log.Fatalf("Error creating backup: %v", err)
+			}
+			defer f.Close()
+			w = f
+		}
+		n, err := backup(connect(), w)
+		if err == nil && w != os.Stdout {
+			err = w.Sync()
+		}
+		if err != nil {
+			log.Fatalf("Error after backing up %v items: %v", n, err)
+		}
+		log.Printf("Backed up %v items", n)
+	case "restore":
+		r := os.Stdin
+		if fn != "-" {
+			f, err := os.Open(fn)
+			if err != nil {
+				log.Fatalf("Error opening backup: %v", err)
+			}
+			defer f.Close()
+			r = f
+		}
+		n, failed, err := restore(connect(), r)
+		if err != nil {
+			log.Fatalf("Error after restoring %v items: %v", n, err)
+		}
+		log.Printf("Restored %v items, %v failed", n, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/client/memcachedtest"
+	mcserver "github.com/dustin/gomemcached/server"
+	"github.com/dustin/gomemcached/server/mcstore"
+)
+
+// serve answers one connection with h.  It's a real socket rather
+// than a pipe, so pipelined requests don't deadlock with responses.
+func serve(t *testing.T, h mcserver.RequestHandler) *memcached.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go func() {
+		s, err := l.Accept()
+		l.Close()
+		if err == nil {
+			mcserver.HandleIO(s, h)
+		}
+	}()
+	c, err := memcached.Connect("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return c
+}
+
+func connectTest(t *testing.T, srv *memcachedtest.Server) *memcached.Client {
+	c, err := memcached.Connect(srv.Network, srv.Addr)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return c
+}
+
+func expectValue(t *testing.T, c *memcached.Client, vb uint16, key, exp string) {
+	res, err := c.Get(vb, key)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", key, err)
+	}
+	if string(res.Body) != exp {
+		t.Fatalf("Expected %v=%q, got %q", key, exp, res.Body)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	from := memcachedtest.NewServer()
+	defer from.Close()
+	c := connectTest(t, from)
+	defer c.Close()
+	if _, err := c.Set(3, "a", 7, 0, []byte("A")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if _, err := c.Set(5, "b", 0, 0, []byte("B")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	n, err := backup(connectTest(t, from), buf)
+	if n != 2 || err != nil {
+		t.Fatalf("Expected to back up 2 items, got %v, %v", n, err)
+	}
+	if items, err := readBackup(buf.Bytes()); len(items) != 2 || err != nil {
+		t.Fatalf("Expected 2 items in the backup, got %v, %v", items, err)
+	}
+
+	to := memcachedtest.NewServer()
+	defer to.Close()
+	c2 := connectTest(t, to)
+	defer c2.Close()
+	n, failed, err := restore(c2, buf)
+	if n != 2 || failed != 0 || err != nil {
+		t.Fatalf("Expected to restore 2 items, got %v, %v failed, %v", n, failed, err)
+	}
+	expectValue(t, c2, 3, "a", "A")
+	expectValue(t, c2, 5, "b", "B")
+}
+
+func TestBackupHangup(t *testing.T) {
+	c := serve(t, mcserver.FuncHandler(func(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		pkt := &gomemcached.MCRequest{
+			Opcode: gomemcached.TAP_MUTATION,
+			Key:    []byte("a"),
+			Extras: make([]byte, 16),
+			Body:   []byte("A"),
+		}
+		pkt.Transmit(w)
+		// Hang up without ending the dump.
+		return &gomemcached.MCResponse{Fatal: true}
+	}))
+
+	buf := &bytes.Buffer{}
+	n, err := backup(c, buf)
+	if n != 1 || err == nil {
+		t.Fatalf("Expected an error after 1 item, got %v, %v", n, err)
+	}
+	if _, err := readBackup(buf.Bytes()); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected a backup without an end record, got %v", err)
+	}
+}
+
+func TestRestoreItemErrors(t *testing.T) {
+	store := mcstore.New()
+	c := serve(t, mcserver.FuncHandler(func(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		if string(req.Key) == "big" {
+			return &gomemcached.MCResponse{Status: gomemcached.E2BIG}
+		}
+		return store.HandleMessage(w, req)
+	}))
+	defer c.Close()
+
+	data := writeBackup(t, []item{
+		{Key: []byte("a"), Value: []byte("A")},
+		{Key: []byte("big"), Value: []byte("B")},
+		{Key: []byte("c"), Value: []byte("C")},
+	})
+	n, failed, err := restore(c, bytes.NewReader(data))
+	if n != 3 || failed != 1 || err != nil {
+		t.Fatalf("Expected 1 of 3 items to fail, got %v, %v failed, %v", n, failed, err)
+	}
+	// The connection is still in step.
+	expectValue(t, c, 0, "a", "A")
+	expectValue(t, c, 0, "c", "C")
+}
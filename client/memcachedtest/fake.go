@@ -0,0 +1,352 @@
+// Package memcachedtest provides in-memory stand-ins for memcached
+// servers and clients for use in tests.
+package memcachedtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/server/mcstore"
+)
+
+// ErrClosed is returned by operations on a closed Fake.
+var ErrClosed = errors.New("memcachedtest: use of closed fake")
+
+// Fake is an in-memory stand-in for a memcached.Client.
+//
+// Operations are applied directly to an mcstore.Store, with the same results
+// a client talking to a real server would see.  Errors and latency
+// can be injected to exercise failure handling.  A Fake is safe for
+// concurrent use.
+type Fake struct {
+	// The store operated on.  Several fakes may share one.
+	Store *mcstore.Store
+	// Added to the time taken by every operation.
+	Latency time.Duration
+	// If set, consulted before every operation.  A non-nil error
+	// fails the operation without touching the store.  Use an
+	// *gomemcached.MCResponse to simulate a server error status,
+	// anything else to simulate a communication failure.
+	Inject func(req *gomemcached.MCRequest) error
+
+	mu       sync.Mutex
+	failures []error
+	closed   bool
+	sick     bool
+}
+
+var _ memcached.ClientIface = (*Fake)(nil)
+
+// NewFake creates a fake with an empty store of its own.
+func NewFake() *Fake {
+	return &Fake{Store: mcstore.New()}
+}
+
+// FailNext makes the next len(errs) operations fail with the given
+// errors, in order.
+func (f *Fake) FailNext(errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, errs...)
+}
+
+func (f *Fake) injected(req *gomemcached.MCRequest) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if len(f.failures) > 0 {
+		err := f.failures[0]
+		f.failures = f.failures[1:]
+		return err
+	}
+	if f.Inject != nil {
+		return f.Inject(req)
+	}
+	return nil
+}
+
+func (f *Fake) setHealth(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sick = gomemcached.IsFatal(err)
+}
+
+// Send a custom request and get the response.
+func (f *Fake) Send(req *gomemcached.MCRequest) (*gomemcached.MCResponse, error) {
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	err := f.injected(req)
+	if err != nil {
+		f.setHealth(err)
+		if res, ok := err.(*gomemcached.MCResponse); ok {
+			return res, err
+		}
+		return nil, err
+	}
+
+	res := f.Store.HandleMessage(ioutil.Discard, req)
+	if res == nil {
+		// A quiet command with nothing to say.  A real client
+		// would be left waiting; call it a success instead.
+		res = &gomemcached.MCResponse{}
+	}
+	res.Opcode = req.Opcode
+	res.Opaque = req.Opaque
+	if res.Status != gomemcached.SUCCESS {
+		err = res
+	}
+	f.setHealth(err)
+	return res, err
+}
+
+// Close the fake.  Further operations will fail.
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	return nil
+}
+
+// IsHealthy is false after a communication failure, until the next
+// successful operation.
+func (f *Fake) IsHealthy() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.closed && !f.sick
+}
+
+// Get the value for a key.
+func (f *Fake) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	return f.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.GET,
+		VBucket: vb,
+		Key:     []byte(key),
+	})
+}
+
+// Del deletes a key.
+func (f *Fake) Del(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	return f.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.DELETE,
+		VBucket: vb,
+		Key:     []byte(key),
+	})
+}
+
+// AuthList lists SASL auth mechanisms.
+func (f *Fake) AuthList() (*gomemcached.MCResponse, error) {
+	return f.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_LIST_MECHS})
+}
+
+// Auth performs SASL PLAIN authentication.  Any credentials work.
+func (f *Fake) Auth(user, pass string) (*gomemcached.MCResponse, error) {
+	return f.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.SASL_AUTH,
+		Key:    []byte("PLAIN"),
+		Body:   []byte(fmt.Sprintf("\x00%s\x00%s", user, pass))})
+}
+
+func storeRequest(opcode gomemcached.CommandCode, vb uint16,
+	key string, flags int, exp int, body []byte) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode:  opcode,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  make([]byte, 8),
+		Body:    body,
+	}
+	binary.BigEndian.PutUint64(req.Extras, uint64(flags)<<32|uint64(exp))
+	return req
+}
+
+// Add a value for a key (store if not exists).
+func (f *Fake) Add(vb uint16, key string, flags int, exp int,
+	body []byte) (*gomemcached.MCResponse, error) {
+	return f.Send(storeRequest(gomemcached.ADD, vb, key, flags, exp, body))
+}
+
+// Set the value for a key.
+func (f *Fake) Set(vb uint16, key string, flags int, exp int,
+	body []byte) (*gomemcached.MCResponse, error) {
+	return f.Send(storeRequest(gomemcached.SET, vb, key, flags, exp, body))
+}
+
+// Append data to the value of a key.
+func (f *Fake) Append(vb uint16, key string, data []byte) (*gomemcached.MCResponse, error) {
+	return f.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.APPEND,
+		VBucket: vb,
+		Key:     []byte(key),
+		Body:    data,
+	})
+}
+
+// Incr increments the value at the given key.
+func (f *Fake) Incr(vb uint16, key string,
+	amt, def uint64, exp int) (uint64, error) {
+
+	req := &gomemcached.MCRequest{
+		Opcode:  gomemcached.INCREMENT,
+		VBucket: vb,
+		Key:     []byte(key),
+		Extras:  make([]byte, 8+8+4),
+	}
+	binary.BigEndian.PutUint64(req.Extras[:8], amt)
+	binary.BigEndian.PutUint64(req.Extras[8:16], def)
+	binary.BigEndian.PutUint32(req.Extras[16:20], uint32(exp))
+
+	res, err := f.Send(req)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(res.Body), nil
+}
+
+// GetBulk gets keys in bulk.  Missing keys are left out of the result.
+//
+// As with memcached.Client, only the last key is fetched with a
+// plain GET, so if it's missing, its not found status is returned
+// as the error along with the rest of the keys.
+func (f *Fake) GetBulk(vb uint16, keys []string) (map[string]*gomemcached.MCResponse, error) {
+	rv := map[string]*gomemcached.MCResponse{}
+	for i, k := range keys {
+		res, err := f.Send(&gomemcached.MCRequest{
+			Opcode:  gomemcached.GET,
+			VBucket: vb,
+			Key:     []byte(k),
+			Opaque:  uint32(i),
+		})
+		switch {
+		case err == nil:
+			rv[k] = res
+		case !gomemcached.IsNotFound(err) || i == len(keys)-1:
+			return rv, err
+		}
+	}
+	return rv, nil
+}
+
+// CAS performs a CAS transform with the given function.
+//
+// It follows the same steps as memcached.Client's CAS, so it stops
+// and retries in the same places.  If the value does not exist, a
+// nil current value will be sent to fn.
+func (f *Fake) CAS(vb uint16, k string, fn memcached.CasFunc,
+	initexp int) (*gomemcached.MCResponse, error) {
+	for {
+		var current []byte
+		var cas uint64
+		exists := false
+		res, err := f.Get(vb, k)
+		switch {
+		case err == nil:
+			exists, current, cas = true, res.Body, res.Cas
+			if current == nil {
+				// Received bodies are never nil.
+				current = []byte{}
+			}
+		case res != nil && res.Status == gomemcached.KEY_ENOENT:
+		default:
+			return res, err
+		}
+
+		newValue, operation := fn(current)
+		if operation == memcached.CASQuit ||
+			(operation == memcached.CASDelete && current == nil) {
+			return nil, operation
+		}
+
+		// Like the client, what's stored depends only on the
+		// new value: nil deletes.
+		switch {
+		case !exists && newValue == nil:
+			return res, nil
+		case !exists:
+			res, err = f.Add(vb, k, 0, initexp, newValue)
+		case newValue == nil:
+			res, err = f.Send(&gomemcached.MCRequest{
+				Opcode:  gomemcached.DELETE,
+				VBucket: vb,
+				Key:     []byte(k),
+				Cas:     cas,
+			})
+		default:
+			req := storeRequest(gomemcached.SET, vb, k, 0, 0, newValue)
+			req.Cas = cas
+			res, err = f.Send(req)
+		}
+
+		if res != nil && (res.Status == gomemcached.KEY_EEXISTS ||
+			res.Status == gomemcached.NOT_STORED) {
+			continue
+		}
+		return res, err
+	}
+}
+
+// Observe gets the persistence/replication/CAS state of a key.
+//
+// Everything in a fake is always persisted.
+func (f *Fake) Observe(vb uint16, key string) (result memcached.ObserveResult, err error) {
+	body := make([]byte, 4+len(key))
+	binary.BigEndian.PutUint16(body[0:2], vb)
+	binary.BigEndian.PutUint16(body[2:4], uint16(len(key)))
+	copy(body[4:], key)
+
+	res, err := f.Send(&gomemcached.MCRequest{
+		Opcode:  gomemcached.OBSERVE,
+		VBucket: vb,
+		Body:    body,
+	})
+	if err != nil {
+		return
+	}
+	klen := len(key)
+	result.Status = memcached.ObservedStatus(res.Body[4+klen])
+	result.Cas = binary.BigEndian.Uint64(res.Body[5+klen:])
+	result.PersistenceTime = time.Duration(res.Cas>>32) * time.Millisecond
+	result.ReplicationTime = time.Duration(res.Cas&math.MaxUint32) * time.Millisecond
+	return
+}
+
+// Stats requests stats from the store.  Only toplevel stats exist.
+func (f *Fake) Stats(key string) ([]memcached.StatValue, error) {
+	rv := []memcached.StatValue{}
+	_, err := f.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.STAT,
+		Key:    []byte(key),
+	})
+	if err != nil {
+		return rv, err
+	}
+	for k, v := range f.Store.Stats() {
+		rv = append(rv, memcached.StatValue{Key: k, Val: v})
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Key < rv[j].Key })
+	return rv, nil
+}
+
+// StatsMap requests stats similarly to Stats, but returns them as a map.
+func (f *Fake) StatsMap(key string) (map[string]string, error) {
+	rv := map[string]string{}
+	st, err := f.Stats(key)
+	if err != nil {
+		return rv, err
+	}
+	for _, sv := range st {
+		rv[sv.Key] = sv.Val
+	}
+	return rv, nil
+}
@@ -0,0 +1,375 @@
+package memcachedtest
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/server/mcstore"
+)
+
+func TestFakeGetSet(t *testing.T) {
+	f := NewFake()
+	if _, err := f.Get(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+
+	set, err := f.Set(0, "k", 0xdeadbeef, 0, []byte("v"))
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	res, err := f.Get(0, "k")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != "v" || res.Cas != set.Cas {
+		t.Errorf("Expected v with cas %v, got %v", set.Cas, res)
+	}
+	if flags := binary.BigEndian.Uint32(res.Extras); flags != 0xdeadbeef {
+		t.Errorf("Expected flags to come back, got %x", flags)
+	}
+
+	if _, err := f.Add(0, "k", 0, 0, []byte("w")); err == nil {
+		t.Errorf("Expected add of existing key to fail")
+	}
+	if _, err := f.Del(0, "k"); err != nil {
+		t.Errorf("Error deleting: %v", err)
+	}
+	if _, err := f.Del(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found deleting twice, got %v", err)
+	}
+}
+
+func TestFakeCASMismatch(t *testing.T) {
+	f := NewFake()
+	res, _ := f.Set(0, "k", 0, 0, []byte("v"))
+	f.Set(0, "k", 0, 0, []byte("v2"))
+
+	req := storeRequest(gomemcached.SET, 0, "k", 0, 0, []byte("v3"))
+	req.Cas = res.Cas
+	res, err := f.Send(req)
+	if res == nil || res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected KEY_EEXISTS, got %v/%v", res, err)
+	}
+}
+
+func TestFakeCAS(t *testing.T) {
+	f := NewFake()
+	calls := 0
+	_, err := f.CAS(0, "k", func(current []byte) ([]byte, memcached.CasOp) {
+		calls++
+		if calls == 1 {
+			// Someone else gets in first.
+			f.Set(0, "k", 0, 0, []byte("a"))
+		}
+		return append(current, 'b'), memcached.CASStore
+	}, 0)
+	if err != nil {
+		t.Fatalf("Error in CAS: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("Expected a retry, got %v calls", calls)
+	}
+	res, _ := f.Get(0, "k")
+	if string(res.Body) != "ab" {
+		t.Errorf("Expected ab, got %q", res.Body)
+	}
+
+	_, err = f.CAS(0, "k", func([]byte) ([]byte, memcached.CasOp) {
+		return nil, memcached.CASDelete
+	}, 0)
+	if err != nil {
+		t.Fatalf("Error in CAS delete: %v", err)
+	}
+	if _, err := f.Get(0, "k"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected key to be deleted, got %v", err)
+	}
+}
+
+func TestFakeExpiry(t *testing.T) {
+	f := NewFake()
+	now := time.Unix(1000000000, 0)
+	f.Store.Now = func() time.Time { return now }
+
+	f.Set(0, "rel", 0, 10, []byte("v"))
+	f.Set(0, "abs", 0, 1000000020, []byte("v"))
+
+	now = now.Add(9 * time.Second)
+	if _, err := f.Get(0, "rel"); err != nil {
+		t.Errorf("Expected rel to still be there, got %v", err)
+	}
+	now = now.Add(time.Second)
+	if _, err := f.Get(0, "rel"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected rel to expire, got %v", err)
+	}
+	if _, err := f.Get(0, "abs"); err != nil {
+		t.Errorf("Expected abs to still be there, got %v", err)
+	}
+	now = now.Add(10 * time.Second)
+	if _, err := f.Get(0, "abs"); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected abs to expire, got %v", err)
+	}
+}
+
+func TestFakeIncrDecr(t *testing.T) {
+	f := NewFake()
+	tests := []struct {
+		op       gomemcached.CommandCode
+		amt, def uint64
+		exp      uint32
+		val      uint64
+		status   gomemcached.Status
+	}{
+		{gomemcached.INCREMENT, 1, 5, 0xffffffff, 0, gomemcached.KEY_ENOENT},
+		{gomemcached.INCREMENT, 1, 5, 0, 5, gomemcached.SUCCESS},
+		{gomemcached.INCREMENT, 3, 5, 0, 8, gomemcached.SUCCESS},
+		{gomemcached.DECREMENT, 2, 5, 0, 6, gomemcached.SUCCESS},
+		{gomemcached.DECREMENT, 10, 5, 0, 0, gomemcached.SUCCESS},
+	}
+	for _, x := range tests {
+		req := &gomemcached.MCRequest{
+			Opcode: x.op,
+			Key:    []byte("n"),
+			Extras: make([]byte, 20),
+		}
+		binary.BigEndian.PutUint64(req.Extras, x.amt)
+		binary.BigEndian.PutUint64(req.Extras[8:], x.def)
+		binary.BigEndian.PutUint32(req.Extras[16:], x.exp)
+		res, _ := f.Send(req)
+		if res.Status != x.status {
+			t.Errorf("Expected %v for %+v, got %v", x.status, x, res.Status)
+			continue
+		}
+		if x.status == gomemcached.SUCCESS {
+			if got := binary.BigEndian.Uint64(res.Body); got != x.val {
+				t.Errorf("Expected %v for %+v, got %v", x.val, x, got)
+			}
+		}
+	}
+
+	f.Set(0, "s", 0, 0, []byte("text"))
+	if _, err := f.Incr(0, "s", 1, 0, 0); err == nil {
+		t.Errorf("Expected incr of non-numeric value to fail")
+	}
+}
+
+func TestFakeAppend(t *testing.T) {
+	f := NewFake()
+	if _, err := f.Append(0, "k", []byte("x")); err == nil {
+		t.Errorf("Expected append to missing key to fail")
+	}
+	f.Set(0, "k", 0, 0, []byte("a"))
+	f.Append(0, "k", []byte("b"))
+	f.Send(&gomemcached.MCRequest{
+		Opcode: gomemcached.PREPEND,
+		Key:    []byte("k"),
+		Body:   []byte("_"),
+	})
+	res, _ := f.Get(0, "k")
+	if string(res.Body) != "_ab" {
+		t.Errorf("Expected _ab, got %q", res.Body)
+	}
+}
+
+func TestFakeGetBulk(t *testing.T) {
+	f := NewFake()
+	f.Set(0, "a", 0, 0, []byte("A"))
+	f.Set(0, "c", 0, 0, []byte("C"))
+	got, err := f.GetBulk(0, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("Error getting bulk: %v", err)
+	}
+	if len(got) != 2 || string(got["a"].Body) != "A" ||
+		string(got["c"].Body) != "C" {
+		t.Errorf("Expected a and c, got %v", got)
+	}
+}
+
+func TestFakeGetBulkMatchesClient(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+	f := &Fake{Store: s.Store}
+	f.Set(0, "a", 0, 0, []byte("A"))
+
+	for _, keys := range [][]string{
+		{"a", "b"}, {"b", "a"}, {"b"}, {"a"},
+	} {
+		exp, experr := c.GetBulk(0, keys)
+		got, goterr := f.GetBulk(0, keys)
+		if len(got) != len(exp) || gomemcached.IsNotFound(goterr) !=
+			gomemcached.IsNotFound(experr) || (goterr == nil) != (experr == nil) {
+			t.Errorf("For %v, expected %v, %v, got %v, %v",
+				keys, exp, experr, got, goterr)
+		}
+	}
+}
+
+func TestFakeStats(t *testing.T) {
+	f := NewFake()
+	f.Set(0, "a", 0, 0, []byte("A"))
+	st, err := f.StatsMap("")
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if st["curr_items"] != "1" {
+		t.Errorf("Expected one item, got %v", st)
+	}
+}
+
+func TestFakeFaults(t *testing.T) {
+	f := NewFake()
+	broken := errors.New("broken pipe")
+	f.FailNext(broken, &gomemcached.MCResponse{Status: gomemcached.TMPFAIL})
+
+	if _, err := f.Set(0, "k", 0, 0, nil); err != broken {
+		t.Errorf("Expected broken pipe, got %v", err)
+	}
+	if f.IsHealthy() {
+		t.Errorf("Expected to be unhealthy after a transport error")
+	}
+	res, err := f.Set(0, "k", 0, 0, nil)
+	if res == nil || res.Status != gomemcached.TMPFAIL || err == nil {
+		t.Errorf("Expected TMPFAIL, got %v/%v", res, err)
+	}
+	if !f.IsHealthy() {
+		t.Errorf("Expected to be healthy after a server error")
+	}
+	if _, err := f.Set(0, "k", 0, 0, nil); err != nil {
+		t.Errorf("Expected faults to be used up, got %v", err)
+	}
+
+	var seen []string
+	f.Inject = func(req *gomemcached.MCRequest) error {
+		seen = append(seen, string(req.Key))
+		if string(req.Key) == "bad" {
+			return broken
+		}
+		return nil
+	}
+	f.Get(0, "k")
+	if _, err := f.Get(0, "bad"); err != broken {
+		t.Errorf("Expected injected error, got %v", err)
+	}
+	if !reflect.DeepEqual(seen, []string{"k", "bad"}) {
+		t.Errorf("Expected to see both keys, saw %v", seen)
+	}
+
+	f.Inject = nil
+	f.Latency = 10 * time.Millisecond
+	start := time.Now()
+	f.Get(0, "k")
+	if time.Since(start) < f.Latency {
+		t.Errorf("Expected at least %v latency", f.Latency)
+	}
+
+	f.Close()
+	if _, err := f.Get(0, "k"); err != ErrClosed {
+		t.Errorf("Expected closed error, got %v", err)
+	}
+}
+
+// casOutcome describes how a CAS went, in terms that can be compared
+// between a fake and a real client.
+type casOutcome struct {
+	Calls  int
+	Status gomemcached.Status
+	Err    string
+	Value  string
+	Exists bool
+}
+
+func TestFakeCASMatchesClient(t *testing.T) {
+	// Each script gets the call number and the current value, and
+	// may change the store behind the CAS's back through other.
+	scripts := map[string]func(n int, current []byte,
+		other *Fake) ([]byte, memcached.CasOp){
+		"store": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			return append(current, 'x'), memcached.CASStore
+		},
+		"conflict": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			if n == 1 {
+				other.Set(0, "k", 0, 0, []byte("theirs"))
+			}
+			return append(current, 'x'), memcached.CASStore
+		},
+		"deleted under": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			if n == 1 {
+				other.Del(0, "k")
+			}
+			return []byte("mine"), memcached.CASStore
+		},
+		"added under": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			if n == 1 {
+				other.Del(0, "k")
+			}
+			if n == 2 {
+				other.Set(0, "k", 0, 0, []byte("theirs"))
+			}
+			return []byte("mine"), memcached.CASStore
+		},
+		"delete": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			return nil, memcached.CASDelete
+		},
+		"delete with value": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			return []byte("kept"), memcached.CASDelete
+		},
+		"store nil": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			return nil, memcached.CASStore
+		},
+		"quit": func(n int, current []byte, other *Fake) ([]byte, memcached.CasOp) {
+			return []byte("never"), memcached.CASQuit
+		},
+	}
+
+	run := func(cas func(memcached.CasFunc) (*gomemcached.MCResponse, error),
+		store *mcstore.Store, initial []byte,
+		script func(int, []byte, *Fake) ([]byte, memcached.CasOp)) casOutcome {
+		other := &Fake{Store: store}
+		if initial != nil {
+			other.Set(0, "k", 0, 0, initial)
+		}
+		var rv casOutcome
+		res, err := cas(func(current []byte) ([]byte, memcached.CasOp) {
+			rv.Calls++
+			return script(rv.Calls, current, other)
+		})
+		if res != nil {
+			rv.Status = res.Status
+		}
+		if err != nil {
+			rv.Err = err.Error()
+		}
+		var item gomemcached.MCItem
+		item, rv.Exists = store.Item("k")
+		rv.Value = string(item.Data)
+		return rv
+	}
+
+	for name, script := range scripts {
+		for _, initial := range [][]byte{nil, []byte("v")} {
+			f := NewFake()
+			fromFake := run(func(fn memcached.CasFunc) (*gomemcached.MCResponse, error) {
+				return f.CAS(0, "k", fn, 0)
+			}, f.Store, initial, script)
+
+			s := NewServer()
+			c := connect(t, s)
+			fromClient := run(func(fn memcached.CasFunc) (*gomemcached.MCResponse, error) {
+				return c.CAS(0, "k", fn, 0)
+			}, s.Store, initial, script)
+			c.Close()
+			s.Close()
+
+			if !reflect.DeepEqual(fromFake, fromClient) {
+				t.Errorf("%v from %q: fake did %+v, client did %+v",
+					name, initial, fromFake, fromClient)
+			}
+		}
+	}
+}
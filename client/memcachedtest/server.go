@@ -0,0 +1,151 @@
+package memcachedtest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/server"
+	"github.com/dustin/gomemcached/server/mcstore"
+)
+
+// Server is a binary protocol memcached server listening on a local
+// socket, for use in tests.
+//
+// It's backed by an mcstore.Store and additionally answers TAP_CONNECT with a
+// feed of the store's contents and changes from a TapProducer.
+type Server struct {
+	// The network and address to connect to, suitable for passing
+	// to memcached.Connect.
+	Network, Addr string
+	// The items served.
+	Store *mcstore.Store
+	// Serves TAP_CONNECT from the Store.
+	Tap *memcached.TapProducer
+
+	l   net.Listener
+	dir string // for unix sockets
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	done   chan bool // closed to stop TAP streams
+	wg     sync.WaitGroup
+}
+
+// onceCloser lets both Server.Close and HandleIO close a connection.
+type onceCloser struct {
+	net.Conn
+	once sync.Once
+}
+
+func (c *onceCloser) Close() error {
+	c.once.Do(func() { c.Conn.Close() })
+	return nil
+}
+
+// NewServer starts a server on a loopback TCP port.  The caller
+// should call Close when finished.
+func NewServer() *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		if l, err = net.Listen("tcp6", "[::1]:0"); err != nil {
+			panic("memcachedtest: failed to listen: " + err.Error())
+		}
+	}
+	return start(l, "")
+}
+
+// NewUnixServer starts a server on a unix socket in a new temporary
+// directory.  The caller should call Close when finished.
+func NewUnixServer() *Server {
+	dir, err := ioutil.TempDir("", "memcachedtest")
+	if err != nil {
+		panic("memcachedtest: failed to make socket dir: " + err.Error())
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "mc.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		panic("memcachedtest: failed to listen: " + err.Error())
+	}
+	return start(l, dir)
+}
+
+func start(l net.Listener, dir string) *Server {
+	s := &Server{
+		Network: l.Addr().Network(),
+		Addr:    l.Addr().String(),
+		Store:   mcstore.New(),
+		l:       l,
+		dir:     dir,
+		conns:   map[net.Conn]bool{},
+		done:    make(chan bool),
+	}
+	s.Tap = memcached.NewTapProducer(s.Store)
+	s.Tap.Done = s.done
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &onceCloser{Conn: nc}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return
+		}
+		s.conns[c] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			// Errors just mean the client went away.
+			memcached.HandleIO(c, memcached.FuncHandler(s.handle))
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handle(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.Opcode == gomemcached.TAP_CONNECT {
+		return s.Tap.HandleMessage(w, req)
+	}
+	return s.Store.HandleMessage(w, req)
+}
+
+// Close stops the server, disconnecting any clients, and waits for
+// everything to shut down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	s.l.Close()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
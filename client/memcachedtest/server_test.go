@@ -0,0 +1,202 @@
+package memcachedtest
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+)
+
+func connect(t *testing.T, s *Server) *memcached.Client {
+	c, err := memcached.Connect(s.Network, s.Addr)
+	if err != nil {
+		t.Fatalf("Error connecting to %v/%v: %v", s.Network, s.Addr, err)
+	}
+	return c
+}
+
+func TestServerBasics(t *testing.T) {
+	for _, s := range []*Server{NewServer(), NewUnixServer()} {
+		c := connect(t, s)
+
+		if _, err := c.Set(0, "a", 7, 0, []byte("A")); err != nil {
+			t.Fatalf("Error setting on %v: %v", s.Network, err)
+		}
+		res, err := c.Get(0, "a")
+		if err != nil || string(res.Body) != "A" {
+			t.Errorf("Expected A on %v, got %v/%v", s.Network, res, err)
+		}
+		if _, err := c.Get(0, "b"); !gomemcached.IsNotFound(err) {
+			t.Errorf("Expected not found on %v, got %v", s.Network, err)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServerGetBulk(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	c.Set(0, "a", 0, 0, []byte("A"))
+	c.Set(0, "c", 0, 0, []byte("C"))
+	got, err := c.GetBulk(0, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("Error getting bulk: %v", err)
+	}
+	if len(got) != 2 || string(got["a"].Body) != "A" ||
+		string(got["c"].Body) != "C" {
+		t.Errorf("Expected a and c, got %v", got)
+	}
+}
+
+func TestServerCAS(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := c.CAS(0, "k", func(current []byte) ([]byte, memcached.CasOp) {
+			return append(current, 'x'), memcached.CASStore
+		}, 0)
+		if err != nil {
+			t.Fatalf("Error in CAS: %v", err)
+		}
+	}
+	if item, _ := s.Store.Item("k"); string(item.Data) != "xxx" {
+		t.Errorf("Expected xxx, got %q", item.Data)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	c.Set(0, "a", 0, 0, []byte("A"))
+	st, err := c.StatsMap("")
+	if err != nil {
+		t.Fatalf("Error getting stats: %v", err)
+	}
+	if st["curr_items"] != "1" {
+		t.Errorf("Expected one item, got %v", st)
+	}
+}
+
+func nextEvent(t *testing.T, feed *memcached.TapFeed) memcached.TapEvent {
+	select {
+	case e, ok := <-feed.C:
+		if !ok {
+			t.Fatalf("Feed ended early: %v", feed.Error)
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a TAP event")
+	}
+	panic("unreachable")
+}
+
+func TestServerTapDump(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	c.Set(3, "a", 0, 0, []byte("A"))
+	c.Set(3, "b", 0, 0, []byte("B"))
+	c.Set(4, "c", 0, 0, []byte("C"))
+
+	tc := connect(t, s)
+	args := memcached.DefaultTapArguments()
+	args.Backfill = 0
+	args.Dump = true
+	args.VBuckets = []uint16{3}
+	feed, err := tc.StartTapFeed(args)
+	if err != nil {
+		t.Fatalf("Error starting tap feed: %v", err)
+	}
+
+	got := []string{}
+	for e := range feed.C {
+		got = append(got, e.Opcode.String()+":"+string(e.Key))
+	}
+	exp := []string{"BeginBackfill:", "Mutation:a", "Mutation:b", "EndBackfill:"}
+	if len(got) != len(exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("Expected %v, got %v", exp, got)
+			break
+		}
+	}
+	if feed.Error != nil {
+		t.Errorf("Expected a clean end of feed, got %v", feed.Error)
+	}
+}
+
+func TestServerTapLive(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	c := connect(t, s)
+	defer c.Close()
+
+	c.Set(0, "old", 0, 0, []byte("x"))
+
+	feed, err := connect(t, s).StartTapFeed(memcached.DefaultTapArguments())
+	if err != nil {
+		t.Fatalf("Error starting tap feed: %v", err)
+	}
+	defer feed.Close()
+
+	c.Set(0, "new", 5, 0, []byte("v"))
+	c.Del(0, "old")
+
+	e := nextEvent(t, feed)
+	if e.Opcode != memcached.TapMutation || string(e.Key) != "new" ||
+		string(e.Value) != "v" || e.Flags != 5 {
+		t.Errorf("Expected mutation of new, got %v", e)
+	}
+	e = nextEvent(t, feed)
+	if e.Opcode != memcached.TapDeletion || string(e.Key) != "old" {
+		t.Errorf("Expected deletion of old, got %v", e)
+	}
+}
+
+func TestServerTapExpiry(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	now := time.Now().Unix()
+	s.Store.Now = func() time.Time { return time.Unix(atomic.LoadInt64(&now), 0) }
+	c := connect(t, s)
+	defer c.Close()
+
+	c.Set(0, "a", 0, 10, []byte("x"))
+
+	args := memcached.DefaultTapArguments()
+	args.Backfill = 1
+	feed, err := connect(t, s).StartTapFeed(args)
+	if err != nil {
+		t.Fatalf("Error starting tap feed: %v", err)
+	}
+	defer feed.Close()
+	// Once the backfill arrives, the stream is watching for changes.
+	for e := nextEvent(t, feed); e.Opcode != memcached.TapEndBackfill; e = nextEvent(t, feed) {
+	}
+
+	atomic.AddInt64(&now, 10)
+	if _, err := c.Get(0, "a"); !gomemcached.IsNotFound(err) {
+		t.Fatalf("Expected a to have expired, got %v", err)
+	}
+	e := nextEvent(t, feed)
+	if e.Opcode != memcached.TapDeletion || string(e.Key) != "a" {
+		t.Errorf("Expected the expiry to be streamed as a deletion, got %v", e)
+	}
+}
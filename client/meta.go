@@ -0,0 +1,152 @@
+package memcached
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strconv"
+
+	"github.com/dustin/gomemcached"
+)
+
+// MetaClient speaks the meta text protocol, for the features the
+// binary protocol lacks, such as leases.
+type MetaClient struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+}
+
+// ConnectMeta connects to a memcached server speaking the meta
+// protocol.
+func ConnectMeta(prot, dest string) (*MetaClient, error) {
+	conn, err := dialFun(prot, dest)
+	if err != nil {
+		return nil, err
+	}
+	return WrapMeta(conn), nil
+}
+
+// WrapMeta wraps an existing transport.
+func WrapMeta(rwc io.ReadWriteCloser) *MetaClient {
+	return &MetaClient{conn: rwc, r: bufio.NewReader(rwc)}
+}
+
+// Close the connection when you're done.
+func (c *MetaClient) Close() error {
+	return c.conn.Close()
+}
+
+// Do sends a meta command and reads its reply.
+//
+// Don't use the q flag, as there may be no reply to read.
+func (c *MetaClient) Do(m *gomemcached.MetaCommand) (*gomemcached.MetaResponse, error) {
+	if _, err := m.Transmit(c.conn); err != nil {
+		return nil, err
+	}
+	mr := &gomemcached.MetaResponse{}
+	_, err := mr.Receive(c.r)
+	return mr, err
+}
+
+// do sends a command about a key, which is base64 encoded so any key
+// works, and turns failures into errors.
+func (c *MetaClient) do(name, key string, data []byte,
+	flags ...gomemcached.MetaFlag) (*gomemcached.MetaResponse, error) {
+	mr, err := c.Do(&gomemcached.MetaCommand{
+		Name:  name,
+		Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+		Flags: append(gomemcached.MetaFlags{{Flag: 'b'}}, flags...),
+		Data:  data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if st := mr.Status(); st != gomemcached.SUCCESS {
+		return mr, &gomemcached.MCResponse{
+			Status: st,
+			Key:    []byte(key),
+			Body:   []byte(mr.Message),
+		}
+	}
+	return mr, nil
+}
+
+func metaNum(flag byte, n int) gomemcached.MetaFlag {
+	return gomemcached.MetaFlag{Flag: flag, Token: strconv.Itoa(n)}
+}
+
+// A Lease is an item fetched with LeaseGet.
+type Lease struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	Cas   uint64
+	// Seconds until the item expires, or -1 if it never does.
+	TTL int64
+	// This client should compute the value and store it with Fill.
+	// Meanwhile Value is empty (for a new item) or stale.
+	Won bool
+	// Value is out of date, but may be used while it's recomputed.
+	Stale bool
+	// Another client is already computing the value.
+	Pending bool
+}
+
+// LeaseGet fetches a key.  A missing key is created as an empty
+// placeholder that lives for ttl seconds.  Exactly one client wins
+// the right to fill in a placeholder or an invalidated item, or, if
+// recache is above zero, an item with fewer than recache seconds
+// left.
+func (c *MetaClient) LeaseGet(key string, ttl, recache int) (*Lease, error) {
+	flags := []gomemcached.MetaFlag{{Flag: 'v'}, {Flag: 'c'}, {Flag: 'f'},
+		{Flag: 't'}, metaNum('N', ttl)}
+	if recache > 0 {
+		flags = append(flags, metaNum('R', recache))
+	}
+	mr, err := c.do("mg", key, nil, flags...)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &Lease{Key: key, Value: mr.Data, TTL: -1}
+	for _, f := range mr.Flags {
+		switch f.Flag {
+		case 'c':
+			rv.Cas, _ = strconv.ParseUint(f.Token, 10, 64)
+		case 'f':
+			flags, _ := strconv.ParseUint(f.Token, 10, 32)
+			rv.Flags = uint32(flags)
+		case 't':
+			rv.TTL, _ = strconv.ParseInt(f.Token, 10, 64)
+		case 'W':
+			rv.Won = true
+		case 'X':
+			rv.Stale = true
+		case 'Z':
+			rv.Pending = true
+		}
+	}
+	return rv, nil
+}
+
+// Fill stores the value computed by the winner of a lease.  If the
+// item was invalidated again in the meantime, the value is still
+// stored, but stale, so it's recomputed once more.
+func (c *MetaClient) Fill(l *Lease, flags, exp int, value []byte) error {
+	_, err := c.do("ms", l.Key, value, metaNum('F', flags), metaNum('T', exp),
+		gomemcached.MetaFlag{Flag: 'C', Token: strconv.FormatUint(l.Cas, 10)},
+		gomemcached.MetaFlag{Flag: 'I'})
+	return err
+}
+
+// Invalidate marks a key stale, so that the next LeaseGet wins the
+// right to recompute it while other clients keep using the old value.
+// A ttl above zero gives the stale item a new TTL.
+func (c *MetaClient) Invalidate(key string, ttl int) error {
+	flags := []gomemcached.MetaFlag{{Flag: 'I'}}
+	if ttl > 0 {
+		flags = append(flags, metaNum('T', ttl))
+	}
+	_, err := c.do("md", key, nil, flags...)
+	return err
+}
@@ -0,0 +1,92 @@
+package memcached
+
+import (
+	"net"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	mcserver "github.com/dustin/gomemcached/server"
+	"github.com/dustin/gomemcached/server/mcstore"
+)
+
+func metaClients(n int) []*MetaClient {
+	store := mcstore.New()
+	rv := []*MetaClient{}
+	for i := 0; i < n; i++ {
+		cli, srv := net.Pipe()
+		go mcserver.HandleAnyIO(srv, store)
+		rv = append(rv, WrapMeta(cli))
+	}
+	return rv
+}
+
+func TestMetaLeases(t *testing.T) {
+	clients := metaClients(2)
+	a, b := clients[0], clients[1]
+	defer a.Close()
+	defer b.Close()
+	key := "a key with spaces"
+
+	l, err := a.LeaseGet(key, 30, 0)
+	if err != nil {
+		t.Fatalf("Error getting lease: %v", err)
+	}
+	if !l.Won || l.Stale || l.Pending || len(l.Value) != 0 || l.TTL != 30 {
+		t.Fatalf("Expected to win a new placeholder, got %+v", l)
+	}
+	if other, _ := b.LeaseGet(key, 30, 0); other.Won || !other.Pending {
+		t.Errorf("Expected the other client to wait, got %+v", other)
+	}
+	if err := a.Fill(l, 7, 0, []byte("v1")); err != nil {
+		t.Fatalf("Error filling: %v", err)
+	}
+	l, err = b.LeaseGet(key, 30, 0)
+	if err != nil || string(l.Value) != "v1" || l.Flags != 7 || l.TTL != -1 ||
+		l.Won || l.Stale || l.Pending {
+		t.Fatalf("Expected a plain hit, got %+v/%v", l, err)
+	}
+
+	if err := a.Invalidate(key, 0); err != nil {
+		t.Fatalf("Error invalidating: %v", err)
+	}
+	l, _ = b.LeaseGet(key, 30, 0)
+	if !l.Won || !l.Stale || string(l.Value) != "v1" {
+		t.Fatalf("Expected to win a recache of the stale value, got %+v", l)
+	}
+	if other, _ := a.LeaseGet(key, 30, 0); !other.Stale || !other.Pending ||
+		string(other.Value) != "v1" {
+		t.Errorf("Expected the other client to get the stale value, got %+v", other)
+	}
+
+	// Invalidated again while recomputing: the fill lands stale.
+	if err := a.Invalidate(key, 0); err != nil {
+		t.Fatalf("Error invalidating: %v", err)
+	}
+	if err := b.Fill(l, 0, 0, []byte("v2")); err != nil {
+		t.Fatalf("Error filling: %v", err)
+	}
+	l, _ = a.LeaseGet(key, 30, 0)
+	if !l.Won || !l.Stale || string(l.Value) != "v2" {
+		t.Errorf("Expected an outdated fill to be stale, got %+v", l)
+	}
+
+	if err := a.Invalidate("missing", 0); !gomemcached.IsNotFound(err) {
+		t.Errorf("Expected not found invalidating a missing key, got %v", err)
+	}
+}
+
+func TestMetaLeaseRecache(t *testing.T) {
+	c := metaClients(1)[0]
+	defer c.Close()
+
+	l, _ := c.LeaseGet("k", 30, 0)
+	if err := c.Fill(l, 0, 10, []byte("v")); err != nil {
+		t.Fatalf("Error filling: %v", err)
+	}
+	if l, _ := c.LeaseGet("k", 30, 5); l.Won {
+		t.Errorf("Didn't expect to win with plenty of time left, got %+v", l)
+	}
+	if l, _ := c.LeaseGet("k", 30, 60); !l.Won || l.Stale || string(l.Value) != "v" {
+		t.Errorf("Expected to win an early recache, got %+v", l)
+	}
+}
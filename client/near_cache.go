@@ -0,0 +1,194 @@
+package memcached
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+var timeNow = time.Now
+
+type nearCacheKey struct {
+	vb  uint16
+	key string
+}
+
+// nearCacheFlight tracks the fetches of a key in progress.
+type nearCacheFlight struct {
+	n   int    // fetches in progress
+	gen uint64 // bumped when the key is invalidated
+}
+
+type nearCacheEntry struct {
+	k       nearCacheKey
+	res     *gomemcached.MCResponse
+	expires time.Time
+}
+
+// NearCache is a small in-process LRU cache of GET responses sitting
+// in front of a Client.
+//
+// Entries live for at most the configured TTL and the cache never
+// holds more than its configured number of keys.  A NearCache is safe
+// for concurrent use, but calls through to the underlying Client are
+// serialized since a Client is not.
+type NearCache struct {
+	c   *Client
+	ttl time.Duration
+	max int
+
+	fetchMu sync.Mutex // serializes use of c
+
+	mu       sync.Mutex
+	lru      *list.List
+	items    map[nearCacheKey]*list.Element
+	inflight map[nearCacheKey]*nearCacheFlight
+	epoch    uint64 // bumped when everything is purged
+}
+
+// NewNearCache builds a near cache holding up to size responses for
+// at most ttl in front of the given client.
+func NewNearCache(c *Client, size int, ttl time.Duration) *NearCache {
+	if size < 1 {
+		size = 1
+	}
+	return &NearCache{
+		c:        c,
+		ttl:      ttl,
+		max:      size,
+		lru:      list.New(),
+		items:    map[nearCacheKey]*list.Element{},
+		inflight: map[nearCacheKey]*nearCacheFlight{},
+	}
+}
+
+// Get the value for a key, serving it locally when possible.
+//
+// Only successful responses are cached.  The returned response may be
+// shared with other callers and must not be modified.
+func (nc *NearCache) Get(vb uint16, key string) (*gomemcached.MCResponse, error) {
+	k := nearCacheKey{vb, key}
+
+	nc.mu.Lock()
+	if e, ok := nc.items[k]; ok {
+		ent := e.Value.(*nearCacheEntry)
+		if timeNow().Before(ent.expires) {
+			nc.lru.MoveToFront(e)
+			nc.mu.Unlock()
+			return ent.res, nil
+		}
+		nc.removeElement(e)
+	}
+	f := nc.inflight[k]
+	if f == nil {
+		f = &nearCacheFlight{}
+		nc.inflight[k] = f
+	}
+	f.n++
+	epoch, gen := nc.epoch, f.gen
+	nc.mu.Unlock()
+
+	nc.fetchMu.Lock()
+	res, err := nc.c.Get(vb, key)
+	nc.fetchMu.Unlock()
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if f.n--; f.n == 0 {
+		delete(nc.inflight, k)
+	}
+	if err != nil {
+		return res, err
+	}
+	// If the key was invalidated while we were fetching, that may
+	// have been after the server produced our response.
+	if nc.epoch == epoch && f.gen == gen {
+		nc.add(k, res)
+	}
+	return res, nil
+}
+
+func (nc *NearCache) add(k nearCacheKey, res *gomemcached.MCResponse) {
+	if e, ok := nc.items[k]; ok {
+		nc.removeElement(e)
+	}
+	nc.items[k] = nc.lru.PushFront(&nearCacheEntry{
+		k:       k,
+		res:     res,
+		expires: timeNow().Add(nc.ttl),
+	})
+	for nc.lru.Len() > nc.max {
+		nc.removeElement(nc.lru.Back())
+	}
+}
+
+func (nc *NearCache) removeElement(e *list.Element) {
+	nc.lru.Remove(e)
+	delete(nc.items, e.Value.(*nearCacheEntry).k)
+}
+
+// Invalidate drops any locally cached value for a key.
+func (nc *NearCache) Invalidate(vb uint16, key string) {
+	k := nearCacheKey{vb, key}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if f := nc.inflight[k]; f != nil {
+		f.gen++
+	}
+	if e, ok := nc.items[k]; ok {
+		nc.removeElement(e)
+	}
+}
+
+// Purge drops everything from the cache.
+func (nc *NearCache) Purge() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.epoch++
+	nc.lru.Init()
+	nc.items = map[nearCacheKey]*list.Element{}
+}
+
+// Len is the number of responses currently cached.
+func (nc *NearCache) Len() int {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.lru.Len()
+}
+
+// InvalidateFrom evicts entries for every mutation or deletion seen
+// on the given feed until the feed ends.
+//
+// Since a feed that has ended can no longer tell us about changes,
+// the whole cache is purged when that happens.
+func (nc *NearCache) InvalidateFrom(feed *TapFeed) {
+	for e := range feed.C {
+		switch e.Opcode {
+		case TapMutation, TapDeletion:
+			nc.Invalidate(e.VBucket, string(e.Key))
+		case TapFlush:
+			nc.Purge()
+		}
+	}
+	nc.Purge()
+}
+
+// StartInvalidation starts a keys-only TAP feed for the given
+// vbuckets (or all of them if empty) on tc and uses it to invalidate
+// the cache in the background.
+//
+// tc is taken over by the feed, so it must not be the client the
+// cache itself reads from.  Close the returned feed to stop.
+func (nc *NearCache) StartInvalidation(tc *Client, vbuckets []uint16) (*TapFeed, error) {
+	args := DefaultTapArguments()
+	args.KeysOnly = true
+	args.VBuckets = vbuckets
+	feed, err := tc.StartTapFeed(args)
+	if err != nil {
+		return nil, err
+	}
+	go nc.InvalidateFrom(feed)
+	return feed, nil
+}
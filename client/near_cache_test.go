@@ -0,0 +1,189 @@
+package memcached
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func countingGets(n *int) *Client {
+	return serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		*n++
+		if string(req.Key) == "missing" {
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		}
+		return &gomemcached.MCResponse{
+			Extras: []byte{0, 0, 0, 0},
+			Body:   req.Key,
+		}
+	})
+}
+
+func TestNearCacheHit(t *testing.T) {
+	var gets int
+	c := countingGets(&gets)
+	defer c.Close()
+	nc := NewNearCache(c, 10, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		res, err := nc.Get(1, "a")
+		if err != nil {
+			t.Fatalf("Error getting: %v", err)
+		}
+		if string(res.Body) != "a" {
+			t.Errorf("Expected body a, got %q", res.Body)
+		}
+	}
+	if gets != 1 {
+		t.Errorf("Expected one server get, got %v", gets)
+	}
+
+	// Same key in another vbucket is another entry.
+	if _, err := nc.Get(2, "a"); err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if gets != 2 {
+		t.Errorf("Expected two server gets, got %v", gets)
+	}
+}
+
+func TestNearCacheMiss(t *testing.T) {
+	var gets int
+	c := countingGets(&gets)
+	defer c.Close()
+	nc := NewNearCache(c, 10, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		_, err := nc.Get(1, "missing")
+		if !gomemcached.IsNotFound(err) {
+			t.Fatalf("Expected not found, got %v", err)
+		}
+	}
+	if gets != 2 || nc.Len() != 0 {
+		t.Errorf("Expected misses not to be cached, gets=%v, len=%v",
+			gets, nc.Len())
+	}
+}
+
+func TestNearCacheExpiry(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	var gets int
+	c := countingGets(&gets)
+	defer c.Close()
+	nc := NewNearCache(c, 10, time.Second)
+
+	nc.Get(0, "a")
+	now = now.Add(999 * time.Millisecond)
+	nc.Get(0, "a")
+	if gets != 1 {
+		t.Errorf("Expected a cached value, got %v gets", gets)
+	}
+	now = now.Add(time.Millisecond)
+	nc.Get(0, "a")
+	if gets != 2 {
+		t.Errorf("Expected value to expire, got %v gets", gets)
+	}
+}
+
+func TestNearCacheEviction(t *testing.T) {
+	var gets int
+	c := countingGets(&gets)
+	defer c.Close()
+	nc := NewNearCache(c, 2, time.Hour)
+
+	nc.Get(0, "a")
+	nc.Get(0, "b")
+	nc.Get(0, "a") // a is now most recently used
+	nc.Get(0, "c") // evicts b
+	if nc.Len() != 2 {
+		t.Errorf("Expected 2 items, got %v", nc.Len())
+	}
+	gets = 0
+	nc.Get(0, "a")
+	nc.Get(0, "c")
+	if gets != 0 {
+		t.Errorf("Expected a and c to be cached, got %v gets", gets)
+	}
+	nc.Get(0, "b")
+	if gets != 1 {
+		t.Errorf("Expected b to be evicted, got %v gets", gets)
+	}
+}
+
+func TestNearCacheInvalidateFrom(t *testing.T) {
+	var gets int
+	c := countingGets(&gets)
+	defer c.Close()
+	nc := NewNearCache(c, 10, time.Hour)
+
+	nc.Get(3, "a")
+	nc.Get(3, "b")
+	nc.Get(3, "c")
+
+	ch := make(chan TapEvent)
+	done := make(chan bool)
+	go func() {
+		nc.InvalidateFrom(&TapFeed{C: ch})
+		close(done)
+	}()
+
+	ch <- TapEvent{Opcode: TapMutation, VBucket: 3, Key: []byte("a")}
+	ch <- TapEvent{Opcode: TapDeletion, VBucket: 3, Key: []byte("b")}
+	ch <- TapEvent{Opcode: TapCheckpointStart, VBucket: 3}
+	ch <- TapEvent{Opcode: TapMutation, VBucket: 4, Key: []byte("c")}
+
+	if nc.Len() != 1 {
+		t.Errorf("Expected only c to remain, have %v items", nc.Len())
+	}
+
+	ch <- TapEvent{Opcode: TapFlush}
+	ch <- TapEvent{Opcode: TapCheckpointStart, VBucket: 3}
+	if nc.Len() != 0 {
+		t.Errorf("Expected cache to be purged by a flush, have %v",
+			nc.Len())
+	}
+	nc.Get(3, "c")
+
+	close(ch)
+	<-done
+	if nc.Len() != 0 {
+		t.Errorf("Expected cache to be purged at end of feed, have %v",
+			nc.Len())
+	}
+}
+
+func TestNearCacheInvalidateDuringFetch(t *testing.T) {
+	var nc *NearCache
+	c := serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		// Changes seen while the server is answering.
+		switch string(req.Key) {
+		case "x":
+			nc.Invalidate(1, "other")
+		case "y":
+			nc.Invalidate(1, "y")
+		}
+		return &gomemcached.MCResponse{
+			Extras: []byte{0, 0, 0, 0},
+			Body:   req.Key,
+		}
+	})
+	defer c.Close()
+	nc = NewNearCache(c, 10, time.Hour)
+
+	nc.Get(1, "x")
+	if nc.Len() != 1 {
+		t.Errorf("Expected x to be cached despite another key changing")
+	}
+	nc.Get(1, "y")
+	if nc.Len() != 1 {
+		t.Errorf("Expected y not to be cached after changing mid-fetch")
+	}
+	nc.Purge()
+	if nc.Len() != 0 {
+		t.Errorf("Expected an empty cache after a purge")
+	}
+}
@@ -0,0 +1,211 @@
+package memcached
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// ErrPoolClosed is returned when asking a closed pool for a connection.
+var ErrPoolClosed = errors.New("connection pool closed")
+
+// ErrNodeDown is returned without trying when a server has been
+// ejected after repeated communication failures.
+var ErrNodeDown = errors.New("node is down")
+
+// DefaultBreakerThreshold is the number of consecutive communication
+// failures after which a server is ejected, unless changed with
+// SetBreaker.
+const DefaultBreakerThreshold = 3
+
+// DefaultBreakerProbeInterval is how often an ejected server is
+// checked to see whether it may be reinstated, unless changed with
+// SetBreaker.
+const DefaultBreakerProbeInterval = time.Second
+
+// DialFunc creates a new client connection to the given server.
+type DialFunc func(server string) (*Client, error)
+
+// DefaultDial connects to a server over TCP.
+func DefaultDial(server string) (*Client, error) {
+	return Connect("tcp", server)
+}
+
+// connPool keeps idle connections to a single server around for
+// reuse, and stops talking to the server entirely while it seems to
+// be down.
+type connPool struct {
+	server string
+	dial   DialFunc
+
+	mu         sync.Mutex
+	idle       []*Client
+	max        int
+	closed     bool
+	failures   int  // consecutive communication failures
+	down       bool // ejected; a prober is running
+	threshold  int
+	probeEvery time.Duration
+}
+
+func newConnPool(server string, max int, dial DialFunc,
+	threshold int, probeEvery time.Duration) *connPool {
+	return &connPool{
+		server:     server,
+		dial:       dial,
+		threshold:  threshold,
+		probeEvery: probeEvery,
+		max:        max,
+	}
+}
+
+// setBreaker changes when the server is ejected and how often it's
+// probed after.
+func (p *connPool) setBreaker(threshold int, probeEvery time.Duration) {
+	p.mu.Lock()
+	p.threshold = threshold
+	p.probeEvery = probeEvery
+	p.mu.Unlock()
+}
+
+// get an idle connection or dial a new one.
+func (p *connPool) get() (*Client, error) {
+	p.mu.Lock()
+	switch {
+	case p.closed:
+		p.mu.Unlock()
+		return nil, ErrPoolClosed
+	case p.down:
+		p.mu.Unlock()
+		return nil, ErrNodeDown
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+	c, err := p.dial(p.server)
+	if err != nil {
+		p.failed()
+	}
+	return c, err
+}
+
+// put a connection back for reuse, or close it if it's not healthy
+// or there are already enough idle ones.
+func (p *connPool) put(c *Client) {
+	p.mu.Lock()
+	if !p.closed && !p.down && c.IsHealthy() && len(p.idle) < p.max {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// use runs f with a pooled connection.
+func (p *connPool) use(f func(*Client) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer p.put(c)
+	err = f(c)
+	if isTransportError(err) {
+		p.failed()
+	} else {
+		p.succeeded()
+	}
+	return err
+}
+
+// isTransportError is true for fatal errors that didn't come from the
+// server, i.e. the server couldn't be talked to.
+func isTransportError(err error) bool {
+	_, isResponse := err.(*gomemcached.MCResponse)
+	return gomemcached.IsFatal(err) && !isResponse
+}
+
+func (p *connPool) succeeded() {
+	p.mu.Lock()
+	p.failures = 0
+	p.mu.Unlock()
+}
+
+// failed records a communication failure, ejecting the server once
+// there have been too many in a row.
+func (p *connPool) failed() {
+	p.mu.Lock()
+	p.failures++
+	if p.down || p.closed || p.failures < p.threshold {
+		p.mu.Unlock()
+		return
+	}
+	p.down = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+	go p.probe()
+}
+
+// isDown is true while the server is ejected.
+func (p *connPool) isDown() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.down
+}
+
+// probe checks on an ejected server until it answers a NOOP, then
+// reinstates it.
+func (p *connPool) probe() {
+	for {
+		p.mu.Lock()
+		d := p.probeEvery
+		p.mu.Unlock()
+		time.Sleep(d)
+
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+		if closed {
+			return
+		}
+
+		c, err := p.dial(p.server)
+		if err != nil {
+			continue
+		}
+		_, err = c.Send(&gomemcached.MCRequest{Opcode: gomemcached.NOOP})
+		if err != nil {
+			c.Close()
+			continue
+		}
+
+		p.mu.Lock()
+		p.down = false
+		p.failures = 0
+		p.mu.Unlock()
+		p.put(c)
+		return
+	}
+}
+
+func (p *connPool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
@@ -0,0 +1,336 @@
+// Replicate copies the items of one server to another with TAP.
+//
+// Mutations and deletions from the source are applied to the same
+// vbuckets on the destination with pipelined SETQ and DELETEQ,
+// keeping their flags and expiry.  Events are only acknowledged to
+// the source once the destination has them, so a registered -name
+// can pick up where it left off.
+//
+// With -cas, a change is skipped as a conflict if the destination's
+// copy was written by someone else since the replicator last wrote
+// it, and is otherwise applied with a compare-and-swap against the
+// CAS the destination had.  CAS values from different servers can't
+// be compared, so this only detects writes made directly to the
+// destination; it can't tell which of two writes is newer.  After a
+// conflict the destination's copy is kept, and the key's next change
+// from the source is applied as usual.  The CAS of up to -casKeys
+// keys is remembered; beyond that, some are forgotten, and their next
+// change is applied without looking for a conflict.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+)
+
+var prot = flag.String("prot", "tcp", "Layer 3 protocol (tcp, tcp4, tcp6)")
+var source = flag.String("source", "localhost:11210", "Host:port to replicate from")
+var dest = flag.String("dest", "localhost:11211", "Host:port to replicate to")
+var sourceUser = flag.String("sourceUser", "", "SASL plain username for the source")
+var sourcePass = flag.String("sourcePass", "", "SASL plain password for the source")
+var destUser = flag.String("destUser", "", "SASL plain username for the destination")
+var destPass = flag.String("destPass", "", "SASL plain password for the destination")
+var name = flag.String("name", "", "Register with the source under this name")
+var back = flag.Uint64("backfill", 1,
+	"Replicate historical values starting from here (0 for none)")
+var dump = flag.Bool("dump", false, "Stop after backfill")
+var keys = flag.String("keys", "", "Only replicate keys matching this regexp")
+var useCas = flag.Bool("cas", false, "Only apply changes newer than the destination's")
+var casKeys = flag.Int("casKeys", 1000000, "With -cas, how many keys to remember writing")
+var batchSize = flag.Int("batch", 100, "Changes to pipeline before waiting for the destination")
+var linger = flag.Duration("linger", 10*time.Millisecond,
+	"Send a partial batch after this long without changes")
+var statsEvery = flag.Duration("stats", 10*time.Second, "How often to log progress")
+
+// Progress counters.
+var received, applied, deleted, filtered, conflicts, errored uint64
+
+func logStats() {
+	log.Printf("received=%v applied=%v deleted=%v filtered=%v conflicts=%v errors=%v",
+		received, applied, deleted, filtered, conflicts, errored)
+}
+
+func connect(server, user, pass string) *memcached.Client {
+	client, err := memcached.Connect(*prot, server)
+	if err != nil {
+		log.Fatalf("Error connecting to %v: %v", server, err)
+	}
+	if user != "" {
+		if _, err := client.Auth(user, pass); err != nil {
+			log.Fatalf("Auth error on %v: %v", server, err)
+		}
+	}
+	return client
+}
+
+// pipeline sends quiet requests followed by a NOOP, and returns the
+// responses to the requests that had any, by index.
+func pipeline(client *memcached.Client,
+	reqs []*gomemcached.MCRequest) map[int]*gomemcached.MCResponse {
+
+	for i, req := range reqs {
+		req.Opaque = uint32(i)
+		if err := client.Transmit(req); err != nil {
+			log.Fatalf("Error sending to %v: %v", *dest, err)
+		}
+	}
+	err := client.Transmit(&gomemcached.MCRequest{
+		Opcode: gomemcached.NOOP,
+		Opaque: uint32(len(reqs)),
+	})
+	if err != nil {
+		log.Fatalf("Error sending to %v: %v", *dest, err)
+	}
+
+	rv := map[int]*gomemcached.MCResponse{}
+	for {
+		res, err := client.Receive()
+		if _, ok := err.(*gomemcached.MCResponse); err != nil && !ok {
+			log.Fatalf("Error receiving from %v: %v", *dest, err)
+		}
+		if res.Opcode == gomemcached.NOOP {
+			return rv
+		}
+		if int(res.Opaque) < len(reqs) {
+			rv[int(res.Opaque)] = res
+		}
+	}
+}
+
+// destCas finds the destination's CAS for each change, with 0 for
+// ones it doesn't have.
+func destCas(client *memcached.Client, batch []memcached.TapEvent) []uint64 {
+	reqs := make([]*gomemcached.MCRequest, len(batch))
+	for i, e := range batch {
+		reqs[i] = &gomemcached.MCRequest{
+			Opcode:  gomemcached.GETQ,
+			VBucket: e.VBucket,
+			Key:     e.Key,
+		}
+	}
+	rv := make([]uint64, len(batch))
+	for i, res := range pipeline(client, reqs) {
+		if res.Status == gomemcached.SUCCESS {
+			rv[i] = res.Cas
+		}
+	}
+	return rv
+}
+
+// With -cas, the destination's CAS for each key the last time the
+// replicator wrote it, or 0 if it left the key deleted.
+var written = map[string]uint64{}
+
+// remember records the destination's CAS for a key the replicator
+// wrote, forgetting an arbitrary key first if -casKeys are known.
+func remember(key string, cas uint64) {
+	if _, ok := written[key]; !ok && len(written) >= *casKeys {
+		for k := range written {
+			delete(written, k)
+			break
+		}
+	}
+	written[key] = cas
+}
+
+// distinctKeys returns how many changes at the start of the batch are
+// to different keys.
+func distinctKeys(batch []memcached.TapEvent) int {
+	seen := map[string]bool{}
+	for i, e := range batch {
+		if seen[string(e.Key)] {
+			return i
+		}
+		seen[string(e.Key)] = true
+	}
+	return len(batch)
+}
+
+// apply writes a batch of changes to the destination.
+func apply(client *memcached.Client, batch []memcached.TapEvent) {
+	var current []uint64
+	if *useCas {
+		// A key's CAS can only be looked up after its previous
+		// change was applied.
+		if n := distinctKeys(batch); n < len(batch) {
+			apply(client, batch[:n])
+			apply(client, batch[n:])
+			return
+		}
+		current = destCas(client, batch)
+	}
+
+	reqs := []*gomemcached.MCRequest{}
+	events := []memcached.TapEvent{}
+	for i, e := range batch {
+		req := &gomemcached.MCRequest{
+			Opcode:  gomemcached.SETQ,
+			VBucket: e.VBucket,
+			Key:     e.Key,
+		}
+		if e.Opcode == memcached.TapDeletion {
+			req.Opcode = gomemcached.DELETEQ
+		} else {
+			req.Extras = make([]byte, 8)
+			binary.BigEndian.PutUint32(req.Extras, e.Flags)
+			binary.BigEndian.PutUint32(req.Extras[4:], e.Expiry)
+			req.Body = e.Value
+		}
+		if *useCas {
+			key := string(e.Key)
+			cas := current[i]
+			if last, ok := written[key]; ok && last != cas {
+				// Written on the destination since we did.
+				conflicts++
+				delete(written, key)
+				continue
+			}
+			// Writes aren't quiet, so we learn the new CAS.
+			switch {
+			case cas == 0 && e.Opcode == memcached.TapDeletion:
+				// Already gone.
+				deleted++
+				remember(key, 0)
+				continue
+			case cas == 0:
+				req.Opcode = gomemcached.ADD
+			case e.Opcode == memcached.TapDeletion:
+				req.Opcode = gomemcached.DELETE
+			default:
+				req.Opcode = gomemcached.SET
+			}
+			req.Cas = cas
+		}
+		reqs = append(reqs, req)
+		events = append(events, e)
+	}
+
+	results := pipeline(client, reqs)
+	for i, e := range events {
+		res := results[i]
+		switch {
+		case res == nil || res.Status == gomemcached.SUCCESS:
+			if e.Opcode == memcached.TapDeletion {
+				deleted++
+			} else {
+				applied++
+			}
+			if *useCas {
+				cas := uint64(0)
+				if res != nil && e.Opcode != memcached.TapDeletion {
+					cas = res.Cas
+				}
+				remember(string(e.Key), cas)
+			}
+		case res.Status == gomemcached.KEY_ENOENT && e.Opcode == memcached.TapDeletion:
+			deleted++
+			if *useCas {
+				remember(string(e.Key), 0)
+			}
+		case *useCas && (res.Status == gomemcached.KEY_EEXISTS ||
+			res.Status == gomemcached.KEY_ENOENT ||
+			res.Status == gomemcached.NOT_STORED):
+			// Changed on the destination since we looked.
+			conflicts++
+			delete(written, string(e.Key))
+		default:
+			errored++
+			log.Printf("Error replicating %s: %v", e.Key, res)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	var filter *regexp.Regexp
+	if *keys != "" {
+		var err error
+		if filter, err = regexp.Compile(*keys); err != nil {
+			log.Fatalf("Error parsing -keys: %v", err)
+		}
+	}
+	if *batchSize < 1 {
+		*batchSize = 1
+	}
+
+	log.Printf("Replicating %s/%s to %s", *prot, *source, *dest)
+	src := connect(*source, *sourceUser, *sourcePass)
+	dst := connect(*dest, *destUser, *destPass)
+
+	args := memcached.DefaultTapArguments()
+	args.Backfill = *back
+	args.Dump = *dump
+	args.ClientName = *name
+	args.RegisteredClient = *name != ""
+	args.ManualAck = true
+	// Room for a full batch between other events.
+	args.AckWindow = 2 * *batchSize
+	feed, err := src.StartTapFeed(args)
+	if err != nil {
+		log.Fatalf("Error starting tap feed: %v", err)
+	}
+
+	stats := time.NewTicker(*statsEvery)
+	defer stats.Stop()
+
+	batch := []memcached.TapEvent{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		apply(dst, batch)
+		for _, e := range batch {
+			if err := e.Ack(); err != nil {
+				log.Fatalf("Error acknowledging %s: %v", e.Key, err)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	var lingering <-chan time.Time
+loop:
+	for {
+		select {
+		case e, ok := <-feed.C:
+			if !ok {
+				break loop
+			}
+			if e.Opcode != memcached.TapMutation &&
+				e.Opcode != memcached.TapDeletion {
+				e.Ack()
+				continue
+			}
+			received++
+			if filter != nil && !filter.Match(e.Key) {
+				filtered++
+				e.Ack()
+			} else {
+				batch = append(batch, e)
+				if len(batch) >= *batchSize {
+					flush()
+				}
+			}
+			if len(batch) > 0 {
+				// The source may be waiting for acks.
+				lingering = time.After(*linger)
+			}
+		case <-lingering:
+			lingering = nil
+			flush()
+		case <-stats.C:
+			logStats()
+		}
+	}
+	flush()
+	logStats()
+	if feed.Error != nil {
+		log.Fatalf("Tap feed closed: %v", feed.Error)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/client"
+	"github.com/dustin/gomemcached/client/memcachedtest"
+)
+
+func connectTest(t *testing.T) (*memcachedtest.Server, *memcached.Client) {
+	srv := memcachedtest.NewServer()
+	c, err := memcached.Connect(srv.Network, srv.Addr)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return srv, c
+}
+
+func resetStats() {
+	received, applied, deleted, filtered, conflicts, errored = 0, 0, 0, 0, 0, 0
+	written = map[string]uint64{}
+}
+
+func mutation(key, value string) memcached.TapEvent {
+	return memcached.TapEvent{
+		Opcode: memcached.TapMutation,
+		Key:    []byte(key),
+		Value:  []byte(value),
+		// From another server, so meaningless here.
+		Cas: 1,
+	}
+}
+
+func deletion(key string) memcached.TapEvent {
+	return memcached.TapEvent{Opcode: memcached.TapDeletion, Key: []byte(key)}
+}
+
+func expectValue(t *testing.T, c *memcached.Client, key, exp string) {
+	res, err := c.Get(0, key)
+	switch {
+	case exp == "" && gomemcached.IsNotFound(err):
+	case err != nil:
+		t.Fatalf("Error getting %v: %v", key, err)
+	case string(res.Body) != exp:
+		t.Fatalf("Expected %v=%q, got %q", key, exp, res.Body)
+	}
+}
+
+func expectStats(t *testing.T, expApplied, expDeleted, expConflicts, expErrored uint64) {
+	if applied != expApplied || deleted != expDeleted ||
+		conflicts != expConflicts || errored != expErrored {
+		t.Fatalf("Expected applied=%v deleted=%v conflicts=%v errors=%v, got %v %v %v %v",
+			expApplied, expDeleted, expConflicts, expErrored,
+			applied, deleted, conflicts, errored)
+	}
+}
+
+func TestPipelineItemErrors(t *testing.T) {
+	srv, c := connectTest(t)
+	defer srv.Close()
+	defer c.Close()
+
+	set := func(key string, extras []byte) *gomemcached.MCRequest {
+		return &gomemcached.MCRequest{
+			Opcode: gomemcached.SETQ,
+			Key:    []byte(key),
+			Extras: extras,
+			Body:   []byte(key),
+		}
+	}
+	res := pipeline(c, []*gomemcached.MCRequest{
+		set("a", make([]byte, 8)),
+		set("bad", nil),
+		set("c", make([]byte, 8)),
+	})
+	if len(res) != 1 || res[1] == nil || res[1].Status != gomemcached.EINVAL {
+		t.Fatalf("Expected just EINVAL for the second item, got %v", res)
+	}
+	expectValue(t, c, "a", "a")
+	expectValue(t, c, "c", "c")
+}
+
+func TestApply(t *testing.T) {
+	srv, c := connectTest(t)
+	defer srv.Close()
+	defer c.Close()
+	resetStats()
+
+	apply(c, []memcached.TapEvent{
+		mutation("a", "1"), mutation("b", "1"), deletion("b"), deletion("c"),
+	})
+	expectStats(t, 2, 2, 0, 0)
+	expectValue(t, c, "a", "1")
+	expectValue(t, c, "b", "")
+}
+
+func TestApplyCas(t *testing.T) {
+	srv, c := connectTest(t)
+	defer srv.Close()
+	defer c.Close()
+	*useCas = true
+	defer func() { *useCas = false }()
+	resetStats()
+
+	apply(c, []memcached.TapEvent{mutation("a", "1"), mutation("a", "2")})
+	expectStats(t, 2, 0, 0, 0)
+	expectValue(t, c, "a", "2")
+
+	// Our own writes aren't conflicts.
+	apply(c, []memcached.TapEvent{mutation("a", "3")})
+	expectStats(t, 3, 0, 0, 0)
+	expectValue(t, c, "a", "3")
+
+	if _, err := c.Set(0, "a", 0, 0, []byte("local")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	apply(c, []memcached.TapEvent{mutation("a", "4")})
+	expectStats(t, 3, 0, 1, 0)
+	expectValue(t, c, "a", "local")
+
+	// After a conflict, the next change is applied.
+	apply(c, []memcached.TapEvent{mutation("a", "5")})
+	expectStats(t, 4, 0, 1, 0)
+	expectValue(t, c, "a", "5")
+
+	apply(c, []memcached.TapEvent{deletion("a"), deletion("missing")})
+	expectStats(t, 4, 2, 1, 0)
+	expectValue(t, c, "a", "")
+
+	// A key recreated locally after we deleted it is kept too.
+	if _, err := c.Set(0, "a", 0, 0, []byte("again")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	apply(c, []memcached.TapEvent{mutation("a", "6")})
+	expectStats(t, 4, 2, 2, 0)
+	expectValue(t, c, "a", "again")
+}
+
+func TestApplyCasKeys(t *testing.T) {
+	srv, c := connectTest(t)
+	defer srv.Close()
+	defer c.Close()
+	*useCas = true
+	*casKeys = 1
+	defer func() { *useCas, *casKeys = false, 1000000 }()
+	resetStats()
+
+	apply(c, []memcached.TapEvent{mutation("a", "1"), mutation("b", "1")})
+	expectStats(t, 2, 0, 0, 0)
+	if len(written) != 1 {
+		t.Fatalf("Expected to remember 1 key, got %v", written)
+	}
+
+	// b is still known, so a local write to it is a conflict.
+	if _, err := c.Set(0, "b", 0, 0, []byte("local")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	apply(c, []memcached.TapEvent{mutation("b", "2")})
+	expectStats(t, 2, 0, 1, 0)
+	expectValue(t, c, "b", "local")
+
+	// a was forgotten, so its next change is applied.
+	if _, err := c.Set(0, "a", 0, 0, []byte("local")); err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	apply(c, []memcached.TapEvent{mutation("a", "2")})
+	expectStats(t, 3, 0, 1, 0)
+	expectValue(t, c, "a", "2")
+}
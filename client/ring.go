@@ -0,0 +1,152 @@
+package memcached
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// ErrNoServers is returned when every server in a Ring is down.
+var ErrNoServers = errors.New("no servers available")
+
+// Number of points each server gets on a Ring.
+const ringPointsPerServer = 160
+
+type ringPoint struct {
+	hash uint32
+	pool *connPool
+}
+
+type ringPoints []ringPoint
+
+func (r ringPoints) Len() int           { return len(r) }
+func (r ringPoints) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r ringPoints) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// Ring spreads keys across plain (non-vbucket) memcached servers by
+// consistent hashing.
+//
+// Servers that fail to communicate several times in a row are
+// ejected and their keys go to the next server on the ring until a
+// background probe finds them healthy again.  A Ring is safe for
+// concurrent use.
+type Ring struct {
+	points ringPoints
+	pools  map[string]*connPool
+}
+
+// NewRing builds a ring over the given servers, connecting to them
+// with dial (DefaultDial if nil).
+func NewRing(servers []string, dial DialFunc) *Ring {
+	if dial == nil {
+		dial = DefaultDial
+	}
+	r := &Ring{pools: map[string]*connPool{}}
+	for _, s := range servers {
+		p := newConnPool(s, 4, dial,
+			DefaultBreakerThreshold, DefaultBreakerProbeInterval)
+		r.pools[s] = p
+		for i := 0; i < ringPointsPerServer; i++ {
+			h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", s, i)))
+			r.points = append(r.points, ringPoint{h, p})
+		}
+	}
+	sort.Sort(r.points)
+	return r
+}
+
+// Server returns the server currently responsible for a key.
+func (r *Ring) Server(key string) (string, error) {
+	p := r.find(key)
+	if p == nil {
+		return "", ErrNoServers
+	}
+	return p.server, nil
+}
+
+func (r *Ring) find(key string) *connPool {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)].pool
+		if !p.isDown() {
+			return p
+		}
+	}
+	return nil
+}
+
+// SetBreaker sets the number of consecutive communication failures
+// after which a server is ejected, and how often an ejected server
+// is checked to see whether it may be reinstated.
+func (r *Ring) SetBreaker(threshold int, probeEvery time.Duration) {
+	for _, p := range r.pools {
+		p.setBreaker(threshold, probeEvery)
+	}
+}
+
+// Ejected lists the servers currently considered down.
+func (r *Ring) Ejected() []string {
+	rv := []string{}
+	for s, p := range r.pools {
+		if p.isDown() {
+			rv = append(rv, s)
+		}
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Do runs f against a pooled connection to the server responsible
+// for key.
+func (r *Ring) Do(key string, f func(*Client) error) error {
+	p := r.find(key)
+	if p == nil {
+		return ErrNoServers
+	}
+	return p.use(f)
+}
+
+// Get the value for a key.
+func (r *Ring) Get(key string) (rv *gomemcached.MCResponse, err error) {
+	err = r.Do(key, func(c *Client) error {
+		rv, err = c.Get(0, key)
+		return err
+	})
+	return rv, err
+}
+
+// Set the value for a key.
+func (r *Ring) Set(key string, flags, exp int,
+	body []byte) (rv *gomemcached.MCResponse, err error) {
+	err = r.Do(key, func(c *Client) error {
+		rv, err = c.Set(0, key, flags, exp, body)
+		return err
+	})
+	return rv, err
+}
+
+// Del deletes a key.
+func (r *Ring) Del(key string) (rv *gomemcached.MCResponse, err error) {
+	err = r.Do(key, func(c *Client) error {
+		rv, err = c.Del(0, key)
+		return err
+	})
+	return rv, err
+}
+
+// Close all connections to all servers.
+func (r *Ring) Close() {
+	for _, p := range r.pools {
+		p.close()
+	}
+}
@@ -0,0 +1,152 @@
+package memcached
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// flakyServers dials fake servers that can be taken down at will.
+type flakyServers struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (f *flakyServers) setDown(s string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down[s] = down
+}
+
+func (f *flakyServers) dial(s string) (*Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[s] {
+		return nil, errors.New("connection refused")
+	}
+	return serveFake(answer(s, 0)), nil
+}
+
+func TestRingDistribution(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	r := NewRing(servers, (&flakyServers{down: map[string]bool{}}).dial)
+	defer r.Close()
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		s, err := r.Server(fmt.Sprintf("key%d", i))
+		if err != nil {
+			t.Fatalf("Error finding server: %v", err)
+		}
+		counts[s]++
+	}
+	for _, s := range servers {
+		if counts[s] < 500 {
+			t.Errorf("Expected a fair share for %v, got %v", s, counts)
+		}
+	}
+}
+
+func TestRingEjection(t *testing.T) {
+	fs := &flakyServers{down: map[string]bool{}}
+	r := NewRing([]string{"a", "b"}, fs.dial)
+	defer r.Close()
+	r.SetBreaker(2, time.Millisecond)
+
+	// Find a key that lives on a.
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key%d", i)
+		if s, _ := r.Server(key); s == "a" {
+			break
+		}
+	}
+
+	fs.setDown("a", true)
+	for i := 0; i < 2; i++ {
+		if _, err := r.Get(key); err == nil ||
+			gomemcached.IsNotFound(err) {
+			t.Fatalf("Expected a connection failure, got %v", err)
+		}
+	}
+	if got := r.Ejected(); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Fatalf("Expected a to be ejected, got %v", got)
+	}
+
+	res, err := r.Get(key)
+	if err != nil {
+		t.Fatalf("Expected b to answer for a, got %v", err)
+	}
+	if string(res.Body) != "b" {
+		t.Errorf("Expected b to answer, got %q", res.Body)
+	}
+
+	fs.setDown("a", false)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.Ejected()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("a was never reinstated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s, _ := r.Server(key); s != "a" {
+		t.Errorf("Expected key to go back to a, went to %v", s)
+	}
+}
+
+func TestRingAllDown(t *testing.T) {
+	fs := &flakyServers{down: map[string]bool{"a": true}}
+	r := NewRing([]string{"a"}, fs.dial)
+	defer r.Close()
+	r.SetBreaker(1, DefaultBreakerProbeInterval)
+
+	r.Get("x")
+	if _, err := r.Get("x"); err != ErrNoServers {
+		t.Errorf("Expected ErrNoServers, got %v", err)
+	}
+}
+
+func TestClusterEjection(t *testing.T) {
+	fs := &flakyServers{down: map[string]bool{"a": true}}
+	cl := NewCluster(&VBucketServerMap{
+		ServerList: []string{"a", "b"},
+		VBucketMap: [][]int{{0, 1}},
+	}, fs.dial)
+	defer cl.Close()
+	cl.SetBreaker(1, DefaultBreakerProbeInterval)
+
+	cl.Get("k")
+	if _, err := cl.Get("k"); err != ErrNodeDown {
+		t.Errorf("Expected ErrNodeDown, got %v", err)
+	}
+	res, err := cl.HedgedGet("k")
+	if err != nil || res.Replica == 0 {
+		t.Errorf("Expected a replica read, got %v/%v", res, err)
+	}
+}
+
+func TestClusterBreakerSettings(t *testing.T) {
+	fs := &flakyServers{down: map[string]bool{}}
+	cl := NewCluster(&VBucketServerMap{
+		ServerList: []string{"a"},
+		VBucketMap: [][]int{{0}},
+	}, fs.dial)
+	defer cl.Close()
+	cl.SetBreaker(7, time.Minute)
+	cl.SetMap(&VBucketServerMap{
+		ServerList: []string{"a", "b"},
+		VBucketMap: [][]int{{0, 1}},
+	})
+	for _, s := range []string{"a", "b"} {
+		p := cl.pool(s)
+		if p.threshold != 7 || p.probeEvery != time.Minute {
+			t.Errorf("Expected %v to have the new settings, got %v/%v",
+				s, p.threshold, p.probeEvery)
+		}
+	}
+}
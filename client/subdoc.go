@@ -0,0 +1,204 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dustin/gomemcached"
+)
+
+// SubdocOp is a single path operation within a subdoc request.
+type SubdocOp struct {
+	Opcode gomemcached.CommandCode
+	Flags  gomemcached.SubdocFlag
+	Path   string
+	// The JSON value for mutations.  For SUBDOC_COUNTER, the delta.
+	Value []byte
+}
+
+// SubdocOptions are document level settings for a subdoc request.
+type SubdocOptions struct {
+	Cas uint64
+	// Set on mutated documents.
+	Expiration uint32
+	DocFlags   gomemcached.SubdocDocFlag
+}
+
+// SubdocResult is the outcome of one path of a multi-path request.
+type SubdocResult struct {
+	Status gomemcached.Status
+	Value  []byte
+}
+
+func (o SubdocOptions) extras(mutation bool) []byte {
+	rv := []byte{}
+	if mutation && o.Expiration != 0 {
+		rv = make([]byte, 4)
+		binary.BigEndian.PutUint32(rv, o.Expiration)
+	}
+	if o.DocFlags != 0 {
+		rv = append(rv, byte(o.DocFlags))
+	}
+	return rv
+}
+
+// NewSubdocRequest builds a single path subdoc request.
+func NewSubdocRequest(vb uint16, key string, op SubdocOp,
+	opts SubdocOptions) *gomemcached.MCRequest {
+
+	extras := make([]byte, 3)
+	binary.BigEndian.PutUint16(extras, uint16(len(op.Path)))
+	extras[2] = byte(op.Flags)
+	extras = append(extras, opts.extras(op.Opcode.IsSubdocMutation())...)
+
+	return &gomemcached.MCRequest{
+		Opcode:  op.Opcode,
+		VBucket: vb,
+		Cas:     opts.Cas,
+		Key:     []byte(key),
+		Extras:  extras,
+		Body:    append([]byte(op.Path), op.Value...),
+	}
+}
+
+// NewLookupInRequest builds a multi-path lookup request.
+func NewLookupInRequest(vb uint16, key string, opts SubdocOptions,
+	ops ...SubdocOp) *gomemcached.MCRequest {
+
+	body := []byte{}
+	for _, op := range ops {
+		spec := []byte{byte(op.Opcode), byte(op.Flags), 0, 0}
+		binary.BigEndian.PutUint16(spec[2:], uint16(len(op.Path)))
+		body = append(append(body, spec...), op.Path...)
+	}
+	return &gomemcached.MCRequest{
+		Opcode:  gomemcached.SUBDOC_MULTI_LOOKUP,
+		VBucket: vb,
+		Cas:     opts.Cas,
+		Key:     []byte(key),
+		Extras:  opts.extras(false),
+		Body:    body,
+	}
+}
+
+// NewMutateInRequest builds a multi-path mutation request.  The
+// mutations are applied atomically.
+func NewMutateInRequest(vb uint16, key string, opts SubdocOptions,
+	ops ...SubdocOp) *gomemcached.MCRequest {
+
+	body := []byte{}
+	for _, op := range ops {
+		spec := []byte{byte(op.Opcode), byte(op.Flags), 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(spec[2:], uint16(len(op.Path)))
+		binary.BigEndian.PutUint32(spec[4:], uint32(len(op.Value)))
+		body = append(append(append(body, spec...), op.Path...), op.Value...)
+	}
+	return &gomemcached.MCRequest{
+		Opcode:  gomemcached.SUBDOC_MULTI_MUTATION,
+		VBucket: vb,
+		Cas:     opts.Cas,
+		Key:     []byte(key),
+		Extras:  opts.extras(true),
+		Body:    body,
+	}
+}
+
+// ParseLookupInResponse gets the result of each path of a multi-path
+// lookup.
+func ParseLookupInResponse(res *gomemcached.MCResponse) ([]SubdocResult, error) {
+	rv := []SubdocResult{}
+	body := res.Body
+	for len(body) > 0 {
+		if len(body) < 6 {
+			return rv, fmt.Errorf("short subdoc lookup result")
+		}
+		n := int(binary.BigEndian.Uint32(body[2:]))
+		if len(body) < 6+n {
+			return rv, fmt.Errorf("short subdoc lookup value")
+		}
+		rv = append(rv, SubdocResult{
+			Status: gomemcached.Status(binary.BigEndian.Uint16(body)),
+			Value:  body[6 : 6+n],
+		})
+		body = body[6+n:]
+	}
+	return rv, nil
+}
+
+// ParseMutateInResponse gets the result of each of the n paths of a
+// multi-path mutation.
+//
+// After a failure, only the path that failed has a result; the rest
+// are left empty.
+func ParseMutateInResponse(res *gomemcached.MCResponse, n int) ([]SubdocResult, error) {
+	rv := make([]SubdocResult, n)
+	body := res.Body
+
+	if res.Status == gomemcached.SUBDOC_MULTI_PATH_FAILURE {
+		if len(body) < 3 || int(body[0]) >= n {
+			return rv, fmt.Errorf("invalid subdoc mutation failure")
+		}
+		rv[body[0]].Status = gomemcached.Status(binary.BigEndian.Uint16(body[1:]))
+		return rv, nil
+	}
+
+	// Only paths that return values are listed.
+	for len(body) > 0 {
+		if len(body) < 7 {
+			return rv, fmt.Errorf("short subdoc mutation result")
+		}
+		i := int(body[0])
+		vlen := int(binary.BigEndian.Uint32(body[3:]))
+		if i >= n || len(body) < 7+vlen {
+			return rv, fmt.Errorf("invalid subdoc mutation result")
+		}
+		rv[i] = SubdocResult{
+			Status: gomemcached.Status(binary.BigEndian.Uint16(body[1:])),
+			Value:  body[7 : 7+vlen],
+		}
+		body = body[7+vlen:]
+	}
+	return rv, nil
+}
+
+// Subdoc performs a single path subdoc operation.
+func (c *Client) Subdoc(vb uint16, key string, op SubdocOp,
+	opts SubdocOptions) (*gomemcached.MCResponse, error) {
+	return c.Send(NewSubdocRequest(vb, key, op, opts))
+}
+
+// LookupIn performs several lookups within a document.
+//
+// The error is only for problems with the whole request, such as a
+// missing document.  Check each result's Status for problems with
+// individual paths.
+func (c *Client) LookupIn(vb uint16, key string, opts SubdocOptions,
+	ops ...SubdocOp) ([]SubdocResult, error) {
+
+	res, err := c.Send(NewLookupInRequest(vb, key, opts, ops...))
+	if err != nil && (res == nil ||
+		res.Status != gomemcached.SUBDOC_MULTI_PATH_FAILURE) {
+		return nil, err
+	}
+	return ParseLookupInResponse(res)
+}
+
+// MutateIn atomically performs several mutations within a document.
+//
+// If a path fails, nothing is changed, the error is the response
+// (with status SUBDOC_MULTI_PATH_FAILURE) and the failing path's
+// result says why.
+func (c *Client) MutateIn(vb uint16, key string, opts SubdocOptions,
+	ops ...SubdocOp) (*gomemcached.MCResponse, []SubdocResult, error) {
+
+	res, err := c.Send(NewMutateInRequest(vb, key, opts, ops...))
+	if err != nil && (res == nil ||
+		res.Status != gomemcached.SUBDOC_MULTI_PATH_FAILURE) {
+		return res, nil, err
+	}
+	results, perr := ParseMutateInResponse(res, len(ops))
+	if perr != nil {
+		return res, results, perr
+	}
+	return res, results, err
+}
@@ -0,0 +1,124 @@
+package memcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestSubdocRequest(t *testing.T) {
+	req := NewSubdocRequest(3, "doc", SubdocOp{
+		Opcode: gomemcached.SUBDOC_DICT_UPSERT,
+		Flags:  gomemcached.SUBDOC_FLAG_MKDIR_P,
+		Path:   "a.b",
+		Value:  []byte("1"),
+	}, SubdocOptions{Cas: 9, Expiration: 60, DocFlags: gomemcached.SUBDOC_DOC_MKDOC})
+
+	exp := []byte{0, 3, 1, 0, 0, 0, 60, 1}
+	if !bytes.Equal(req.Extras, exp) {
+		t.Errorf("Expected extras %v, got %v", exp, req.Extras)
+	}
+	if string(req.Body) != "a.b1" || req.Cas != 9 || req.VBucket != 3 {
+		t.Errorf("Unexpected request: %v", req)
+	}
+
+	req = NewSubdocRequest(0, "doc", SubdocOp{
+		Opcode: gomemcached.SUBDOC_GET,
+		Path:   "a",
+	}, SubdocOptions{Expiration: 60})
+	if !bytes.Equal(req.Extras, []byte{0, 1, 0}) {
+		t.Errorf("Expected no expiration on a lookup, got %v", req.Extras)
+	}
+}
+
+func subdocServer() *Client {
+	return serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		switch req.Opcode {
+		case gomemcached.SUBDOC_MULTI_LOOKUP:
+			exp := []byte{byte(gomemcached.SUBDOC_GET), 0, 0, 1, 'a',
+				byte(gomemcached.SUBDOC_EXISTS), 4, 0, 1, 'z'}
+			if !bytes.Equal(req.Body, exp) {
+				return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+			}
+			return &gomemcached.MCResponse{
+				Status: gomemcached.SUBDOC_MULTI_PATH_FAILURE,
+				Body: []byte{0, 0, 0, 0, 0, 1, '1',
+					0, 0xc0, 0, 0, 0, 0},
+			}
+		case gomemcached.SUBDOC_MULTI_MUTATION:
+			if string(req.Key) == "bad" {
+				return &gomemcached.MCResponse{
+					Status: gomemcached.SUBDOC_MULTI_PATH_FAILURE,
+					Body:   []byte{1, 0, 0xc0},
+				}
+			}
+			if len(req.Body) != 8+1+1+8+1+1 ||
+				binary.BigEndian.Uint32(req.Body[4:]) != 1 {
+				return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+			}
+			return &gomemcached.MCResponse{
+				Cas:  5,
+				Body: []byte{1, 0, 0, 0, 0, 0, 1, '3'},
+			}
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	})
+}
+
+func TestLookupIn(t *testing.T) {
+	c := subdocServer()
+	defer c.Close()
+
+	results, err := c.LookupIn(0, "doc", SubdocOptions{},
+		SubdocOp{Opcode: gomemcached.SUBDOC_GET, Path: "a"},
+		SubdocOp{Opcode: gomemcached.SUBDOC_EXISTS,
+			Flags: gomemcached.SUBDOC_FLAG_XATTR, Path: "z"})
+	if err != nil {
+		t.Fatalf("Error looking up: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected two results, got %v", results)
+	}
+	if results[0].Status != gomemcached.SUCCESS || string(results[0].Value) != "1" {
+		t.Errorf("Expected the first path to be found, got %v", results[0])
+	}
+	if results[1].Status != gomemcached.SUBDOC_PATH_ENOENT {
+		t.Errorf("Expected the second path to be missing, got %v", results[1])
+	}
+}
+
+func TestMutateIn(t *testing.T) {
+	c := subdocServer()
+	defer c.Close()
+
+	ops := []SubdocOp{
+		{Opcode: gomemcached.SUBDOC_DICT_UPSERT, Path: "a", Value: []byte("1")},
+		{Opcode: gomemcached.SUBDOC_COUNTER, Path: "n", Value: []byte("2")},
+	}
+	res, results, err := c.MutateIn(0, "doc", SubdocOptions{}, ops...)
+	if err != nil {
+		t.Fatalf("Error mutating: %v", err)
+	}
+	if res.Cas != 5 {
+		t.Errorf("Expected the new CAS, got %v", res.Cas)
+	}
+	if len(results) != 2 || results[1].Status != gomemcached.SUCCESS ||
+		string(results[1].Value) != "3" || results[0].Value != nil {
+		t.Errorf("Expected only the counter to return a value, got %v", results)
+	}
+
+	_, results, err = c.MutateIn(0, "bad", SubdocOptions{}, ops...)
+	if errStatus(err) != gomemcached.SUBDOC_MULTI_PATH_FAILURE {
+		t.Fatalf("Expected a path failure, got %v", err)
+	}
+	if len(results) != 2 || results[1].Status != gomemcached.SUBDOC_PATH_ENOENT {
+		t.Errorf("Expected the second path to fail, got %v", results)
+	}
+
+	_, _, err = c.MutateIn(0, "missing", SubdocOptions{})
+	if errStatus(err) != gomemcached.EINVAL {
+		t.Errorf("Expected a whole request failure, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package memcached
+
+import (
+	"sync"
+
+	"github.com/dustin/gomemcached"
+)
+
+// Default TapArguments.AckWindow.
+const DefaultTapAckWindow = 100
+
+// tapAck is the acknowledgement state of one delivered TAP packet.
+type tapAck struct {
+	acks *tapAcks
+	pkt  *gomemcached.MCRequest // nil if the server didn't ask for an ack
+	done bool
+	// Whether this holds a slot in the window.
+	counted bool
+}
+
+// tapAcks tracks delivered events until the consumer acknowledges
+// them, and acknowledges packets to the server in the order they
+// arrived.
+type tapAcks struct {
+	mc     *Client
+	window chan bool
+
+	mu      sync.Mutex
+	pending []*tapAck
+}
+
+func newTapAcks(mc *Client, window int) *tapAcks {
+	if window <= 0 {
+		window = DefaultTapAckWindow
+	}
+	return &tapAcks{mc: mc, window: make(chan bool, window)}
+}
+
+// track waits for room in the window for an event and returns its
+// ack handle.  It returns nil if the feed is closed while waiting.
+func (a *tapAcks) track(pkt *gomemcached.MCRequest, needAck bool,
+	closer <-chan bool) *tapAck {
+
+	select {
+	case a.window <- true:
+	case <-closer:
+		return nil
+	}
+	rv := &tapAck{acks: a, counted: true}
+	if needAck {
+		rv.pkt = pkt
+	}
+	a.mu.Lock()
+	a.pending = append(a.pending, rv)
+	a.mu.Unlock()
+	return rv
+}
+
+// skip acknowledges a packet that wasn't delivered as soon as
+// everything before it is acknowledged.
+func (a *tapAcks) skip(pkt *gomemcached.MCRequest) error {
+	a.mu.Lock()
+	a.pending = append(a.pending, &tapAck{acks: a, pkt: pkt})
+	a.mu.Unlock()
+	return a.ack(nil)
+}
+
+// ack marks one event done and sends the acks that are now due.
+func (a *tapAcks) ack(t *tapAck) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if t != nil {
+		if t.done {
+			return nil
+		}
+		t.done = true
+	}
+
+	for len(a.pending) > 0 {
+		head := a.pending[0]
+		if head.counted && !head.done {
+			break
+		}
+		a.pending = a.pending[1:]
+		if head.counted {
+			<-a.window
+		}
+		if head.pkt != nil {
+			if _, err := a.mc.sendAck(head.pkt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Ack tells the server an event from a TAP feed with ManualAck has
+// been handled.  Events may be acknowledged in any order; the server
+// is told once all earlier events are acknowledged too.
+//
+// It does nothing for events from other feeds.
+func (event TapEvent) Ack() error {
+	if event.ack == nil {
+		return nil
+	}
+	return event.ack.acks.ack(event.ack)
+}
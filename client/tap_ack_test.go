@@ -0,0 +1,116 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func tapAckPacket(op gomemcached.CommandCode, key string, opaque uint32,
+	needAck bool) *gomemcached.MCRequest {
+
+	pkt := &gomemcached.MCRequest{
+		Opcode: op,
+		Key:    []byte(key),
+		Opaque: opaque,
+		Extras: make([]byte, 16),
+	}
+	if needAck {
+		binary.BigEndian.PutUint16(pkt.Extras[2:], gomemcached.TAP_ACK)
+	}
+	return pkt
+}
+
+func TestTapManualAck(t *testing.T) {
+	cli, srv := net.Pipe()
+	acked := make(chan uint32, 10)
+	go func() {
+		var req gomemcached.MCRequest
+		if _, err := req.Receive(srv, nil); err != nil {
+			return
+		}
+		go func() {
+			for {
+				var res gomemcached.MCResponse
+				if _, err := res.Receive(srv, nil); err != nil {
+					return
+				}
+				acked <- res.Opaque
+			}
+		}()
+		for _, pkt := range []*gomemcached.MCRequest{
+			tapAckPacket(gomemcached.TAP_MUTATION, "m1", 1, false),
+			tapAckPacket(gomemcached.TAP_MUTATION, "m2", 2, true),
+			tapAckPacket(gomemcached.TAP_MUTATION, "m3", 3, true),
+			// Not delivered (auto nack), but still needs an ack.
+			tapAckPacket(gomemcached.TAP_OPAQUE, "", 4, true),
+		} {
+			pkt.Transmit(srv)
+		}
+	}()
+
+	mc, err := Wrap(cli)
+	must(err)
+	args := DefaultTapArguments()
+	args.ManualAck = true
+	args.AckWindow = 2
+	feed, err := mc.StartTapFeed(args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	defer mc.Close()
+
+	next := func() TapEvent {
+		select {
+		case e := <-feed.C:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for an event")
+		}
+		panic("unreachable")
+	}
+	noAck := func() {
+		select {
+		case o := <-acked:
+			t.Fatalf("Unexpected ack of %v", o)
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	m1, m2 := next(), next()
+	select {
+	case e := <-feed.C:
+		t.Fatalf("Expected the window to hold back %v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := m2.Ack(); err != nil {
+		t.Fatalf("Error acking: %v", err)
+	}
+	noAck()
+	m1.Ack()
+	if o := <-acked; o != 2 {
+		t.Errorf("Expected m2 to be acked, got %v", o)
+	}
+
+	m3 := next()
+	if string(m3.Key) != "m3" {
+		t.Fatalf("Expected m3, got %v", m3)
+	}
+	noAck()
+	m3.Ack()
+	m3.Ack()
+	for _, exp := range []uint32{3, 4} {
+		if o := <-acked; o != exp {
+			t.Errorf("Expected an ack of %v, got %v", exp, o)
+		}
+	}
+	noAck()
+
+	if err := (TapEvent{}).Ack(); err != nil {
+		t.Errorf("Expected acking an untracked event to do nothing, got %v", err)
+	}
+}
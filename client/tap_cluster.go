@@ -0,0 +1,352 @@
+package memcached
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ClusterTapFeed is a single TAP feed from every server in a vbucket
+// map.  Each server is asked for the vbuckets it's the master of, and
+// the events of all of them arrive on C.
+//
+// When the map changes, only the streams of servers that gained or
+// lost vbuckets are restarted.  A vbucket's old stream is finished
+// before its new one starts, so events for each vbucket arrive in
+// order.  With Checkpoint set, restarted streams resume from the last
+// checkpoint seen on each of their vbuckets instead of using Backfill.
+//
+// Streams that fail are restarted, with the same delays as a
+// ResumableTapFeed.
+type ClusterTapFeed struct {
+	C <-chan TapEvent
+
+	dial   DialFunc
+	args   TapArguments
+	subset map[uint16]bool // nil for every vbucket
+
+	ch     chan TapEvent
+	remap  chan *VBucketServerMap
+	ended  chan *clusterTapStream
+	closer chan bool
+
+	// Owned by the run goroutine.
+	vbmap    *VBucketServerMap
+	streams  map[string]*clusterTapStream
+	finished map[string]bool // dumps that are complete
+
+	mu          sync.Mutex
+	checkpoints map[uint16]uint64
+	closed      bool
+}
+
+// clusterTapStream is the TAP feed of one server.
+type clusterTapStream struct {
+	server   string
+	vbuckets []uint16
+	client   *Client
+	feed     *TapFeed
+	stop     chan bool
+	// Closed once the last event has been delivered.
+	done chan bool
+}
+
+// StartClusterTapFeed starts a TAP feed from the masters of every
+// vbucket in the map, or of args.VBuckets if any are listed.
+//
+// Connections are made with dial (DefaultDial if nil).  An error is
+// only returned if a first connection fails.
+func StartClusterTapFeed(m *VBucketServerMap, dial DialFunc,
+	args TapArguments) (*ClusterTapFeed, error) {
+
+	if dial == nil {
+		dial = DefaultDial
+	}
+	ch := make(chan TapEvent)
+	feed := &ClusterTapFeed{
+		C:           ch,
+		dial:        dial,
+		args:        args,
+		ch:          ch,
+		remap:       make(chan *VBucketServerMap, 1),
+		ended:       make(chan *clusterTapStream),
+		closer:      make(chan bool),
+		vbmap:       m,
+		streams:     map[string]*clusterTapStream{},
+		finished:    map[string]bool{},
+		checkpoints: map[uint16]uint64{},
+	}
+	if len(args.VBuckets) > 0 {
+		feed.subset = map[uint16]bool{}
+		for _, vb := range args.VBuckets {
+			feed.subset[vb] = true
+		}
+	}
+	for vb, id := range args.Checkpoints {
+		feed.checkpoints[vb] = id
+	}
+
+	assigned := feed.assign(m)
+	servers := []string{}
+	for server := range assigned {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		s, err := feed.start(server, assigned[server])
+		if err != nil {
+			feed.Close()
+			for _, s := range feed.streams {
+				s.halt()
+			}
+			return nil, err
+		}
+		feed.streams[server] = s
+	}
+	go feed.run()
+	return feed, nil
+}
+
+// assign finds the vbuckets each server should stream.
+func (feed *ClusterTapFeed) assign(m *VBucketServerMap) map[string][]uint16 {
+	rv := map[string][]uint16{}
+	for i := range m.VBucketMap {
+		vb := uint16(i)
+		if feed.subset != nil && !feed.subset[vb] {
+			continue
+		}
+		if servers := m.servers(vb); len(servers) > 0 && servers[0] != "" {
+			rv[servers[0]] = append(rv[servers[0]], vb)
+		}
+	}
+	return rv
+}
+
+func (feed *ClusterTapFeed) start(server string, vbs []uint16) (*clusterTapStream, error) {
+	args := feed.args
+	args.VBuckets = vbs
+	feed.mu.Lock()
+	if feed.closed {
+		feed.mu.Unlock()
+		return nil, errors.New("closed")
+	}
+	args.Checkpoints = nil
+	for _, vb := range vbs {
+		if id, ok := feed.checkpoints[vb]; ok {
+			if args.Checkpoints == nil {
+				args.Checkpoints = map[uint16]uint64{}
+			}
+			args.Checkpoints[vb] = id
+		}
+	}
+	if args.Checkpoint && len(args.Checkpoints) > 0 {
+		// Resume from the checkpoints rather than backfilling.
+		args.Backfill = 0
+	}
+	feed.mu.Unlock()
+
+	c, err := feed.dial(server)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := c.StartTapFeed(args)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s := &clusterTapStream{
+		server:   server,
+		vbuckets: vbs,
+		client:   c,
+		feed:     tf,
+		stop:     make(chan bool),
+		done:     make(chan bool),
+	}
+	go feed.forward(s)
+	return s, nil
+}
+
+func (feed *ClusterTapFeed) track(e TapEvent) {
+	if !feed.args.Checkpoint {
+		return
+	}
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	switch e.Opcode {
+	case TapCheckpointStart:
+		feed.checkpoints[e.VBucket] = e.Checkpoint
+	case TapCheckpointEnd:
+		feed.checkpoints[e.VBucket] = e.Checkpoint + 1
+	}
+}
+
+// forward delivers the events of one stream until it ends.
+func (feed *ClusterTapFeed) forward(s *clusterTapStream) {
+	for e := range s.feed.C {
+		feed.track(e)
+		select {
+		case feed.ch <- e:
+		case <-feed.closer:
+			s.client.Close()
+			for range s.feed.C {
+			}
+		}
+	}
+	close(s.done)
+	select {
+	case feed.ended <- s:
+	case <-s.stop:
+	case <-feed.closer:
+	}
+}
+
+// halt ends a stream and waits for its events to be delivered.
+func (s *clusterTapStream) halt() {
+	close(s.stop)
+	s.feed.Close()
+	s.client.Close()
+	<-s.done
+}
+
+func sameVBuckets(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// rebalance moves the streams to the current map, and reports
+// whether every server that should have one does.
+func (feed *ClusterTapFeed) rebalance() bool {
+	want := feed.assign(feed.vbmap)
+
+	servers := []string{}
+	for server, s := range feed.streams {
+		if !sameVBuckets(s.vbuckets, want[server]) {
+			servers = append(servers, server)
+		}
+	}
+	sort.Strings(servers)
+	// Finish the old streams of moving vbuckets before starting new
+	// ones.
+	for _, server := range servers {
+		feed.streams[server].halt()
+		delete(feed.streams, server)
+		delete(feed.finished, server)
+	}
+
+	servers = servers[:0]
+	for server := range want {
+		if feed.streams[server] == nil && !feed.finished[server] {
+			servers = append(servers, server)
+		}
+	}
+	sort.Strings(servers)
+	ok := true
+	for _, server := range servers {
+		s, err := feed.start(server, want[server])
+		if err != nil {
+			log.Printf("ClusterTapFeed: Error connecting to %v: %v",
+				server, err)
+			ok = false
+			continue
+		}
+		feed.streams[server] = s
+	}
+	return ok
+}
+
+func (feed *ClusterTapFeed) run() {
+	defer close(feed.ch)
+	defer func() {
+		for _, s := range feed.streams {
+			s.halt()
+		}
+	}()
+
+	var retry <-chan time.Time
+	delay := TapReconnectMinDelay
+	failed := func() {
+		if retry == nil {
+			retry = time.After(delay)
+			delay *= 2
+			if delay > TapReconnectMaxDelay {
+				delay = TapReconnectMaxDelay
+			}
+		}
+	}
+
+	for {
+		if feed.args.Dump && len(feed.streams) == 0 && retry == nil {
+			// Every dump is complete.
+			return
+		}
+		select {
+		case m := <-feed.remap:
+			feed.vbmap = m
+			if feed.rebalance() {
+				delay = TapReconnectMinDelay
+			} else {
+				failed()
+			}
+		case s := <-feed.ended:
+			if feed.streams[s.server] != s {
+				continue
+			}
+			delete(feed.streams, s.server)
+			if s.feed.Ended {
+				feed.finished[s.server] = true
+				continue
+			}
+			log.Printf("ClusterTapFeed: Lost %v (%v), reconnecting",
+				s.server, s.feed.Error)
+			failed()
+		case <-retry:
+			retry = nil
+			if feed.rebalance() {
+				delay = TapReconnectMinDelay
+			} else {
+				failed()
+			}
+		case <-feed.closer:
+			return
+		}
+	}
+}
+
+// SetMap moves the feed's streams to a new vbucket map.  It returns
+// without waiting for the streams to move.
+func (feed *ClusterTapFeed) SetMap(m *VBucketServerMap) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if feed.closed {
+		return
+	}
+	// Only the latest map matters.
+	select {
+	case <-feed.remap:
+	default:
+	}
+	feed.remap <- m
+}
+
+// Close terminates a ClusterTapFeed and all of its connections.
+//
+// The channel ends when every server has finished a dump, or after
+// Close.
+func (feed *ClusterTapFeed) Close() {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if feed.closed {
+		return
+	}
+	feed.closed = true
+	close(feed.closer)
+}
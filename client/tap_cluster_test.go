@@ -0,0 +1,292 @@
+package memcached
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	mcserver "github.com/dustin/gomemcached/server"
+)
+
+// tapNode is a fake server whose TAP streams are fed by the test.
+type tapNode struct {
+	items   []mcserver.TapChange
+	watches chan chan mcserver.TapChange
+	stops   chan bool
+}
+
+func newTapNode(vbs ...uint16) *tapNode {
+	n := &tapNode{
+		watches: make(chan chan mcserver.TapChange, 10),
+		stops:   make(chan bool, 10),
+	}
+	for _, vb := range vbs {
+		n.items = append(n.items, mcserver.TapChange{
+			Key:     string(rune('a' + vb)),
+			VBucket: vb,
+		})
+	}
+	return n
+}
+
+func (n *tapNode) TapWatch() ([]mcserver.TapChange, <-chan mcserver.TapChange, func()) {
+	ch := make(chan mcserver.TapChange)
+	n.watches <- ch
+	return n.items, ch, func() { n.stops <- true }
+}
+
+func (n *tapNode) watch(t *testing.T) chan mcserver.TapChange {
+	select {
+	case ch := <-n.watches:
+		return ch
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a stream")
+	}
+	panic("unreachable")
+}
+
+type tapCluster struct {
+	mu       sync.Mutex
+	nodes    map[string]*tapNode
+	connects map[string][]*gomemcached.MCRequest
+}
+
+func (tc *tapCluster) dial(server string) (*Client, error) {
+	n := tc.nodes[server]
+	if n == nil {
+		return nil, errors.New("no such server")
+	}
+	cli, srv := net.Pipe()
+	// Each connection has its own producer, which stops watching
+	// the node when the connection ends.
+	p := mcserver.NewTapProducer(n)
+	done := make(chan bool)
+	p.Done = done
+	go func() {
+		mcserver.HandleIO(srv, tapConnectRecorder{tc, server, p})
+		close(done)
+	}()
+	return Wrap(cli)
+}
+
+func (tc *tapCluster) vbuckets(server string) [][]uint16 {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	rv := [][]uint16{}
+	for _, req := range tc.connects[server] {
+		c, _ := req.ParseTapCommands()
+		vbs, _ := c.Flags[gomemcached.LIST_VBUCKETS].([]uint16)
+		rv = append(rv, vbs)
+	}
+	return rv
+}
+
+type tapConnectRecorder struct {
+	tc     *tapCluster
+	server string
+	h      mcserver.RequestHandler
+}
+
+func (r tapConnectRecorder) HandleMessage(w io.Writer,
+	req *gomemcached.MCRequest) *gomemcached.MCResponse {
+
+	r.tc.mu.Lock()
+	r.tc.connects[r.server] = append(r.tc.connects[r.server], req)
+	r.tc.mu.Unlock()
+	return r.h.HandleMessage(w, req)
+}
+
+func newTapCluster(servers ...string) *tapCluster {
+	tc := &tapCluster{
+		nodes:    map[string]*tapNode{},
+		connects: map[string][]*gomemcached.MCRequest{},
+	}
+	for _, s := range servers {
+		tc.nodes[s] = newTapNode(0, 1, 2, 3)
+	}
+	return tc
+}
+
+func clusterEvent(t *testing.T, feed *ClusterTapFeed) TapEvent {
+	select {
+	case e := <-feed.C:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for an event")
+	}
+	panic("unreachable")
+}
+
+func TestClusterTapFeedDump(t *testing.T) {
+	tc := newTapCluster("a", "b", "c")
+	m := &VBucketServerMap{
+		ServerList: []string{"a", "b", "c"},
+		VBucketMap: [][]int{{0}, {1}, {0}, {-1}},
+	}
+
+	args := DefaultTapArguments()
+	args.Backfill = 0
+	args.Dump = true
+	feed, err := StartClusterTapFeed(m, tc.dial, args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+
+	keys := []string{}
+	for e := range feed.C {
+		if e.Opcode == TapMutation {
+			keys = append(keys, string(e.Key))
+		}
+	}
+	sort.Strings(keys)
+	if exp := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("Expected %v, got %v", exp, keys)
+	}
+	if got := tc.vbuckets("a"); !reflect.DeepEqual(got, [][]uint16{{0, 2}}) {
+		t.Errorf("Expected a to stream 0 and 2, got %v", got)
+	}
+	if got := tc.vbuckets("c"); len(got) != 0 {
+		t.Errorf("Expected nothing from c, got %v", got)
+	}
+
+	args.VBuckets = []uint16{1, 2}
+	feed, err = StartClusterTapFeed(m, tc.dial, args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	for range feed.C {
+	}
+	if got := tc.vbuckets("a"); !reflect.DeepEqual(got, [][]uint16{{0, 2}, {2}}) {
+		t.Errorf("Expected a to stream 2, got %v", got)
+	}
+
+	m.ServerList[1] = "missing"
+	if _, err := StartClusterTapFeed(m, tc.dial, args); err == nil {
+		t.Errorf("Expected an error from a missing server")
+	}
+}
+
+func TestClusterTapFeedDumpHangup(t *testing.T) {
+	defer func(d time.Duration) { TapReconnectMinDelay = d }(TapReconnectMinDelay)
+	TapReconnectMinDelay = time.Millisecond
+
+	s := &tapScript{
+		conns: [][]*gomemcached.MCRequest{
+			{
+				{Opcode: gomemcached.TAP_MUTATION, Extras: make([]byte, 16), Key: []byte("a")},
+			},
+			{
+				{Opcode: gomemcached.TAP_MUTATION, Extras: make([]byte, 16), Key: []byte("b")},
+				tapEndStreamPacket(),
+			},
+		},
+		hangup: []bool{true, false},
+	}
+	m := &VBucketServerMap{
+		ServerList: []string{"a"},
+		VBucketMap: [][]int{{0}},
+	}
+	args := DefaultTapArguments()
+	args.Dump = true
+	feed, err := StartClusterTapFeed(m, s.dial, args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	defer feed.Close()
+
+	keys := []string{}
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case e, ok := <-feed.C:
+			if !ok {
+				done = true
+			} else if e.Opcode == TapMutation {
+				keys = append(keys, string(e.Key))
+			}
+		case <-timeout:
+			t.Fatalf("Timed out after %v", keys)
+		}
+	}
+	if exp := []string{"a", "b"}; !reflect.DeepEqual(keys, exp) {
+		t.Errorf("Expected the dump to be finished after a hangup, got %v", keys)
+	}
+}
+
+func TestClusterTapFeedStartFailure(t *testing.T) {
+	tc := newTapCluster("a")
+	m := &VBucketServerMap{
+		ServerList: []string{"a", "missing"},
+		VBucketMap: [][]int{{0}, {1}},
+	}
+
+	before := runtime.NumGoroutine()
+	if _, err := StartClusterTapFeed(m, tc.dial, DefaultTapArguments()); err == nil {
+		t.Fatalf("Expected an error from a missing server")
+	}
+	select {
+	case <-tc.nodes["a"].stops:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a's stream to be stopped")
+	}
+	if got := tc.vbuckets("a"); len(got) != 1 {
+		t.Fatalf("Expected a to have been started first, got %v", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v goroutines, got %v", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterTapFeedRebalance(t *testing.T) {
+	tc := newTapCluster("a", "b")
+	a, b := tc.nodes["a"], tc.nodes["b"]
+	m := &VBucketServerMap{
+		ServerList: []string{"a", "b"},
+		VBucketMap: [][]int{{0}, {1}},
+	}
+
+	feed, err := StartClusterTapFeed(m, tc.dial, DefaultTapArguments())
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	defer feed.Close()
+	achanges := a.watch(t)
+	b.watch(t)
+
+	achanges <- mcserver.TapChange{Key: "x", VBucket: 0}
+	if e := clusterEvent(t, feed); string(e.Key) != "x" || e.VBucket != 0 {
+		t.Fatalf("Expected x from vbucket 0, got %v", e)
+	}
+
+	feed.SetMap(&VBucketServerMap{
+		ServerList: []string{"a", "b"},
+		VBucketMap: [][]int{{1}, {1}},
+	})
+	<-a.stops
+	<-b.stops
+	bchanges := b.watch(t)
+	bchanges <- mcserver.TapChange{Key: "y", VBucket: 0}
+	if e := clusterEvent(t, feed); string(e.Key) != "y" || e.VBucket != 0 {
+		t.Fatalf("Expected y from vbucket 0, got %v", e)
+	}
+	if got := tc.vbuckets("b"); !reflect.DeepEqual(got, [][]uint16{{1}, {0, 1}}) {
+		t.Errorf("Expected b to take over vbucket 0, got %v", got)
+	}
+
+	feed.Close()
+	for range feed.C {
+	}
+	<-b.stops
+}
@@ -1,7 +1,6 @@
 package memcached
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -24,10 +23,24 @@ const (
 	TapDeletion
 	TapCheckpointStart
 	TapCheckpointEnd
+	TapReconnected
+	TapVBucketSet
+	TapFlush
 	tapEndStream
 )
 
-const tapMutationExtraLen = 16
+// VBucket states (found in TapEvent.VBucketState)
+const (
+	TapVBucketActive  = uint32(1)
+	TapVBucketReplica = uint32(2)
+	TapVBucketPending = uint32(3)
+	TapVBucketDead    = uint32(4)
+)
+
+const (
+	tapExtraLen         = 8
+	tapMutationExtraLen = 16
+)
 
 var tapOpcodeNames map[TapOpcode]string
 
@@ -39,6 +52,9 @@ func init() {
 		TapDeletion:        "Deletion",
 		TapCheckpointStart: "TapCheckpointStart",
 		TapCheckpointEnd:   "TapCheckpointEnd",
+		TapReconnected:     "Reconnected",
+		TapVBucketSet:      "VBucketSet",
+		TapFlush:           "Flush",
 		tapEndStream:       "EndStream",
 	}
 }
@@ -59,11 +75,21 @@ type TapEvent struct {
 	Expiry     uint32    // Item expiration time
 	Key, Value []byte    // Item key/value
 	Cas        uint64
+	Checkpoint uint64 // Checkpoint ID of a checkpoint event
+
+	Opaque       uint32 // Opaque from the packet header
+	TapFlags     uint16 // TAP_ACK, TAP_NO_VALUE, etc.
+	TTL          uint8  // Hops left before the event is dropped
+	Seqno        uint64 // Revision seqno from the engine private data
+	VBucketState uint32 // New state of a VBucketSet
+
+	ack *tapAck
 }
 
 func makeTapEvent(req gomemcached.MCRequest) *TapEvent {
 	event := TapEvent{
 		VBucket: req.VBucket,
+		Opaque:  req.Opaque,
 	}
 	switch req.Opcode {
 	case gomemcached.TAP_MUTATION:
@@ -77,8 +103,21 @@ func makeTapEvent(req gomemcached.MCRequest) *TapEvent {
 		event.Cas = req.Cas
 	case gomemcached.TAP_CHECKPOINT_START:
 		event.Opcode = TapCheckpointStart
+		if len(req.Body) >= 8 {
+			event.Checkpoint = binary.BigEndian.Uint64(req.Body)
+		}
 	case gomemcached.TAP_CHECKPOINT_END:
 		event.Opcode = TapCheckpointEnd
+		if len(req.Body) >= 8 {
+			event.Checkpoint = binary.BigEndian.Uint64(req.Body)
+		}
+	case gomemcached.TAP_VBUCKET_SET:
+		event.Opcode = TapVBucketSet
+		if len(req.Body) >= 4 {
+			event.VBucketState = binary.BigEndian.Uint32(req.Body)
+		}
+	case gomemcached.TAP_FLUSH:
+		event.Opcode = TapFlush
 	case gomemcached.TAP_OPAQUE:
 		if len(req.Extras) < 8+4 {
 			return nil
@@ -105,7 +144,21 @@ func makeTapEvent(req gomemcached.MCRequest) *TapEvent {
 		return nil // unknown event
 	}
 
-	if len(req.Extras) >= tapMutationExtraLen &&
+	if len(req.Extras) < tapExtraLen {
+		return &event
+	}
+	event.TapFlags = binary.BigEndian.Uint16(req.Extras[2:])
+	event.TTL = req.Extras[4]
+
+	// The engine private data was read onto the end of the extras.
+	elen := len(req.Extras) - int(binary.BigEndian.Uint16(req.Extras))
+	if elen < tapExtraLen {
+		return &event
+	}
+	if len(req.Extras)-elen >= 8 {
+		event.Seqno = binary.BigEndian.Uint64(req.Extras[elen:])
+	}
+	if elen >= tapMutationExtraLen &&
 		(event.Opcode == TapMutation || event.Opcode == TapDeletion) {
 
 		event.Flags = binary.BigEndian.Uint32(req.Extras[8:])
@@ -117,9 +170,17 @@ func makeTapEvent(req gomemcached.MCRequest) *TapEvent {
 
 func (event TapEvent) String() string {
 	switch event.Opcode {
-	case TapBeginBackfill, TapEndBackfill, TapCheckpointStart, TapCheckpointEnd:
+	case TapBeginBackfill, TapEndBackfill, TapReconnected:
 		return fmt.Sprintf("<TapEvent %s, vbucket=%d>",
 			event.Opcode, event.VBucket)
+	case TapCheckpointStart, TapCheckpointEnd:
+		return fmt.Sprintf("<TapEvent %s, vbucket=%d, checkpoint=%d>",
+			event.Opcode, event.VBucket, event.Checkpoint)
+	case TapVBucketSet:
+		return fmt.Sprintf("<TapEvent %s, vbucket=%d, state=%d>",
+			event.Opcode, event.VBucket, event.VBucketState)
+	case TapFlush:
+		return fmt.Sprintf("<TapEvent %s>", event.Opcode)
 	default:
 		return fmt.Sprintf("<TapEvent %s, key=%q (%d bytes) flags=%x, exp=%d>",
 			event.Opcode, event.Key, len(event.Value),
@@ -143,10 +204,18 @@ type TapArguments struct {
 	Takeover bool
 	// If true, server will wait for client ACK after every notification.
 	SupportAck bool
+	// If true, the server is only acknowledged once each event's Ack
+	// is called.  Implies SupportAck.
+	ManualAck bool
+	// With ManualAck, how many events may be unacknowledged before the
+	// feed stops reading.  Zero means DefaultTapAckWindow.
+	AckWindow int
 	// If true, client doesn't want values so server shouldn't send them.
 	KeysOnly bool
 	// If true, client wants the server to send checkpoint events.
 	Checkpoint bool
+	// With Checkpoint, the checkpoint to resume each vbucket from.
+	Checkpoints map[uint16]uint64
 	// Optional identifier to use for this client, to allow reconnects
 	ClientName string
 	// Registers this client (by name) till explicitly deregistered.
@@ -165,35 +234,38 @@ func DefaultTapArguments() TapArguments {
 	}
 }
 
-func (args *TapArguments) flags() []byte {
-	var flags gomemcached.TapConnectFlag
+// connect describes the TAP_CONNECT for these arguments.
+func (args *TapArguments) connect() gomemcached.TapConnect {
+	flags := map[gomemcached.TapConnectFlag]interface{}{}
 	if args.Backfill != 0 {
-		flags |= gomemcached.BACKFILL
+		flags[gomemcached.BACKFILL] = args.Backfill
 	}
 	if args.Dump {
-		flags |= gomemcached.DUMP
+		flags[gomemcached.DUMP] = true
 	}
 	if len(args.VBuckets) > 0 {
-		flags |= gomemcached.LIST_VBUCKETS
+		flags[gomemcached.LIST_VBUCKETS] = args.VBuckets
 	}
 	if args.Takeover {
-		flags |= gomemcached.TAKEOVER_VBUCKETS
+		flags[gomemcached.TAKEOVER_VBUCKETS] = true
 	}
-	if args.SupportAck {
-		flags |= gomemcached.SUPPORT_ACK
+	if args.SupportAck || args.ManualAck {
+		flags[gomemcached.SUPPORT_ACK] = true
 	}
 	if args.KeysOnly {
-		flags |= gomemcached.REQUEST_KEYS_ONLY
+		flags[gomemcached.REQUEST_KEYS_ONLY] = true
 	}
 	if args.Checkpoint {
-		flags |= gomemcached.CHECKPOINT
+		cps := args.Checkpoints
+		if cps == nil {
+			cps = map[uint16]uint64{}
+		}
+		flags[gomemcached.CHECKPOINT] = cps
 	}
 	if args.RegisteredClient {
-		flags |= gomemcached.REGISTERED_CLIENT
+		flags[gomemcached.REGISTERED_CLIENT] = true
 	}
-	encoded := make([]byte, 4)
-	binary.BigEndian.PutUint32(encoded, uint32(flags))
-	return encoded
+	return gomemcached.TapConnect{Flags: flags, Name: args.ClientName}
 }
 
 func must(err error) {
@@ -202,27 +274,15 @@ func must(err error) {
 	}
 }
 
-func (args *TapArguments) bytes() (rv []byte) {
-	buf := bytes.NewBuffer([]byte{})
-
-	if args.Backfill > 0 {
-		must(binary.Write(buf, binary.BigEndian, uint64(args.Backfill)))
-	}
-
-	if len(args.VBuckets) > 0 {
-		must(binary.Write(buf, binary.BigEndian, uint16(len(args.VBuckets))))
-		for i := 0; i < len(args.VBuckets); i++ {
-			must(binary.Write(buf, binary.BigEndian, uint16(args.VBuckets[i])))
-		}
-	}
-	return buf.Bytes()
-}
-
 // TapFeed represents a stream of events from a server.
 type TapFeed struct {
-	C      <-chan TapEvent
-	Error  error
+	C     <-chan TapEvent
+	Error error
+	// Ended is set if the server closed the stream, as it does
+	// after a dump, rather than just hanging up.
+	Ended  bool
 	closer chan bool
+	acks   *tapAcks
 }
 
 // StartTapFeed starts a TAP feed on a client connection.
@@ -232,13 +292,12 @@ type TapFeed struct {
 // receiving the TAP messages. To stop receiving events, close the
 // client connection.
 func (mc *Client) StartTapFeed(args TapArguments) (*TapFeed, error) {
-	rq := &gomemcached.MCRequest{
-		Opcode: gomemcached.TAP_CONNECT,
-		Key:    []byte(args.ClientName),
-		Extras: args.flags(),
-		Body:   args.bytes()}
+	rq, err := args.connect().Request()
+	if err != nil {
+		return nil, err
+	}
 
-	err := mc.Transmit(rq)
+	err = mc.Transmit(rq)
 	if err != nil {
 		return nil, err
 	}
@@ -248,6 +307,9 @@ func (mc *Client) StartTapFeed(args TapArguments) (*TapFeed, error) {
 		C:      ch,
 		closer: make(chan bool),
 	}
+	if args.ManualAck {
+		feed.acks = newTapAcks(mc, args.AckWindow)
+	}
 	go mc.runFeed(ch, feed)
 	return feed, nil
 }
@@ -288,26 +350,42 @@ loop:
 			break loop
 		}
 
+		needAck := false
+		if len(pkt.Extras) >= 4 {
+			reqFlags := binary.BigEndian.Uint16(pkt.Extras[2:])
+			needAck = reqFlags&gomemcached.TAP_ACK != 0
+		}
+
 		event := makeTapEvent(pkt)
 		if event != nil {
 			if event.Opcode == tapEndStream {
+				feed.Ended = true
 				break loop
 			}
 
+			if feed.acks != nil {
+				event.ack = feed.acks.track(&pkt, needAck, feed.closer)
+				if event.ack == nil {
+					break loop
+				}
+			}
+
 			select {
 			case ch <- *event:
 			case <-feed.closer:
 				break loop
 			}
+		} else if needAck && feed.acks != nil {
+			if err := feed.acks.skip(&pkt); err != nil {
+				feed.Error = err
+				break loop
+			}
 		}
 
-		if len(pkt.Extras) >= 4 {
-			reqFlags := binary.BigEndian.Uint16(pkt.Extras[2:])
-			if reqFlags&gomemcached.TAP_ACK != 0 {
-				if _, err := mc.sendAck(&pkt); err != nil {
-					feed.Error = err
-					break loop
-				}
+		if needAck && feed.acks == nil {
+			if _, err := mc.sendAck(&pkt); err != nil {
+				feed.Error = err
+				break loop
 			}
 		}
 	}
@@ -1,6 +1,7 @@
 package memcached
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/dustin/gomemcached"
@@ -26,3 +27,52 @@ func TestMakeTapEvent(t *testing.T) {
 		t.Fatalf("Expected Cas to match")
 	}
 }
+
+func TestMakeTapEventMetadata(t *testing.T) {
+	extras := make([]byte, 16+8)
+	binary.BigEndian.PutUint16(extras, 8)
+	binary.BigEndian.PutUint16(extras[2:], gomemcached.TAP_ACK)
+	extras[4] = 3
+	binary.BigEndian.PutUint32(extras[8:], 0xf1a9)
+	binary.BigEndian.PutUint32(extras[12:], 600)
+	binary.BigEndian.PutUint64(extras[16:], 42)
+	e := makeTapEvent(gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_MUTATION,
+		Opaque: 9,
+		Key:    []byte("k"),
+		Extras: extras,
+	})
+	if e.TapFlags != gomemcached.TAP_ACK || e.TTL != 3 || e.Opaque != 9 ||
+		e.Seqno != 42 || e.Flags != 0xf1a9 || e.Expiry != 600 {
+		t.Errorf("Incorrect mutation metadata: %#v", e)
+	}
+
+	// A deletion's engine private data isn't item flags.
+	extras = make([]byte, 8+8)
+	binary.BigEndian.PutUint16(extras, 8)
+	binary.BigEndian.PutUint64(extras[8:], 43)
+	e = makeTapEvent(gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_DELETE,
+		Key:    []byte("k"),
+		Extras: extras,
+	})
+	if e.Seqno != 43 || e.Flags != 0 || e.Expiry != 0 {
+		t.Errorf("Incorrect deletion metadata: %#v", e)
+	}
+
+	e = makeTapEvent(gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_VBUCKET_SET,
+		VBucket: 7,
+		Extras:  make([]byte, 8),
+		Body:    []byte{0, 0, 0, 2},
+	})
+	if e.Opcode != TapVBucketSet || e.VBucket != 7 ||
+		e.VBucketState != TapVBucketReplica {
+		t.Errorf("Expected vbucket 7 to become a replica, got %v", e)
+	}
+
+	e = makeTapEvent(gomemcached.MCRequest{Opcode: gomemcached.TAP_FLUSH})
+	if e.Opcode != TapFlush {
+		t.Errorf("Expected a flush, got %v", e)
+	}
+}
@@ -0,0 +1,180 @@
+package memcached
+
+import (
+	"bytes"
+	"regexp"
+	"time"
+)
+
+// A TapFilter decides whether to keep a TAP event, and may change it
+// on the way.
+type TapFilter func(*TapEvent) bool
+
+// Whether an event is about an item.  Filters of items let other
+// events through.
+func (event *TapEvent) isItem() bool {
+	return event.Opcode == TapMutation || event.Opcode == TapDeletion
+}
+
+// TapKeyPrefix keeps items whose keys start with the prefix.
+func TapKeyPrefix(prefix string) TapFilter {
+	p := []byte(prefix)
+	return func(e *TapEvent) bool {
+		return !e.isItem() || bytes.HasPrefix(e.Key, p)
+	}
+}
+
+// TapKeyMatch keeps items whose keys match the regexp.
+func TapKeyMatch(re *regexp.Regexp) TapFilter {
+	return func(e *TapEvent) bool {
+		return !e.isItem() || re.Match(e.Key)
+	}
+}
+
+// TapVBuckets keeps items in the given vbuckets.
+func TapVBuckets(vbuckets ...uint16) TapFilter {
+	vbs := map[uint16]bool{}
+	for _, vb := range vbuckets {
+		vbs[vb] = true
+	}
+	return func(e *TapEvent) bool {
+		return !e.isItem() || vbs[e.VBucket]
+	}
+}
+
+// TapOpcodes keeps events of the given types, and no others.
+func TapOpcodes(opcodes ...TapOpcode) TapFilter {
+	ops := map[TapOpcode]bool{}
+	for _, op := range opcodes {
+		ops[op] = true
+	}
+	return func(e *TapEvent) bool {
+		return ops[e.Opcode]
+	}
+}
+
+// Expirations longer than this are absolute unix times.
+const maxRelativeExpiry = 60 * 60 * 24 * 30
+
+// TapDropExpired drops mutations of items that have already expired.
+// Only absolute expiration times can be checked.
+func TapDropExpired() TapFilter {
+	return func(e *TapEvent) bool {
+		return e.Opcode != TapMutation || e.Expiry <= maxRelativeExpiry ||
+			int64(e.Expiry) > time.Now().Unix()
+	}
+}
+
+// TapKeysOnly removes the values of mutations.
+func TapKeysOnly() TapFilter {
+	return func(e *TapEvent) bool {
+		if e.Opcode == TapMutation {
+			e.Value = nil
+		}
+		return true
+	}
+}
+
+// Filter returns a feed of the events that pass every filter, in
+// order.  Dropped events are acknowledged as if they'd been handled.
+//
+// The new feed's Error and Ended are the original's once its channel
+// ends.  Closing either feed closes both, so only close one.
+func (feed *TapFeed) Filter(filters ...TapFilter) *TapFeed {
+	ch := make(chan TapEvent)
+	rv := &TapFeed{C: ch, closer: feed.closer, acks: feed.acks}
+	go func() {
+		defer close(ch)
+	events:
+		for e := range feed.C {
+			for _, f := range filters {
+				if !f(&e) {
+					e.Ack()
+					continue events
+				}
+			}
+			select {
+			case ch <- e:
+			case <-feed.closer:
+				return
+			}
+		}
+		rv.Error = feed.Error
+		rv.Ended = feed.Ended
+	}()
+	return rv
+}
+
+// TapBatchFeed delivers the events of a TapFeed in batches.
+type TapBatchFeed struct {
+	C     <-chan []TapEvent
+	Error error
+	// As for TapFeed.
+	Ended  bool
+	closer chan bool
+}
+
+// Batch returns a feed of the events in slices of up to max events.
+// A batch is sent when it's full, when latency has passed since its
+// first event, or when the feed ends.  Zero latency waits for full
+// batches.
+//
+// With ManualAck, keep max within the AckWindow or allow some
+// latency, or the feed may wait on acks for a batch that never fills.
+//
+// The new feed's Error and Ended are the original's once its channel
+// ends.  Closing either feed closes both, so only close one.
+func (feed *TapFeed) Batch(max int, latency time.Duration) *TapBatchFeed {
+	if max < 1 {
+		max = 1
+	}
+	ch := make(chan []TapEvent)
+	rv := &TapBatchFeed{C: ch, closer: feed.closer}
+	go func() {
+		defer close(ch)
+		var batch []TapEvent
+		var timer <-chan time.Time
+		send := func() bool {
+			select {
+			case ch <- batch:
+				batch, timer = nil, nil
+				return true
+			case <-feed.closer:
+				return false
+			}
+		}
+
+		for {
+			select {
+			case e, ok := <-feed.C:
+				if !ok {
+					if len(batch) > 0 && !send() {
+						return
+					}
+					rv.Error = feed.Error
+					rv.Ended = feed.Ended
+					return
+				}
+				batch = append(batch, e)
+				if len(batch) == 1 && latency > 0 {
+					timer = time.After(latency)
+				}
+				if len(batch) >= max && !send() {
+					return
+				}
+			case <-timer:
+				if !send() {
+					return
+				}
+			case <-feed.closer:
+				return
+			}
+		}
+	}()
+	return rv
+}
+
+// Close terminates a TapBatchFeed and the TapFeed it came from.
+func (feed *TapBatchFeed) Close() {
+	close(feed.closer)
+}
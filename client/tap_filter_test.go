@@ -0,0 +1,200 @@
+package memcached
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func tapTestFeed(events ...TapEvent) (*TapFeed, chan TapEvent) {
+	ch := make(chan TapEvent, len(events))
+	for _, e := range events {
+		ch <- e
+	}
+	return &TapFeed{C: ch, closer: make(chan bool)}, ch
+}
+
+func tapKeys(events []TapEvent) []string {
+	rv := []string{}
+	for _, e := range events {
+		rv = append(rv, e.Opcode.String()+":"+string(e.Key))
+	}
+	return rv
+}
+
+func TestTapFilters(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	events := []TapEvent{
+		{Opcode: TapBeginBackfill, VBucket: 9},
+		{Opcode: TapMutation, Key: []byte("a:1"), Value: []byte("x")},
+		{Opcode: TapMutation, Key: []byte("b:1"), VBucket: 1},
+		{Opcode: TapDeletion, Key: []byte("a:2"), VBucket: 9},
+		{Opcode: TapMutation, Key: []byte("a:3"), Expiry: 1000000000},
+		{Opcode: TapMutation, Key: []byte("a:4"), Expiry: now + 3600},
+		{Opcode: TapMutation, Key: []byte("a:5"), Expiry: 60},
+		{Opcode: TapEndBackfill},
+	}
+
+	tests := []struct {
+		filters []TapFilter
+		exp     []string
+	}{
+		{nil, []string{"BeginBackfill:", "Mutation:a:1", "Mutation:b:1", "Deletion:a:2",
+			"Mutation:a:3", "Mutation:a:4", "Mutation:a:5", "EndBackfill:"}},
+		{[]TapFilter{TapKeyPrefix("b:")},
+			[]string{"BeginBackfill:", "Mutation:b:1", "EndBackfill:"}},
+		{[]TapFilter{TapKeyMatch(regexp.MustCompile(`[24]$`))},
+			[]string{"BeginBackfill:", "Deletion:a:2", "Mutation:a:4", "EndBackfill:"}},
+		{[]TapFilter{TapVBuckets(1, 9)},
+			[]string{"BeginBackfill:", "Mutation:b:1", "Deletion:a:2", "EndBackfill:"}},
+		{[]TapFilter{TapOpcodes(TapDeletion, TapEndBackfill)},
+			[]string{"Deletion:a:2", "EndBackfill:"}},
+		{[]TapFilter{TapOpcodes(TapMutation), TapDropExpired(), TapKeyPrefix("a")},
+			[]string{"Mutation:a:1", "Mutation:a:4", "Mutation:a:5"}},
+	}
+
+	for _, test := range tests {
+		in, ch := tapTestFeed(events...)
+		close(ch)
+		in.Error = errors.New("gone")
+		feed := in.Filter(test.filters...)
+		got := []TapEvent{}
+		for e := range feed.C {
+			got = append(got, e)
+		}
+		if !reflect.DeepEqual(tapKeys(got), test.exp) {
+			t.Errorf("Expected %v, got %v", test.exp, tapKeys(got))
+		}
+		if feed.Error != in.Error {
+			t.Errorf("Expected the original error, got %v", feed.Error)
+		}
+	}
+
+	in, ch := tapTestFeed(events[1])
+	close(ch)
+	e := <-in.Filter(TapKeysOnly()).C
+	if string(e.Key) != "a:1" || e.Value != nil {
+		t.Errorf("Expected just a key, got %v", e)
+	}
+	if string(events[1].Value) != "x" {
+		t.Errorf("Expected the original event to keep its value")
+	}
+}
+
+func TestTapFilterAcksDropped(t *testing.T) {
+	cli, srv := net.Pipe()
+	mc, err := Wrap(cli)
+	must(err)
+	defer mc.Close()
+	acked := make(chan uint32, 2)
+	go func() {
+		for {
+			var res gomemcached.MCResponse
+			if _, err := res.Receive(srv, nil); err != nil {
+				return
+			}
+			acked <- res.Opaque
+		}
+	}()
+
+	acks := newTapAcks(mc, 10)
+	events := []TapEvent{}
+	for i, key := range []string{"drop", "keep"} {
+		pkt := tapAckPacket(gomemcached.TAP_MUTATION, key, uint32(i+1), true)
+		events = append(events, TapEvent{Opcode: TapMutation, Key: []byte(key),
+			ack: acks.track(pkt, true, nil)})
+	}
+	in, ch := tapTestFeed(events...)
+	in.acks = acks
+	close(ch)
+
+	feed := in.Filter(TapKeyPrefix("k"))
+	e := <-feed.C
+	if o := <-acked; o != 1 {
+		t.Errorf("Expected the dropped event to be acked, got %v", o)
+	}
+	e.Ack()
+	if o := <-acked; o != 2 {
+		t.Errorf("Expected the kept event to be acked, got %v", o)
+	}
+}
+
+func TestTapFilterClose(t *testing.T) {
+	in, ch := tapTestFeed()
+	feed := in.Filter()
+	ch <- TapEvent{Opcode: TapMutation}
+	feed.Close()
+	select {
+	case <-in.closer:
+	default:
+		t.Fatalf("Expected closing the filtered feed to close the original")
+	}
+	for range feed.C {
+	}
+}
+
+func TestTapFilterEnded(t *testing.T) {
+	in, ch := tapTestFeed(TapEvent{Opcode: TapMutation})
+	in.Ended = true
+	close(ch)
+	feed := in.Filter()
+	for range feed.C {
+	}
+	if !feed.Ended || feed.Error != nil {
+		t.Errorf("Expected a filtered feed to end with its original, got %v, %v",
+			feed.Ended, feed.Error)
+	}
+
+	in, ch = tapTestFeed(TapEvent{Opcode: TapMutation})
+	in.Ended = true
+	close(ch)
+	batches := in.Batch(10, 0)
+	for range batches.C {
+	}
+	if !batches.Ended || batches.Error != nil {
+		t.Errorf("Expected a batched feed to end with its original, got %v, %v",
+			batches.Ended, batches.Error)
+	}
+}
+
+func TestTapBatch(t *testing.T) {
+	events := []TapEvent{}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		events = append(events, TapEvent{Opcode: TapMutation, Key: []byte(k)})
+	}
+	in, ch := tapTestFeed(events...)
+	close(ch)
+	in.Error = errors.New("gone")
+	feed := in.Batch(2, 0)
+	sizes := []int{}
+	for b := range feed.C {
+		sizes = append(sizes, len(b))
+	}
+	if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+		t.Errorf("Expected batches of 2, 2 and 1, got %v", sizes)
+	}
+	if feed.Error != in.Error || feed.Ended {
+		t.Errorf("Expected the original error, got %v, %v", feed.Error, feed.Ended)
+	}
+
+	// A partial batch goes after the latency.
+	in, ch = tapTestFeed(events[:3]...)
+	feed = in.Batch(10, 10*time.Millisecond)
+	select {
+	case b := <-feed.C:
+		if len(b) != 3 {
+			t.Errorf("Expected 3 events, got %v", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a partial batch")
+	}
+	ch <- events[3]
+	feed.Close()
+	for range feed.C {
+	}
+}
@@ -0,0 +1,204 @@
+package memcached
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Delays between attempts to reconnect a ResumableTapFeed.  The delay
+// doubles after each failed attempt up to the maximum.
+var (
+	TapReconnectMinDelay = 100 * time.Millisecond
+	TapReconnectMaxDelay = 30 * time.Second
+)
+
+// ResumableTapFeed is a TAP feed that reconnects when its connection
+// fails, resuming from the last checkpoint seen on each vbucket.
+//
+// A TapReconnected event is sent each time it reconnects.  Events
+// since the resumed checkpoints may be seen again.
+type ResumableTapFeed struct {
+	C <-chan TapEvent
+
+	server string
+	dial   DialFunc
+	args   TapArguments
+
+	mu          sync.Mutex
+	checkpoints map[uint16]uint64
+	client      *Client
+	closer      chan bool
+	closed      bool
+}
+
+// StartResumableTapFeed starts a TAP feed from a server that survives
+// reconnects.  The args must name a client; it is registered with the
+// server so the server keeps its place while it's disconnected.
+//
+// Connections are made with dial (DefaultDial if nil).  An error is
+// only returned if the first connection fails.
+func StartResumableTapFeed(server string, dial DialFunc,
+	args TapArguments) (*ResumableTapFeed, error) {
+
+	if args.ClientName == "" {
+		return nil, errors.New("a resumable tap feed needs a ClientName")
+	}
+	if dial == nil {
+		dial = DefaultDial
+	}
+	args.RegisteredClient = true
+	args.Checkpoint = true
+
+	ch := make(chan TapEvent)
+	feed := &ResumableTapFeed{
+		C:           ch,
+		server:      server,
+		dial:        dial,
+		args:        args,
+		checkpoints: map[uint16]uint64{},
+		closer:      make(chan bool),
+	}
+	for vb, id := range args.Checkpoints {
+		feed.checkpoints[vb] = id
+	}
+
+	tf, err := feed.connect()
+	if err != nil {
+		return nil, err
+	}
+	go feed.run(ch, tf)
+	return feed, nil
+}
+
+// Checkpoints returns the checkpoint each vbucket would resume from.
+func (feed *ResumableTapFeed) Checkpoints() map[uint16]uint64 {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	rv := make(map[uint16]uint64, len(feed.checkpoints))
+	for vb, id := range feed.checkpoints {
+		rv[vb] = id
+	}
+	return rv
+}
+
+func (feed *ResumableTapFeed) connect() (*TapFeed, error) {
+	args := feed.args
+	feed.mu.Lock()
+	if len(feed.checkpoints) > 0 {
+		args.Checkpoints = make(map[uint16]uint64, len(feed.checkpoints))
+		for vb, id := range feed.checkpoints {
+			args.Checkpoints[vb] = id
+		}
+		// Resume from the checkpoints rather than backfilling.
+		args.Backfill = 0
+	}
+	feed.mu.Unlock()
+
+	c, err := feed.dial(feed.server)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := c.StartTapFeed(args)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if feed.closed {
+		c.Close()
+		return nil, errors.New("closed")
+	}
+	feed.client = c
+	return tf, nil
+}
+
+func (feed *ResumableTapFeed) track(e TapEvent) {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	switch e.Opcode {
+	case TapCheckpointStart:
+		feed.checkpoints[e.VBucket] = e.Checkpoint
+	case TapCheckpointEnd:
+		feed.checkpoints[e.VBucket] = e.Checkpoint + 1
+	}
+}
+
+// reconnect tries to connect until it works or the feed is closed,
+// backing off from the given delay.  It returns the delay to use
+// next time if the new connection is of no use either.
+func (feed *ResumableTapFeed) reconnect(delay time.Duration) (*TapFeed, time.Duration) {
+	for {
+		select {
+		case <-time.After(delay):
+		case <-feed.closer:
+			return nil, delay
+		}
+		tf, err := feed.connect()
+		delay *= 2
+		if delay > TapReconnectMaxDelay {
+			delay = TapReconnectMaxDelay
+		}
+		if err == nil {
+			return tf, delay
+		}
+		log.Printf("ResumableTapFeed: Error reconnecting to %v: %v",
+			feed.server, err)
+	}
+}
+
+func (feed *ResumableTapFeed) run(ch chan TapEvent, tf *TapFeed) {
+	defer close(ch)
+	delay := TapReconnectMinDelay
+	for {
+		for e := range tf.C {
+			delay = TapReconnectMinDelay
+			feed.track(e)
+			select {
+			case ch <- e:
+			case <-feed.closer:
+				tf.Close()
+				return
+			}
+		}
+		if tf.Ended {
+			// The dump finished.
+			return
+		}
+		select {
+		case <-feed.closer:
+			return
+		default:
+		}
+		log.Printf("ResumableTapFeed: Lost %v (%v), reconnecting",
+			feed.server, tf.Error)
+
+		if tf, delay = feed.reconnect(delay); tf == nil {
+			return
+		}
+		select {
+		case ch <- TapEvent{Opcode: TapReconnected}:
+		case <-feed.closer:
+			return
+		}
+	}
+}
+
+// Close terminates a ResumableTapFeed and its connection.
+//
+// The channel ends when the feed has finished a dump, or after Close.
+func (feed *ResumableTapFeed) Close() {
+	feed.mu.Lock()
+	defer feed.mu.Unlock()
+	if feed.closed {
+		return
+	}
+	feed.closed = true
+	close(feed.closer)
+	if feed.client != nil {
+		feed.client.Close()
+	}
+}
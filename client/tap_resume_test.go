@@ -0,0 +1,191 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// tapScript dials connections that answer a TAP_CONNECT with the
+// next list of packets, then hang up if asked.  A nil list fails the
+// dial.
+type tapScript struct {
+	mu       sync.Mutex
+	conns    [][]*gomemcached.MCRequest
+	hangup   []bool
+	connects []*gomemcached.MCRequest
+}
+
+func (s *tapScript) dial(server string) (*Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) == 0 {
+		return nil, errors.New("no more connections")
+	}
+	pkts, hangup := s.conns[0], s.hangup[0]
+	s.conns, s.hangup = s.conns[1:], s.hangup[1:]
+	if pkts == nil {
+		return nil, errors.New("refused")
+	}
+
+	cli, srv := net.Pipe()
+	go func() {
+		req := &gomemcached.MCRequest{}
+		if _, err := req.Receive(srv, nil); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connects = append(s.connects, req)
+		s.mu.Unlock()
+		for _, pkt := range pkts {
+			pkt.Transmit(srv)
+		}
+		if hangup {
+			srv.Close()
+		}
+	}()
+	return Wrap(cli)
+}
+
+func TestResumableTapFeed(t *testing.T) {
+	defer func(d time.Duration) { TapReconnectMinDelay = d }(TapReconnectMinDelay)
+	TapReconnectMinDelay = time.Millisecond
+
+	checkpoint := make([]byte, 8)
+	binary.BigEndian.PutUint64(checkpoint, 5)
+	s := &tapScript{
+		conns: [][]*gomemcached.MCRequest{
+			{
+				{Opcode: gomemcached.TAP_CHECKPOINT_START, VBucket: 1,
+					Extras: make([]byte, 8), Body: checkpoint},
+				{Opcode: gomemcached.TAP_MUTATION, VBucket: 1,
+					Extras: make([]byte, 16), Key: []byte("a")},
+			},
+			nil,
+			{
+				{Opcode: gomemcached.TAP_MUTATION, VBucket: 1,
+					Extras: make([]byte, 16), Key: []byte("b")},
+			},
+		},
+		hangup: []bool{true, false, false},
+	}
+
+	if _, err := StartResumableTapFeed("x", s.dial, DefaultTapArguments()); err == nil {
+		t.Fatalf("Expected an error without a client name")
+	}
+
+	args := DefaultTapArguments()
+	args.ClientName = "resume"
+	feed, err := StartResumableTapFeed("x", s.dial, args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+
+	exp := []string{"TapCheckpointStart:", "Mutation:a", "Reconnected:", "Mutation:b"}
+	for _, want := range exp {
+		select {
+		case e := <-feed.C:
+			if got := e.Opcode.String() + ":" + string(e.Key); got != want {
+				t.Fatalf("Expected %v, got %v", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %v", want)
+		}
+	}
+	if cp := feed.Checkpoints(); len(cp) != 1 || cp[1] != 5 {
+		t.Errorf("Expected to resume vbucket 1 from 5, got %v", cp)
+	}
+
+	feed.Close()
+	for e := range feed.C {
+		t.Errorf("Unexpected event after close: %v", e)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.connects) != 2 {
+		t.Fatalf("Expected two connections, got %v", len(s.connects))
+	}
+	for _, req := range s.connects {
+		flags := gomemcached.TapConnectFlag(binary.BigEndian.Uint32(req.Extras))
+		if string(req.Key) != "resume" ||
+			flags&gomemcached.REGISTERED_CLIENT == 0 ||
+			flags&gomemcached.CHECKPOINT == 0 {
+			t.Errorf("Expected a registered checkpointing client, got %q %v",
+				req.Key, flags)
+		}
+	}
+	resumed := s.connects[1]
+	flags := gomemcached.TapConnectFlag(binary.BigEndian.Uint32(resumed.Extras))
+	if flags&gomemcached.BACKFILL != 0 {
+		t.Errorf("Expected no backfill on resume, got %v", flags)
+	}
+	expBody := []byte{0, 1, 0, 1, 0, 0, 0, 0, 0, 0, 0, 5}
+	if string(resumed.Body) != string(expBody) {
+		t.Errorf("Expected checkpoints %v, got %v", expBody, resumed.Body)
+	}
+}
+
+// tapEndStreamPacket is what a server sends when it ends a dump.
+func tapEndStreamPacket() *gomemcached.MCRequest {
+	pkt := &gomemcached.MCRequest{
+		Opcode: gomemcached.TAP_OPAQUE,
+		Extras: make([]byte, 12),
+	}
+	binary.BigEndian.PutUint32(pkt.Extras[8:], gomemcached.TAP_OPAQUE_CLOSE_TAP_STREAM)
+	return pkt
+}
+
+func TestResumableTapFeedDumpHangup(t *testing.T) {
+	defer func(d time.Duration) { TapReconnectMinDelay = d }(TapReconnectMinDelay)
+	TapReconnectMinDelay = time.Millisecond
+
+	s := &tapScript{
+		conns: [][]*gomemcached.MCRequest{
+			{
+				{Opcode: gomemcached.TAP_MUTATION, VBucket: 1,
+					Extras: make([]byte, 16), Key: []byte("a")},
+			},
+			{
+				{Opcode: gomemcached.TAP_MUTATION, VBucket: 1,
+					Extras: make([]byte, 16), Key: []byte("b")},
+				tapEndStreamPacket(),
+			},
+		},
+		hangup: []bool{true, false},
+	}
+
+	args := DefaultTapArguments()
+	args.ClientName = "dump"
+	args.Dump = true
+	feed, err := StartResumableTapFeed("x", s.dial, args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	defer feed.Close()
+
+	got := []string{}
+	timeout := time.After(5 * time.Second)
+	for done := false; !done; {
+		select {
+		case e, ok := <-feed.C:
+			if !ok {
+				done = true
+				break
+			}
+			got = append(got, e.Opcode.String()+":"+string(e.Key))
+		case <-timeout:
+			t.Fatalf("Timed out after %v", got)
+		}
+	}
+	exp := []string{"Mutation:a", "Reconnected:", "Mutation:b"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
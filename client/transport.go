@@ -38,6 +38,11 @@ func getResponse(s io.Reader, hdrBytes []byte) (rv *gomemcached.MCResponse, n in
 		ReceiveHook(rv, n, err)
 	}
 
+	if err == nil && rv.DataType&gomemcached.DATATYPE_SNAPPY != 0 {
+		rv.Body, err = gomemcached.SnappyDecode(rv.Body)
+		rv.DataType &^= gomemcached.DATATYPE_SNAPPY
+	}
+
 	if err == nil && rv.Status != gomemcached.SUCCESS {
 		err = rv
 	}
@@ -0,0 +1,94 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+
+	"github.com/dustin/gomemcached"
+)
+
+// SetWithXattrs sets a value along with extended attributes.
+//
+// The server only accepts this after FEATURE_XATTR is negotiated with
+// Hello.
+func (c *Client) SetWithXattrs(vb uint16, key string, flags int, exp int,
+	body []byte, xattrs map[string]string) (*gomemcached.MCResponse, error) {
+
+	req := &gomemcached.MCRequest{
+		Opcode:   gomemcached.SET,
+		VBucket:  vb,
+		Key:      []byte(key),
+		DataType: gomemcached.DATATYPE_XATTR,
+		Extras:   make([]byte, 8),
+		Body:     gomemcached.EncodeXattrs(xattrs, body),
+	}
+	binary.BigEndian.PutUint64(req.Extras, uint64(flags)<<32|uint64(exp))
+	return c.Send(req)
+}
+
+// The virtual xattr holding a document's flags.
+const docFlagsXattr = "$document.flags"
+
+// GetWithXattrs gets a value along with the named extended
+// attributes.  The response's Body is the document and its Extras
+// hold the flags, as for Get; attributes that aren't set are left out
+// of the map.
+//
+// The error is the response if the document itself couldn't be
+// fetched, even when some attributes were.
+func (c *Client) GetWithXattrs(vb uint16, key string,
+	names ...string) (*gomemcached.MCResponse, map[string]string, error) {
+
+	// Xattr paths must come before document paths.
+	ops := make([]SubdocOp, 0, len(names)+2)
+	for _, name := range names {
+		ops = append(ops, SubdocOp{
+			Opcode: gomemcached.SUBDOC_GET,
+			Flags:  gomemcached.SUBDOC_FLAG_XATTR,
+			Path:   name,
+		})
+	}
+	ops = append(ops, SubdocOp{
+		Opcode: gomemcached.SUBDOC_GET,
+		Flags:  gomemcached.SUBDOC_FLAG_XATTR,
+		Path:   docFlagsXattr,
+	})
+	// A GET with an empty path is the whole document.
+	ops = append(ops, SubdocOp{Opcode: gomemcached.GET})
+
+	res, err := c.Send(NewLookupInRequest(vb, key, SubdocOptions{}, ops...))
+	if err != nil && (res == nil ||
+		res.Status != gomemcached.SUBDOC_MULTI_PATH_FAILURE) {
+		return res, nil, err
+	}
+	results, err := ParseLookupInResponse(res)
+	if err != nil {
+		return res, nil, err
+	}
+	if len(results) != len(ops) {
+		return res, nil, fmt.Errorf("expected %v subdoc results, got %v",
+			len(ops), len(results))
+	}
+
+	xattrs := map[string]string{}
+	for i, name := range names {
+		if results[i].Status == gomemcached.SUCCESS {
+			xattrs[name] = string(results[i].Value)
+		}
+	}
+	rv := *res
+	flags, doc := results[len(names)], results[len(names)+1]
+	rv.Status = doc.Status
+	rv.Body = doc.Value
+	rv.Extras = make([]byte, 4)
+	if flags.Status == gomemcached.SUCCESS {
+		f, _ := strconv.ParseUint(string(flags.Value), 10, 32)
+		binary.BigEndian.PutUint32(rv.Extras, uint32(f))
+	}
+	if rv.Status != gomemcached.SUCCESS {
+		rv.Body = nil
+		return &rv, xattrs, &rv
+	}
+	return &rv, xattrs, nil
+}
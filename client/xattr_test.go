@@ -0,0 +1,94 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestXattrs(t *testing.T) {
+	var stored *gomemcached.MCRequest
+	c := serveFake(func(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		switch req.Opcode {
+		case gomemcached.SET:
+			stored = req
+			return &gomemcached.MCResponse{Cas: 1}
+		case gomemcached.SUBDOC_MULTI_LOOKUP:
+			if stored == nil {
+				return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+			}
+			x, body, _ := gomemcached.DecodeXattrs(stored.Body)
+			res := &gomemcached.MCResponse{Cas: 1}
+			result := func(st gomemcached.Status, v string) {
+				r := []byte{0, 0, 0, 0, 0, 0}
+				binary.BigEndian.PutUint16(r, uint16(st))
+				binary.BigEndian.PutUint32(r[2:], uint32(len(v)))
+				res.Body = append(append(res.Body, r...), v...)
+				if st != gomemcached.SUCCESS {
+					res.Status = gomemcached.SUBDOC_MULTI_PATH_FAILURE
+				}
+			}
+			for specs := req.Body; len(specs) >= 4; {
+				n := int(binary.BigEndian.Uint16(specs[2:]))
+				path := string(specs[4 : 4+n])
+				specs = specs[4+n:]
+				v, ok := x[path]
+				switch {
+				case path == "":
+					if string(req.Key) == "deleted" {
+						result(gomemcached.SUBDOC_PATH_ENOENT, "")
+					} else {
+						result(gomemcached.SUCCESS, string(body))
+					}
+				case path == "$document.flags":
+					result(gomemcached.SUCCESS, strconv.Itoa(int(stored.Extras[3])))
+				case ok:
+					result(gomemcached.SUCCESS, v)
+				default:
+					result(gomemcached.SUBDOC_PATH_ENOENT, "")
+				}
+			}
+			return res
+		}
+		return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+	})
+	defer c.Close()
+
+	if _, _, err := c.GetWithXattrs(0, "k", "origin"); errStatus(err) != gomemcached.KEY_ENOENT {
+		t.Errorf("Expected a missing document, got %v", err)
+	}
+
+	_, err := c.SetWithXattrs(0, "k", 7, 0, []byte(`{}`),
+		map[string]string{"origin": `"a"`})
+	if err != nil {
+		t.Fatalf("Error setting: %v", err)
+	}
+	if stored.DataType != gomemcached.DATATYPE_XATTR {
+		t.Errorf("Expected the xattr datatype, got %v", stored.DataType)
+	}
+
+	res, x, err := c.GetWithXattrs(0, "k", "origin", "missing")
+	if err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+	if string(res.Body) != `{}` || res.Cas != 1 || res.Status != gomemcached.SUCCESS {
+		t.Errorf("Expected the document, got %v", res)
+	}
+	if len(res.Extras) != 4 || binary.BigEndian.Uint32(res.Extras) != 7 {
+		t.Errorf("Expected the document's flags, got %v", res.Extras)
+	}
+	if len(x) != 1 || x["origin"] != `"a"` {
+		t.Errorf("Expected only the origin xattr, got %v", x)
+	}
+
+	res, x, err = c.GetWithXattrs(0, "deleted", "origin")
+	if errStatus(err) != gomemcached.SUBDOC_PATH_ENOENT ||
+		res.Status != gomemcached.SUBDOC_PATH_ENOENT {
+		t.Errorf("Expected the document's failure, got %v/%v", res, err)
+	}
+	if x["origin"] != `"a"` {
+		t.Errorf("Expected the xattrs that were found, got %v", x)
+	}
+}
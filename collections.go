@@ -0,0 +1,82 @@
+package gomemcached
+
+import (
+	"errors"
+	"strconv"
+)
+
+// The collection keys belong to when none is given.
+const DEFAULT_COLLECTION_ID = uint32(0)
+
+// ErrBadLEB128 is returned when decoding an invalid LEB128 value.
+var ErrBadLEB128 = errors.New("invalid LEB128 encoding")
+
+// AppendLEB128 appends the unsigned LEB128 encoding of v to b.
+func AppendLEB128(b []byte, v uint32) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// DecodeLEB128 decodes an unsigned LEB128 value from the start of b,
+// returning it and the number of bytes it took.
+func DecodeLEB128(b []byte) (uint32, int, error) {
+	var rv uint64
+	for i := 0; i < len(b) && i < 5; i++ {
+		rv |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			if rv > 1<<32-1 {
+				return 0, 0, ErrBadLEB128
+			}
+			return uint32(rv), i + 1, nil
+		}
+	}
+	return 0, 0, ErrBadLEB128
+}
+
+// EncodeCollectionKey prefixes a key with its collection ID.
+func EncodeCollectionKey(cid uint32, key []byte) []byte {
+	rv := AppendLEB128(make([]byte, 0, len(key)+5), cid)
+	return append(rv, key...)
+}
+
+// DecodeCollectionKey splits a collection ID prefixed key.
+func DecodeCollectionKey(key []byte) (uint32, []byte, error) {
+	cid, n, err := DecodeLEB128(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	return cid, key[n:], nil
+}
+
+// A bucket's collections manifest, as returned by
+// GET_COLLECTIONS_MANIFEST.  UIDs are hex strings.
+type CollectionsManifest struct {
+	UID    string `json:"uid"`
+	Scopes []struct {
+		Name        string `json:"name"`
+		UID         string `json:"uid"`
+		Collections []struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"collections"`
+	} `json:"scopes"`
+}
+
+// CollectionID finds the ID of a collection in the manifest.
+func (m *CollectionsManifest) CollectionID(scope, collection string) (uint32, bool) {
+	for _, s := range m.Scopes {
+		if s.Name != scope {
+			continue
+		}
+		for _, c := range s.Collections {
+			if c.Name == collection {
+				id, err := strconv.ParseUint(c.UID, 16, 32)
+				return uint32(id), err == nil
+			}
+		}
+	}
+	return 0, false
+}
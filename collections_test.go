@@ -0,0 +1,80 @@
+package gomemcached
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestLEB128(t *testing.T) {
+	tests := []struct {
+		v   uint32
+		enc []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x80, 0x01}},
+		{0x555, []byte{0xd5, 0x0a}},
+		{0xffffffff, []byte{0xff, 0xff, 0xff, 0xff, 0x0f}},
+	}
+	for _, test := range tests {
+		got := AppendLEB128(nil, test.v)
+		if !bytes.Equal(got, test.enc) {
+			t.Errorf("Expected %v for 0x%x, got %v", test.enc, test.v, got)
+		}
+		v, n, err := DecodeLEB128(append(got, 'x'))
+		if err != nil || v != test.v || n != len(test.enc) {
+			t.Errorf("Expected 0x%x/%v back, got 0x%x/%v/%v",
+				test.v, len(test.enc), v, n, err)
+		}
+	}
+
+	for _, bad := range [][]byte{
+		{},
+		{0x80},
+		{0xff, 0xff, 0xff, 0xff, 0x1f},
+		{0x80, 0x80, 0x80, 0x80, 0x80, 0x00},
+	} {
+		if _, _, err := DecodeLEB128(bad); err != ErrBadLEB128 {
+			t.Errorf("Expected an error decoding %v, got %v", bad, err)
+		}
+	}
+}
+
+func TestCollectionKey(t *testing.T) {
+	enc := EncodeCollectionKey(8, []byte("key"))
+	if !bytes.Equal(enc, []byte("\x08key")) {
+		t.Errorf("Expected a one byte prefix, got %q", enc)
+	}
+	cid, key, err := DecodeCollectionKey(enc)
+	if err != nil || cid != 8 || string(key) != "key" {
+		t.Errorf("Expected 8/key, got %v/%q/%v", cid, key, err)
+	}
+}
+
+func TestCollectionsManifest(t *testing.T) {
+	data := `{"uid": "2", "scopes": [
+		{"name": "_default", "uid": "0", "collections": [
+			{"name": "_default", "uid": "0"}]},
+		{"name": "app", "uid": "8", "collections": [
+			{"name": "users", "uid": "a"},
+			{"name": "bad", "uid": "zz"}]}]}`
+	m := &CollectionsManifest{}
+	if err := json.Unmarshal([]byte(data), m); err != nil {
+		t.Fatalf("Error parsing manifest: %v", err)
+	}
+	if id, ok := m.CollectionID("app", "users"); !ok || id != 10 {
+		t.Errorf("Expected app.users to be 10, got %v/%v", id, ok)
+	}
+	if id, ok := m.CollectionID("_default", "_default"); !ok || id != 0 {
+		t.Errorf("Expected the default collection to be 0, got %v/%v", id, ok)
+	}
+	for _, c := range []string{"users", "bad"} {
+		if _, ok := m.CollectionID("_default", c); ok {
+			t.Errorf("Expected no _default.%v", c)
+		}
+	}
+	if _, ok := m.CollectionID("app", "bad"); ok {
+		t.Errorf("Expected a bad UID to be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package gomemcached
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DataType describes the encoding of a request or response body.
+type DataType uint8
+
+// Datatype bits
+const (
+	DATATYPE_RAW    = DataType(0x00)
+	DATATYPE_JSON   = DataType(0x01)
+	DATATYPE_SNAPPY = DataType(0x02)
+	DATATYPE_XATTR  = DataType(0x04)
+)
+
+var DataTypeNames = map[DataType]string{
+	DATATYPE_JSON:   "JSON",
+	DATATYPE_SNAPPY: "SNAPPY",
+	DATATYPE_XATTR:  "XATTR",
+}
+
+// Split the ORed bits into the individual datatypes.
+func (d DataType) SplitFlags() []DataType {
+	rv := []DataType{}
+	for i := DataType(1); d != 0; i = i << 1 {
+		if d&i == i {
+			rv = append(rv, i)
+		}
+		d &^= i
+	}
+	return rv
+}
+
+func (d DataType) String() string {
+	if d == DATATYPE_RAW {
+		return "RAW"
+	}
+	parts := []string{}
+	for _, x := range d.SplitFlags() {
+		p := DataTypeNames[x]
+		if p == "" {
+			p = fmt.Sprintf("0x%x", int(x))
+		}
+		parts = append(parts, p)
+	}
+	return strings.Join(parts, "|")
+}
@@ -0,0 +1,19 @@
+package gomemcached
+
+import (
+	"testing"
+)
+
+func TestDataTypeString(t *testing.T) {
+	tests := map[DataType]string{
+		DATATYPE_RAW:                    "RAW",
+		DATATYPE_JSON:                   "JSON",
+		DATATYPE_JSON | DATATYPE_SNAPPY: "JSON|SNAPPY",
+		DATATYPE_XATTR | DataType(0x10): "XATTR|0x10",
+	}
+	for d, exp := range tests {
+		if d.String() != exp {
+			t.Errorf("Expected %v for 0x%x, got %v", exp, uint8(d), d)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package gomemcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Magic bytes for packets with framing extras.
+const (
+	ALT_REQ_MAGIC = 0x08
+	ALT_RES_MAGIC = 0x18
+)
+
+// FrameObjId identifies the kind of a framing extra.  Requests and
+// responses have separate sets of IDs.
+type FrameObjId uint8
+
+// Request framing extras
+const (
+	FRAME_BARRIER      = FrameObjId(0x00)
+	FRAME_DURABILITY   = FrameObjId(0x01)
+	FRAME_STREAM_ID    = FrameObjId(0x02)
+	FRAME_OPEN_TRACING = FrameObjId(0x03)
+	FRAME_IMPERSONATE  = FrameObjId(0x04)
+	FRAME_PRESERVE_TTL = FrameObjId(0x05)
+)
+
+// Response framing extras
+const (
+	FRAME_SERVER_DURATION = FrameObjId(0x00)
+)
+
+// DurabilityLevel is how durable a mutation must be before the server
+// will acknowledge it.
+type DurabilityLevel uint8
+
+// Durability levels
+const (
+	DURABILITY_MAJORITY                    = DurabilityLevel(0x01)
+	DURABILITY_MAJORITY_AND_PERSIST_ACTIVE = DurabilityLevel(0x02)
+	DURABILITY_PERSIST_TO_MAJORITY         = DurabilityLevel(0x03)
+)
+
+// ErrBadFraming is returned when framing extras can't be decoded.
+var ErrBadFraming = errors.New("invalid framing extras")
+
+// ErrHeaderOverflow is returned when sending a message with framing
+// extras, extras or a key too long for their lengths to fit in its
+// header.  With framing extras, the key length is a single byte.
+var ErrHeaderOverflow = errors.New("field too long for the header")
+
+func checkHeaderLengths(framing, extras, key int) error {
+	maxKey := math.MaxUint16
+	if framing > 0 {
+		maxKey = math.MaxUint8
+	}
+	if framing > math.MaxUint8 || extras > math.MaxUint8 || key > maxKey {
+		return ErrHeaderOverflow
+	}
+	return nil
+}
+
+// A single framing extra.
+type FrameInfo struct {
+	ObjId FrameObjId
+	Data  []byte
+}
+
+func (f FrameInfo) String() string {
+	return fmt.Sprintf("{FrameInfo id=%d, len=%d}", f.ObjId, len(f.Data))
+}
+
+// DurabilityFrame requires a mutation to reach a durability level.  A
+// zero timeout leaves the timeout up to the server.
+func DurabilityFrame(level DurabilityLevel, timeout time.Duration) FrameInfo {
+	if timeout <= 0 {
+		return FrameInfo{FRAME_DURABILITY, []byte{byte(level)}}
+	}
+	ms := timeout / time.Millisecond
+	if ms > math.MaxUint16 {
+		ms = math.MaxUint16
+	} else if ms == 0 {
+		ms = 1
+	}
+	data := []byte{byte(level), 0, 0}
+	binary.BigEndian.PutUint16(data[1:], uint16(ms))
+	return FrameInfo{FRAME_DURABILITY, data}
+}
+
+// StreamIDFrame directs a DCP request to a stream.
+func StreamIDFrame(id uint16) FrameInfo {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, id)
+	return FrameInfo{FRAME_STREAM_ID, data}
+}
+
+// Each frame's ID and length are packed in nibbles, with 15 meaning
+// an extra byte follows to add to it.
+func appendFrameNibble(b []byte, v int) (byte, []byte) {
+	if v < 15 {
+		return byte(v), b
+	}
+	return 15, append(b, byte(v-15))
+}
+
+// EncodeFrameInfos builds the framing extras section of a packet.
+func EncodeFrameInfos(frames []FrameInfo) []byte {
+	var rv []byte
+	for _, f := range frames {
+		id, escapes := appendFrameNibble(nil, int(f.ObjId))
+		l, escapes := appendFrameNibble(escapes, len(f.Data))
+		rv = append(rv, id<<4|l)
+		rv = append(rv, escapes...)
+		rv = append(rv, f.Data...)
+	}
+	return rv
+}
+
+// DecodeFrameInfos parses the framing extras section of a packet.
+func DecodeFrameInfos(data []byte) ([]FrameInfo, error) {
+	rv := []FrameInfo{}
+	for len(data) > 0 {
+		id, l := int(data[0]>>4), int(data[0]&0x0f)
+		data = data[1:]
+		if id == 15 {
+			if len(data) < 1 {
+				return nil, ErrBadFraming
+			}
+			id += int(data[0])
+			data = data[1:]
+		}
+		if l == 15 {
+			if len(data) < 1 {
+				return nil, ErrBadFraming
+			}
+			l += int(data[0])
+			data = data[1:]
+		}
+		if id > math.MaxUint8 || len(data) < l {
+			return nil, ErrBadFraming
+		}
+		rv = append(rv, FrameInfo{FrameObjId(id), data[:l]})
+		data = data[l:]
+	}
+	return rv, nil
+}
+
+// frameLen is the encoded length of a set of framing extras.
+func frameLen(frames []FrameInfo) int {
+	rv := 0
+	for _, f := range frames {
+		rv += 1 + len(f.Data)
+		if f.ObjId >= 15 {
+			rv++
+		}
+		if len(f.Data) >= 15 {
+			rv++
+		}
+	}
+	return rv
+}
+
+// Frame finds the first framing extra with the given ID.
+func (req *MCRequest) Frame(id FrameObjId) (FrameInfo, bool) {
+	return findFrame(req.FramingExtras, id)
+}
+
+// Frame finds the first framing extra with the given ID.
+func (res *MCResponse) Frame(id FrameObjId) (FrameInfo, bool) {
+	return findFrame(res.FramingExtras, id)
+}
+
+func findFrame(frames []FrameInfo, id FrameObjId) (FrameInfo, bool) {
+	for _, f := range frames {
+		if f.ObjId == id {
+			return f, true
+		}
+	}
+	return FrameInfo{}, false
+}
+
+// ServerDuration is how long the server spent on the request, from
+// receiving it to sending this response, if the server said.
+func (res *MCResponse) ServerDuration() (time.Duration, bool) {
+	f, ok := res.Frame(FRAME_SERVER_DURATION)
+	if !ok || len(f.Data) != 2 {
+		return 0, false
+	}
+	// The duration is compressed as (2 * micros) ^ (1 / 1.74)
+	enc := float64(binary.BigEndian.Uint16(f.Data))
+	micros := math.Pow(enc, 1.74) / 2
+	return time.Duration(micros * float64(time.Microsecond)), true
+}
+
+// ServerDurationFrame builds the response framing extra reporting how
+// long the server took.
+func ServerDurationFrame(d time.Duration) FrameInfo {
+	micros := float64(d) / float64(time.Microsecond)
+	enc := math.Pow(micros*2, 1/1.74)
+	if enc > math.MaxUint16 {
+		enc = math.MaxUint16
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(enc+0.5))
+	return FrameInfo{FRAME_SERVER_DURATION, data}
+}
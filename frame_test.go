@@ -0,0 +1,183 @@
+package gomemcached
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrameInfoEncoding(t *testing.T) {
+	frames := []FrameInfo{
+		{FRAME_BARRIER, []byte{}},
+		DurabilityFrame(DURABILITY_MAJORITY, 0),
+		StreamIDFrame(0x1234),
+		{FrameObjId(20), bytes.Repeat([]byte{'x'}, 20)},
+	}
+	enc := EncodeFrameInfos(frames)
+	exp := []byte{
+		0x00,
+		0x11, 0x01,
+		0x22, 0x12, 0x34,
+		0xff, 5, 5,
+	}
+	exp = append(exp, bytes.Repeat([]byte{'x'}, 20)...)
+	if !bytes.Equal(enc, exp) {
+		t.Errorf("Expected\n%v, got\n%v", exp, enc)
+	}
+	if frameLen(frames) != len(enc) {
+		t.Errorf("Expected length %v, got %v", len(enc), frameLen(frames))
+	}
+
+	got, err := DecodeFrameInfos(enc)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if !reflect.DeepEqual(got, frames) {
+		t.Errorf("Expected %v, got %v", frames, got)
+	}
+
+	for _, bad := range [][]byte{{0x12, 0}, {0xf0}, {0x0f}} {
+		if _, err := DecodeFrameInfos(bad); err != ErrBadFraming {
+			t.Errorf("Expected an error decoding %v, got %v", bad, err)
+		}
+	}
+}
+
+func TestDurabilityFrame(t *testing.T) {
+	f := DurabilityFrame(DURABILITY_PERSIST_TO_MAJORITY, 1500*time.Millisecond)
+	if f.ObjId != FRAME_DURABILITY || !bytes.Equal(f.Data, []byte{3, 0x05, 0xdc}) {
+		t.Errorf("Expected level 3 with a 1500ms timeout, got %v", f.Data)
+	}
+}
+
+func TestRequestFraming(t *testing.T) {
+	req := MCRequest{
+		Opcode:        SET,
+		Opaque:        7,
+		VBucket:       3,
+		FramingExtras: []FrameInfo{DurabilityFrame(DURABILITY_MAJORITY, 0)},
+		Extras:        []byte{0, 0, 0, 0, 0, 0, 0, 0},
+		Key:           []byte("k"),
+		Body:          []byte("value"),
+	}
+	data := req.Bytes()
+	if len(data) != req.Size() {
+		t.Fatalf("Expected %v bytes, got %v", req.Size(), len(data))
+	}
+	hdr := data[:6]
+	if !bytes.Equal(hdr, []byte{ALT_REQ_MAGIC, byte(SET), 2, 1, 8, 0}) {
+		t.Errorf("Unexpected alt header: %v", hdr)
+	}
+	if !bytes.Equal(req.HeaderBytes(), data[:len(data)-len(req.Body)]) {
+		t.Errorf("Expected the header bytes to include the framing extras")
+	}
+
+	req2 := MCRequest{}
+	n, err := req2.Receive(bytes.NewReader(data), nil)
+	if err != nil || n != len(data) {
+		t.Fatalf("Error receiving: %v (%v bytes)", err, n)
+	}
+	if !reflect.DeepEqual(req, req2) {
+		t.Errorf("Expected %#v, got %#v", req, req2)
+	}
+}
+
+func TestResponseFraming(t *testing.T) {
+	res := MCResponse{
+		Opcode:        SET,
+		Status:        SUCCESS,
+		Cas:           99,
+		FramingExtras: []FrameInfo{ServerDurationFrame(1500 * time.Microsecond)},
+		Body:          []byte("ok"),
+	}
+	data := res.Bytes()
+	if data[0] != ALT_RES_MAGIC || data[2] != 3 || data[3] != 0 {
+		t.Errorf("Unexpected alt header: %v", data[:HDR_LEN])
+	}
+
+	res2 := MCResponse{}
+	if _, err := res2.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if res2.Cas != 99 || string(res2.Body) != "ok" {
+		t.Errorf("Expected %v, got %v", res, res2)
+	}
+	d, ok := res2.ServerDuration()
+	if !ok || d < 1400*time.Microsecond || d > 1600*time.Microsecond {
+		t.Errorf("Expected about 1.5ms, got %v/%v", d, ok)
+	}
+
+	if _, ok := (&MCResponse{}).ServerDuration(); ok {
+		t.Errorf("Expected no duration without framing extras")
+	}
+}
+
+func TestFramingHeaderOverflow(t *testing.T) {
+	frame := []FrameInfo{DurabilityFrame(DURABILITY_MAJORITY, 0)}
+	many := []FrameInfo{}
+	for i := 0; i < 20; i++ {
+		many = append(many, FrameInfo{FRAME_OPEN_TRACING, make([]byte, 14)})
+	}
+	tests := []struct {
+		frames      []FrameInfo
+		extras, key int
+		err         error
+	}{
+		{frame, 8, 255, nil},
+		{frame, 8, 256, ErrHeaderOverflow},
+		{many, 0, 1, ErrHeaderOverflow},
+		{nil, 256, 1, ErrHeaderOverflow},
+		// Without frames the key length has two bytes.
+		{nil, 8, 256, nil},
+		{nil, 8, 65536, ErrHeaderOverflow},
+	}
+	for _, test := range tests {
+		req := &MCRequest{Opcode: SET, FramingExtras: test.frames,
+			Extras: make([]byte, test.extras), Key: make([]byte, test.key)}
+		res := &MCResponse{Opcode: SET, FramingExtras: test.frames,
+			Extras: make([]byte, test.extras), Key: make([]byte, test.key)}
+		for _, m := range []interface {
+			Transmit(io.Writer) (int, error)
+		}{req, res} {
+			buf := &bytes.Buffer{}
+			n, err := m.Transmit(buf)
+			if err != test.err {
+				t.Errorf("Expected %v sending %T with %v frames, %v extras and a %v byte key, got %v",
+					test.err, m, len(test.frames), test.extras, test.key, err)
+			}
+			if err != nil && (n != 0 || buf.Len() != 0) {
+				t.Errorf("Expected nothing sent, sent %v", n)
+			}
+		}
+	}
+
+	// Long keys without frames still use the normal magic and
+	// come back intact.
+	req := &MCRequest{Opcode: GET, Key: bytes.Repeat([]byte("k"), 300)}
+	buf := &bytes.Buffer{}
+	if _, err := req.Transmit(buf); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if buf.Bytes()[0] != REQ_MAGIC {
+		t.Errorf("Expected the normal magic, got %x", buf.Bytes()[0])
+	}
+	req2 := MCRequest{}
+	if _, err := req2.Receive(buf, nil); err != nil || !bytes.Equal(req2.Key, req.Key) {
+		t.Errorf("Expected the long key back, got %v", err)
+	}
+
+	res := &MCResponse{Opcode: GET, Key: bytes.Repeat([]byte("k"), 300)}
+	buf.Reset()
+	if _, err := res.Transmit(buf); err != nil {
+		t.Fatalf("Error sending: %v", err)
+	}
+	if buf.Bytes()[0] != RES_MAGIC {
+		t.Errorf("Expected the normal magic, got %x", buf.Bytes()[0])
+	}
+	res2 := MCResponse{}
+	if _, err := res2.Receive(buf, nil); err != nil || !bytes.Equal(res2.Key, res.Key) {
+		t.Errorf("Expected the long key back, got %v", err)
+	}
+}
@@ -15,16 +15,24 @@ var port *int = flag.Int("port", 11212, "Port on which to listen")
 
 type chanReq struct {
 	req *gomemcached.MCRequest
+	w   io.Writer
 	res chan *gomemcached.MCResponse
 }
 
+type chanMetaReq struct {
+	cmd *gomemcached.MetaCommand
+	res chan *gomemcached.MetaResponse
+}
+
 type reqHandler struct {
-	ch chan chanReq
+	ch     chan chanReq
+	metaCh chan chanMetaReq
 }
 
 func (rh *reqHandler) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
 	cr := chanReq{
 		req,
+		w,
 		make(chan *gomemcached.MCResponse),
 	}
 
@@ -32,17 +40,28 @@ func (rh *reqHandler) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *go
 	return <-cr.res
 }
 
+func (rh *reqHandler) HandleMeta(m *gomemcached.MetaCommand) *gomemcached.MetaResponse {
+	cr := chanMetaReq{
+		m,
+		make(chan *gomemcached.MetaResponse),
+	}
+
+	rh.metaCh <- cr
+	return <-cr.res
+}
+
 func connectionHandler(s net.Conn, h memcached.RequestHandler) {
 	// Explicitly ignoring errors since they all result in the
 	// client getting hung up on and many are common.
-	_ = memcached.HandleIO(s, h)
+	_ = memcached.HandleAnyIO(s, h)
 }
 
 func waitForConnections(ls net.Listener) {
 	reqChannel := make(chan chanReq)
+	metaChannel := make(chan chanMetaReq)
 
-	go RunServer(reqChannel)
-	handler := &reqHandler{reqChannel}
+	go RunServer(reqChannel, metaChannel)
+	handler := &reqHandler{reqChannel, metaChannel}
 
 	log.Printf("Listening on port %d", *port)
 	for {
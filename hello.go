@@ -0,0 +1,78 @@
+package gomemcached
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// A Feature is an optional protocol feature negotiated with HELLO.
+type Feature uint16
+
+// HELLO features
+const (
+	FEATURE_DATATYPE                       = Feature(0x01)
+	FEATURE_TLS                            = Feature(0x02)
+	FEATURE_TCPNODELAY                     = Feature(0x03)
+	FEATURE_MUTATION_SEQNO                 = Feature(0x04)
+	FEATURE_TCPDELAY                       = Feature(0x05)
+	FEATURE_XATTR                          = Feature(0x06)
+	FEATURE_XERROR                         = Feature(0x07)
+	FEATURE_SELECT_BUCKET                  = Feature(0x08)
+	FEATURE_SNAPPY                         = Feature(0x0a)
+	FEATURE_JSON                           = Feature(0x0b)
+	FEATURE_DUPLEX                         = Feature(0x0c)
+	FEATURE_CLUSTERMAP_CHANGE_NOTIFICATION = Feature(0x0d)
+	FEATURE_UNORDERED_EXECUTION            = Feature(0x0e)
+	FEATURE_TRACING                        = Feature(0x0f)
+	FEATURE_ALT_REQUEST_SUPPORT            = Feature(0x10)
+	FEATURE_SYNC_REPLICATION               = Feature(0x11)
+	FEATURE_COLLECTIONS                    = Feature(0x12)
+)
+
+var FeatureNames = map[Feature]string{
+	FEATURE_DATATYPE:                       "DATATYPE",
+	FEATURE_TLS:                            "TLS",
+	FEATURE_TCPNODELAY:                     "TCPNODELAY",
+	FEATURE_MUTATION_SEQNO:                 "MUTATION_SEQNO",
+	FEATURE_TCPDELAY:                       "TCPDELAY",
+	FEATURE_XATTR:                          "XATTR",
+	FEATURE_XERROR:                         "XERROR",
+	FEATURE_SELECT_BUCKET:                  "SELECT_BUCKET",
+	FEATURE_SNAPPY:                         "SNAPPY",
+	FEATURE_JSON:                           "JSON",
+	FEATURE_DUPLEX:                         "DUPLEX",
+	FEATURE_CLUSTERMAP_CHANGE_NOTIFICATION: "CLUSTERMAP_CHANGE_NOTIFICATION",
+	FEATURE_UNORDERED_EXECUTION:            "UNORDERED_EXECUTION",
+	FEATURE_TRACING:                        "TRACING",
+	FEATURE_ALT_REQUEST_SUPPORT:            "ALT_REQUEST_SUPPORT",
+	FEATURE_SYNC_REPLICATION:               "SYNC_REPLICATION",
+	FEATURE_COLLECTIONS:                    "COLLECTIONS",
+}
+
+func (f Feature) String() string {
+	if name, ok := FeatureNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(f))
+}
+
+// EncodeFeatures builds the body of a HELLO request or response.
+func EncodeFeatures(features []Feature) []byte {
+	rv := make([]byte, 2*len(features))
+	for i, f := range features {
+		binary.BigEndian.PutUint16(rv[2*i:], uint16(f))
+	}
+	return rv
+}
+
+// DecodeFeatures parses the body of a HELLO request or response.
+func DecodeFeatures(body []byte) ([]Feature, error) {
+	if len(body)%2 != 0 {
+		return nil, fmt.Errorf("invalid HELLO body length: %v", len(body))
+	}
+	rv := make([]Feature, 0, len(body)/2)
+	for i := 0; i < len(body); i += 2 {
+		rv = append(rv, Feature(binary.BigEndian.Uint16(body[i:])))
+	}
+	return rv, nil
+}
@@ -0,0 +1,37 @@
+package gomemcached
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFeatureString(t *testing.T) {
+	tests := map[Feature]string{
+		FEATURE_SNAPPY:      "SNAPPY",
+		FEATURE_COLLECTIONS: "COLLECTIONS",
+		Feature(0x99):       "0x0099",
+	}
+	for f, exp := range tests {
+		if f.String() != exp {
+			t.Errorf("Expected %v for %d, got %v", exp, f, f.String())
+		}
+	}
+}
+
+func TestFeatureEncoding(t *testing.T) {
+	features := []Feature{FEATURE_TCPNODELAY, FEATURE_JSON, FEATURE_COLLECTIONS}
+	body := EncodeFeatures(features)
+	exp := []byte{0, 0x03, 0, 0x0b, 0, 0x12}
+	if !reflect.DeepEqual(body, exp) {
+		t.Errorf("Expected %v, got %v", exp, body)
+	}
+
+	got, err := DecodeFeatures(body)
+	if err != nil || !reflect.DeepEqual(got, features) {
+		t.Errorf("Expected %v, got %v/%v", features, got, err)
+	}
+
+	if _, err := DecodeFeatures([]byte{0, 1, 2}); err == nil {
+		t.Errorf("Expected an error decoding an odd length body")
+	}
+}
@@ -40,6 +40,7 @@ const (
 	FLUSHQ     = CommandCode(0x18)
 	APPENDQ    = CommandCode(0x19)
 	PREPENDQ   = CommandCode(0x1a)
+	HELLO      = CommandCode(0x1f) // Negotiate optional features
 	RGET       = CommandCode(0x30)
 	RSET       = CommandCode(0x31)
 	RSETQ      = CommandCode(0x32)
@@ -67,7 +68,42 @@ const (
 	TAP_CHECKPOINT_START = CommandCode(0x46) // Notifies start of new checkpoint
 	TAP_CHECKPOINT_END   = CommandCode(0x47) // Notifies end of checkpoint
 
-	OBSERVE = CommandCode(0x92)
+	DCP_OPEN              = CommandCode(0x50) // Open a DCP connection
+	DCP_ADD_STREAM        = CommandCode(0x51) // Ask a consumer to stream a vbucket
+	DCP_CLOSE_STREAM      = CommandCode(0x52) // Close a vbucket stream
+	DCP_STREAM_REQ        = CommandCode(0x53) // Request a vbucket stream by seqno range
+	DCP_FAILOVER_LOG      = CommandCode(0x54) // Get a vbucket's failover log
+	DCP_STREAM_END        = CommandCode(0x55) // Notifies a stream has ended
+	DCP_SNAPSHOT_MARKER   = CommandCode(0x56) // Notifies the start of a snapshot
+	DCP_MUTATION          = CommandCode(0x57) // Notification of a mutation
+	DCP_DELETION          = CommandCode(0x58) // Notification of a deletion
+	DCP_EXPIRATION        = CommandCode(0x59) // Notification of an expiration
+	DCP_FLUSH             = CommandCode(0x5a) // Notification of a flush
+	DCP_SET_VBUCKET_STATE = CommandCode(0x5b) // Sets state of vbucket in receiver
+	DCP_NOOP              = CommandCode(0x5c) // Keeps an idle connection alive
+	DCP_BUFFER_ACK        = CommandCode(0x5d) // Acknowledges consumed bytes for flow control
+	DCP_CONTROL           = CommandCode(0x5e) // Sets a connection parameter
+
+	GET_REPLICA = CommandCode(0x83) // Read a key from a replica vbucket
+	OBSERVE     = CommandCode(0x92)
+
+	GET_COLLECTIONS_MANIFEST = CommandCode(0xba) // Get the bucket's collections manifest
+	GET_COLLECTION_ID        = CommandCode(0xbb) // Resolve scope.collection to an ID
+
+	SUBDOC_GET              = CommandCode(0xc5) // Get a path from a JSON document
+	SUBDOC_EXISTS           = CommandCode(0xc6) // Check a path exists
+	SUBDOC_DICT_ADD         = CommandCode(0xc7) // Add a dictionary entry
+	SUBDOC_DICT_UPSERT      = CommandCode(0xc8) // Add or replace a dictionary entry
+	SUBDOC_DELETE           = CommandCode(0xc9) // Delete a path
+	SUBDOC_REPLACE          = CommandCode(0xca) // Replace an existing path
+	SUBDOC_ARRAY_PUSH_LAST  = CommandCode(0xcb) // Append to an array
+	SUBDOC_ARRAY_PUSH_FIRST = CommandCode(0xcc) // Prepend to an array
+	SUBDOC_ARRAY_INSERT     = CommandCode(0xcd) // Insert at an array index
+	SUBDOC_ARRAY_ADD_UNIQUE = CommandCode(0xce) // Append to an array if not present
+	SUBDOC_COUNTER          = CommandCode(0xcf) // Add to a number
+	SUBDOC_MULTI_LOOKUP     = CommandCode(0xd0) // Several lookups in one document
+	SUBDOC_MULTI_MUTATION   = CommandCode(0xd1) // Several mutations of one document, atomically
+	SUBDOC_GET_COUNT        = CommandCode(0xd2) // Count the elements at a path
 )
 
 type Status uint16
@@ -81,9 +117,32 @@ const (
 	NOT_STORED      = Status(0x05)
 	DELTA_BADVAL    = Status(0x06)
 	NOT_MY_VBUCKET  = Status(0x07)
+	ROLLBACK        = Status(0x23)
 	UNKNOWN_COMMAND = Status(0x81)
 	ENOMEM          = Status(0x82)
+	EINTERNAL       = Status(0x84)
 	TMPFAIL         = Status(0x86)
+
+	UNKNOWN_COLLECTION = Status(0x88)
+	UNKNOWN_SCOPE      = Status(0x8c)
+
+	SUBDOC_PATH_ENOENT         = Status(0xc0)
+	SUBDOC_PATH_MISMATCH       = Status(0xc1)
+	SUBDOC_PATH_EINVAL         = Status(0xc2)
+	SUBDOC_PATH_E2BIG          = Status(0xc3)
+	SUBDOC_DOC_E2DEEP          = Status(0xc4)
+	SUBDOC_VALUE_CANTINSERT    = Status(0xc5)
+	SUBDOC_DOC_NOT_JSON        = Status(0xc6)
+	SUBDOC_NUM_ERANGE          = Status(0xc7)
+	SUBDOC_DELTA_EINVAL        = Status(0xc8)
+	SUBDOC_PATH_EEXISTS        = Status(0xc9)
+	SUBDOC_VALUE_ETOODEEP      = Status(0xca)
+	SUBDOC_INVALID_COMBO       = Status(0xcb)
+	SUBDOC_MULTI_PATH_FAILURE  = Status(0xcc)
+	SUBDOC_SUCCESS_DELETED     = Status(0xcd)
+	SUBDOC_XATTR_INVALID_FLAGS = Status(0xce)
+	SUBDOC_XATTR_INVALID_KEYS  = Status(0xcf)
+	SUBDOC_XATTR_UNKNOWN_MACRO = Status(0xd0)
 )
 
 // An internal representation of an item.
@@ -130,6 +189,7 @@ func init() {
 	CommandNames[FLUSHQ] = "FLUSHQ"
 	CommandNames[APPENDQ] = "APPENDQ"
 	CommandNames[PREPENDQ] = "PREPENDQ"
+	CommandNames[HELLO] = "HELLO"
 	CommandNames[RGET] = "RGET"
 	CommandNames[RSET] = "RSET"
 	CommandNames[RSETQ] = "RSETQ"
@@ -157,6 +217,40 @@ func init() {
 	CommandNames[TAP_CHECKPOINT_START] = "TAP_CHECKPOINT_START"
 	CommandNames[TAP_CHECKPOINT_END] = "TAP_CHECKPOINT_END"
 
+	CommandNames[DCP_OPEN] = "DCP_OPEN"
+	CommandNames[DCP_ADD_STREAM] = "DCP_ADD_STREAM"
+	CommandNames[DCP_CLOSE_STREAM] = "DCP_CLOSE_STREAM"
+	CommandNames[DCP_STREAM_REQ] = "DCP_STREAM_REQ"
+	CommandNames[DCP_FAILOVER_LOG] = "DCP_FAILOVER_LOG"
+	CommandNames[DCP_STREAM_END] = "DCP_STREAM_END"
+	CommandNames[DCP_SNAPSHOT_MARKER] = "DCP_SNAPSHOT_MARKER"
+	CommandNames[DCP_MUTATION] = "DCP_MUTATION"
+	CommandNames[DCP_DELETION] = "DCP_DELETION"
+	CommandNames[DCP_EXPIRATION] = "DCP_EXPIRATION"
+	CommandNames[DCP_FLUSH] = "DCP_FLUSH"
+	CommandNames[DCP_SET_VBUCKET_STATE] = "DCP_SET_VBUCKET_STATE"
+	CommandNames[DCP_NOOP] = "DCP_NOOP"
+	CommandNames[DCP_BUFFER_ACK] = "DCP_BUFFER_ACK"
+	CommandNames[DCP_CONTROL] = "DCP_CONTROL"
+
+	CommandNames[GET_REPLICA] = "GET_REPLICA"
+	CommandNames[GET_COLLECTIONS_MANIFEST] = "GET_COLLECTIONS_MANIFEST"
+	CommandNames[GET_COLLECTION_ID] = "GET_COLLECTION_ID"
+	CommandNames[SUBDOC_GET] = "SUBDOC_GET"
+	CommandNames[SUBDOC_EXISTS] = "SUBDOC_EXISTS"
+	CommandNames[SUBDOC_DICT_ADD] = "SUBDOC_DICT_ADD"
+	CommandNames[SUBDOC_DICT_UPSERT] = "SUBDOC_DICT_UPSERT"
+	CommandNames[SUBDOC_DELETE] = "SUBDOC_DELETE"
+	CommandNames[SUBDOC_REPLACE] = "SUBDOC_REPLACE"
+	CommandNames[SUBDOC_ARRAY_PUSH_LAST] = "SUBDOC_ARRAY_PUSH_LAST"
+	CommandNames[SUBDOC_ARRAY_PUSH_FIRST] = "SUBDOC_ARRAY_PUSH_FIRST"
+	CommandNames[SUBDOC_ARRAY_INSERT] = "SUBDOC_ARRAY_INSERT"
+	CommandNames[SUBDOC_ARRAY_ADD_UNIQUE] = "SUBDOC_ARRAY_ADD_UNIQUE"
+	CommandNames[SUBDOC_COUNTER] = "SUBDOC_COUNTER"
+	CommandNames[SUBDOC_MULTI_LOOKUP] = "SUBDOC_MULTI_LOOKUP"
+	CommandNames[SUBDOC_MULTI_MUTATION] = "SUBDOC_MULTI_MUTATION"
+	CommandNames[SUBDOC_GET_COUNT] = "SUBDOC_GET_COUNT"
+
 	StatusNames = make(map[Status]string)
 	StatusNames[SUCCESS] = "SUCCESS"
 	StatusNames[KEY_ENOENT] = "KEY_ENOENT"
@@ -166,9 +260,30 @@ func init() {
 	StatusNames[NOT_STORED] = "NOT_STORED"
 	StatusNames[DELTA_BADVAL] = "DELTA_BADVAL"
 	StatusNames[NOT_MY_VBUCKET] = "NOT_MY_VBUCKET"
+	StatusNames[ROLLBACK] = "ROLLBACK"
 	StatusNames[UNKNOWN_COMMAND] = "UNKNOWN_COMMAND"
 	StatusNames[ENOMEM] = "ENOMEM"
+	StatusNames[EINTERNAL] = "EINTERNAL"
 	StatusNames[TMPFAIL] = "TMPFAIL"
+	StatusNames[UNKNOWN_COLLECTION] = "UNKNOWN_COLLECTION"
+	StatusNames[UNKNOWN_SCOPE] = "UNKNOWN_SCOPE"
+	StatusNames[SUBDOC_PATH_ENOENT] = "SUBDOC_PATH_ENOENT"
+	StatusNames[SUBDOC_PATH_MISMATCH] = "SUBDOC_PATH_MISMATCH"
+	StatusNames[SUBDOC_PATH_EINVAL] = "SUBDOC_PATH_EINVAL"
+	StatusNames[SUBDOC_PATH_E2BIG] = "SUBDOC_PATH_E2BIG"
+	StatusNames[SUBDOC_DOC_E2DEEP] = "SUBDOC_DOC_E2DEEP"
+	StatusNames[SUBDOC_VALUE_CANTINSERT] = "SUBDOC_VALUE_CANTINSERT"
+	StatusNames[SUBDOC_DOC_NOT_JSON] = "SUBDOC_DOC_NOT_JSON"
+	StatusNames[SUBDOC_NUM_ERANGE] = "SUBDOC_NUM_ERANGE"
+	StatusNames[SUBDOC_DELTA_EINVAL] = "SUBDOC_DELTA_EINVAL"
+	StatusNames[SUBDOC_PATH_EEXISTS] = "SUBDOC_PATH_EEXISTS"
+	StatusNames[SUBDOC_VALUE_ETOODEEP] = "SUBDOC_VALUE_ETOODEEP"
+	StatusNames[SUBDOC_INVALID_COMBO] = "SUBDOC_INVALID_COMBO"
+	StatusNames[SUBDOC_MULTI_PATH_FAILURE] = "SUBDOC_MULTI_PATH_FAILURE"
+	StatusNames[SUBDOC_SUCCESS_DELETED] = "SUBDOC_SUCCESS_DELETED"
+	StatusNames[SUBDOC_XATTR_INVALID_FLAGS] = "SUBDOC_XATTR_INVALID_FLAGS"
+	StatusNames[SUBDOC_XATTR_INVALID_KEYS] = "SUBDOC_XATTR_INVALID_KEYS"
+	StatusNames[SUBDOC_XATTR_UNKNOWN_MACRO] = "SUBDOC_XATTR_UNKNOWN_MACRO"
 
 }
 
@@ -20,13 +20,23 @@ type MCRequest struct {
 	Opaque uint32
 	// The vbucket to which this command belongs
 	VBucket uint16
+	// The encoding of the body
+	DataType DataType
+	// Framing extras.  If there are any, the request is sent with
+	// ALT_REQ_MAGIC.
+	FramingExtras []FrameInfo
+	// The collection the key belongs to.  This isn't part of the
+	// encoded request; clients that negotiated collections prefix
+	// it to the key.
+	CollId uint32
 	// Command extras, key, and body
 	Extras, Key, Body []byte
 }
 
 // The number of bytes this request requires.
 func (req *MCRequest) Size() int {
-	return HDR_LEN + len(req.Extras) + len(req.Key) + len(req.Body)
+	return HDR_LEN + frameLen(req.FramingExtras) +
+		len(req.Extras) + len(req.Key) + len(req.Body)
 }
 
 // A debugging string representation of this request
@@ -36,27 +46,36 @@ func (req MCRequest) String() string {
 }
 
 func (req *MCRequest) fillHeaderBytes(data []byte) int {
+	framing := EncodeFrameInfos(req.FramingExtras)
 
 	pos := 0
 	data[pos] = REQ_MAGIC
+	if len(framing) > 0 {
+		data[pos] = ALT_REQ_MAGIC
+	}
 	pos++
 	data[pos] = byte(req.Opcode)
 	pos++
-	binary.BigEndian.PutUint16(data[pos:pos+2],
-		uint16(len(req.Key)))
+	if len(framing) > 0 {
+		data[pos] = byte(len(framing))
+		data[pos+1] = byte(len(req.Key))
+	} else {
+		binary.BigEndian.PutUint16(data[pos:pos+2],
+			uint16(len(req.Key)))
+	}
 	pos += 2
 
 	// 4
 	data[pos] = byte(len(req.Extras))
 	pos++
-	// data[pos] = 0
+	data[pos] = byte(req.DataType)
 	pos++
 	binary.BigEndian.PutUint16(data[pos:pos+2], req.VBucket)
 	pos += 2
 
 	// 8
 	binary.BigEndian.PutUint32(data[pos:pos+4],
-		uint32(len(req.Body)+len(req.Key)+len(req.Extras)))
+		uint32(len(framing)+len(req.Body)+len(req.Key)+len(req.Extras)))
 	pos += 4
 
 	// 12
@@ -69,6 +88,8 @@ func (req *MCRequest) fillHeaderBytes(data []byte) int {
 	}
 	pos += 8
 
+	pos += copy(data[pos:], framing)
+
 	if len(req.Extras) > 0 {
 		copy(data[pos:pos+len(req.Extras)], req.Extras)
 		pos += len(req.Extras)
@@ -83,7 +104,8 @@ func (req *MCRequest) fillHeaderBytes(data []byte) int {
 
 // The wire representation of the header (with the extras and key)
 func (req *MCRequest) HeaderBytes() []byte {
-	data := make([]byte, HDR_LEN+len(req.Extras)+len(req.Key))
+	data := make([]byte, HDR_LEN+frameLen(req.FramingExtras)+
+		len(req.Extras)+len(req.Key))
 
 	req.fillHeaderBytes(data)
 
@@ -104,7 +126,14 @@ func (req *MCRequest) Bytes() []byte {
 }
 
 // Send this request message across a writer.
+//
+// Nothing is sent if a field is too long for the header
+// (ErrHeaderOverflow).  Bytes and HeaderBytes don't check.
 func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
+	err = checkHeaderLengths(frameLen(req.FramingExtras), len(req.Extras), len(req.Key))
+	if err != nil {
+		return 0, err
+	}
 	if len(req.Body) < 128 {
 		n, err = w.Write(req.Bytes())
 	} else {
@@ -118,6 +147,18 @@ func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
 	return
 }
 
+// keyLengths gets the framing extras and key lengths from a header,
+// which depend on its magic.
+func keyLengths(hdrBytes []byte) (flen, klen int, err error) {
+	switch hdrBytes[0] {
+	case REQ_MAGIC, RES_MAGIC:
+		return 0, int(binary.BigEndian.Uint16(hdrBytes[2:])), nil
+	case ALT_REQ_MAGIC, ALT_RES_MAGIC:
+		return int(hdrBytes[2]), int(hdrBytes[3]), nil
+	}
+	return 0, 0, fmt.Errorf("Bad magic: 0x%02x", hdrBytes[0])
+}
+
 // Fill this MCRequest with the data from this reader.
 func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	if len(hdrBytes) < HDR_LEN {
@@ -131,18 +172,18 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		return n, err
 	}
 
-	if hdrBytes[0] != RES_MAGIC && hdrBytes[0] != REQ_MAGIC {
-		return n, fmt.Errorf("Bad magic: 0x%02x", hdrBytes[0])
+	flen, klen, err := keyLengths(hdrBytes)
+	if err != nil {
+		return n, err
 	}
-
-	klen := int(binary.BigEndian.Uint16(hdrBytes[2:]))
 	elen := int(hdrBytes[4])
 
 	req.Opcode = CommandCode(hdrBytes[1])
+	req.DataType = DataType(hdrBytes[5])
 	// Vbucket at 6:7
 	req.VBucket = binary.BigEndian.Uint16(hdrBytes[6:])
 	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:]) -
-		uint32(klen) - uint32(elen))
+		uint32(flen) - uint32(klen) - uint32(elen))
 	if bodyLen > MaxBodyLen {
 		return n, fmt.Errorf("%d is too big (max %d)",
 			bodyLen, MaxBodyLen)
@@ -150,17 +191,25 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	req.Opaque = binary.BigEndian.Uint32(hdrBytes[12:])
 	req.Cas = binary.BigEndian.Uint64(hdrBytes[16:])
 
-	buf := make([]byte, klen+elen+bodyLen)
+	buf := make([]byte, flen+klen+elen+bodyLen)
 	m, err := io.ReadFull(r, buf)
 	n += m
+	if err == nil && flen > 0 {
+		req.FramingExtras, err = DecodeFrameInfos(buf[:flen])
+		buf = buf[flen:]
+	}
 	if err == nil {
 		if req.Opcode >= TAP_MUTATION &&
 			req.Opcode <= TAP_CHECKPOINT_END &&
-			len(buf) > 1 {
+			elen > 1 {
 			// In these commands there is "engine private"
 			// data at the end of the extras.  The first 2
 			// bytes of extra data give its length.
 			elen += int(binary.BigEndian.Uint16(buf))
+			if elen+klen > len(buf) {
+				return n, fmt.Errorf("engine private data too long for %v",
+					req.Opcode)
+			}
 		}
 		if elen > 0 {
 			req.Extras = buf[0:elen]
@@ -168,7 +217,7 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		if klen > 0 {
 			req.Key = buf[elen : klen+elen]
 		}
-		if klen+elen > 0 {
+		if klen+elen > 0 || bodyLen > 0 {
 			req.Body = buf[klen+elen:]
 		}
 	}
@@ -220,6 +220,28 @@ func TestReceiveRequest(t *testing.T) {
 	}
 }
 
+func TestReceiveRequestDataType(t *testing.T) {
+	req := MCRequest{
+		Opcode:   SET,
+		Key:      []byte("k"),
+		DataType: DATATYPE_JSON | DATATYPE_SNAPPY,
+		Body:     []byte("{}"),
+	}
+
+	data := req.Bytes()
+	if data[5] != 0x03 {
+		t.Errorf("Expected datatype 3 in the header, got %v", data[5])
+	}
+
+	req2 := MCRequest{}
+	if _, err := req2.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if req2.DataType != req.DataType {
+		t.Errorf("Expected datatype %v, got %v", req.DataType, req2.DataType)
+	}
+}
+
 func TestReceiveRequestNoContent(t *testing.T) {
 	req := MCRequest{
 		Opcode:  SET,
@@ -405,3 +427,22 @@ func TestReceivingTapRequest(t *testing.T) {
 		t.Errorf("Expected string=%q, got %q", exp, req.String())
 	}
 }
+
+func TestReceivingTapEnginePrivate(t *testing.T) {
+	// Without extras there's no engine private length to read.
+	req := MCRequest{Opcode: TAP_FLUSH, Key: []byte("\x00\x09k")}
+	data := req.Bytes()
+	got := MCRequest{}
+	if _, err := got.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if string(got.Key) != string(req.Key) || len(got.Extras) != 0 {
+		t.Errorf("Expected key %q and no extras, got %q/%v",
+			req.Key, got.Key, got.Extras)
+	}
+
+	req = MCRequest{Opcode: TAP_MUTATION, Extras: []byte{0, 99}, Key: []byte("k")}
+	if _, err := got.Receive(bytes.NewReader(req.Bytes()), nil); err == nil {
+		t.Errorf("Expected an error for overlong engine private data")
+	}
+}
@@ -16,6 +16,11 @@ type MCResponse struct {
 	Opaque uint32
 	// The CAS identifier (if applicable)
 	Cas uint64
+	// The encoding of the body
+	DataType DataType
+	// Framing extras.  If there are any, the response is sent with
+	// ALT_RES_MAGIC.
+	FramingExtras []FrameInfo
 	// Extras, key, and body for this response
 	Extras, Key, Body []byte
 	// If true, this represents a fatal condition and we should hang up
@@ -52,8 +57,13 @@ func IsFatal(e error) bool {
 	if e == nil {
 		return false
 	}
-	switch errStatus(e) {
-	case KEY_ENOENT, KEY_EEXISTS, NOT_STORED, TMPFAIL:
+	switch st := errStatus(e); {
+	case st == KEY_ENOENT, st == KEY_EEXISTS, st == NOT_STORED,
+		st == TMPFAIL, st == UNKNOWN_COLLECTION, st == UNKNOWN_SCOPE,
+		st == ROLLBACK:
+		return false
+	case st >= SUBDOC_PATH_ENOENT && st <= SUBDOC_XATTR_UNKNOWN_MACRO:
+		// Problems with the document, not the connection.
 		return false
 	}
 	return true
@@ -61,30 +71,41 @@ func IsFatal(e error) bool {
 
 // Number of bytes this response consumes on the wire.
 func (res *MCResponse) Size() int {
-	return HDR_LEN + len(res.Extras) + len(res.Key) + len(res.Body)
+	return HDR_LEN + frameLen(res.FramingExtras) +
+		len(res.Extras) + len(res.Key) + len(res.Body)
 }
 
 func (res *MCResponse) fillHeaderBytes(data []byte) int {
+	framing := EncodeFrameInfos(res.FramingExtras)
+
 	pos := 0
 	data[pos] = RES_MAGIC
+	if len(framing) > 0 {
+		data[pos] = ALT_RES_MAGIC
+	}
 	pos++
 	data[pos] = byte(res.Opcode)
 	pos++
-	binary.BigEndian.PutUint16(data[pos:pos+2],
-		uint16(len(res.Key)))
+	if len(framing) > 0 {
+		data[pos] = byte(len(framing))
+		data[pos+1] = byte(len(res.Key))
+	} else {
+		binary.BigEndian.PutUint16(data[pos:pos+2],
+			uint16(len(res.Key)))
+	}
 	pos += 2
 
 	// 4
 	data[pos] = byte(len(res.Extras))
 	pos++
-	data[pos] = 0
+	data[pos] = byte(res.DataType)
 	pos++
 	binary.BigEndian.PutUint16(data[pos:pos+2], uint16(res.Status))
 	pos += 2
 
 	// 8
 	binary.BigEndian.PutUint32(data[pos:pos+4],
-		uint32(len(res.Body)+len(res.Key)+len(res.Extras)))
+		uint32(len(framing)+len(res.Body)+len(res.Key)+len(res.Extras)))
 	pos += 4
 
 	// 12
@@ -95,6 +116,8 @@ func (res *MCResponse) fillHeaderBytes(data []byte) int {
 	binary.BigEndian.PutUint64(data[pos:pos+8], res.Cas)
 	pos += 8
 
+	pos += copy(data[pos:], framing)
+
 	if len(res.Extras) > 0 {
 		copy(data[pos:pos+len(res.Extras)], res.Extras)
 		pos += len(res.Extras)
@@ -110,7 +133,8 @@ func (res *MCResponse) fillHeaderBytes(data []byte) int {
 
 // Get just the header bytes for this response.
 func (res *MCResponse) HeaderBytes() []byte {
-	data := make([]byte, HDR_LEN+len(res.Extras)+len(res.Key))
+	data := make([]byte, HDR_LEN+frameLen(res.FramingExtras)+
+		len(res.Extras)+len(res.Key))
 
 	res.fillHeaderBytes(data)
 
@@ -129,7 +153,14 @@ func (res *MCResponse) Bytes() []byte {
 }
 
 // Send this response message across a writer.
+//
+// Nothing is sent if a field is too long for the header
+// (ErrHeaderOverflow).  Bytes and HeaderBytes don't check.
 func (res *MCResponse) Transmit(w io.Writer) (n int, err error) {
+	err = checkHeaderLengths(frameLen(res.FramingExtras), len(res.Extras), len(res.Key))
+	if err != nil {
+		return 0, err
+	}
 	if len(res.Body) < 128 {
 		n, err = w.Write(res.Bytes())
 	} else {
@@ -156,22 +187,26 @@ func (req *MCResponse) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		return n, err
 	}
 
-	if hdrBytes[0] != RES_MAGIC && hdrBytes[0] != REQ_MAGIC {
-		return n, fmt.Errorf("Bad magic: 0x%02x", hdrBytes[0])
+	flen, klen, err := keyLengths(hdrBytes)
+	if err != nil {
+		return n, err
 	}
-
-	klen := int(binary.BigEndian.Uint16(hdrBytes[2:4]))
 	elen := int(hdrBytes[4])
 
 	req.Opcode = CommandCode(hdrBytes[1])
+	req.DataType = DataType(hdrBytes[5])
 	req.Status = Status(binary.BigEndian.Uint16(hdrBytes[6:8]))
 	req.Opaque = binary.BigEndian.Uint32(hdrBytes[12:16])
 	req.Cas = binary.BigEndian.Uint64(hdrBytes[16:24])
 
-	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:12])) - (klen + elen)
+	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:12])) - (flen + klen + elen)
 
-	buf := make([]byte, klen+elen+bodyLen)
+	buf := make([]byte, flen+klen+elen+bodyLen)
 	m, err := io.ReadFull(r, buf)
+	if err == nil && flen > 0 {
+		req.FramingExtras, err = DecodeFrameInfos(buf[:flen])
+		buf = buf[flen:]
+	}
 	if err == nil {
 		if elen > 0 {
 			req.Extras = buf[0:elen]
@@ -179,7 +214,7 @@ func (req *MCResponse) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		if klen > 0 {
 			req.Key = buf[elen : klen+elen]
 		}
-		if klen+elen > 0 {
+		if klen+elen > 0 || bodyLen > 0 {
 			req.Body = buf[klen+elen:]
 		}
 	}
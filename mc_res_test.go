@@ -197,6 +197,10 @@ func TestIsFatal(t *testing.T) {
 		{&MCResponse{Status: KEY_ENOENT}, false},
 		{&MCResponse{Status: EINVAL}, true},
 		{&MCResponse{Status: TMPFAIL}, false},
+		{&MCResponse{Status: UNKNOWN_COLLECTION}, false},
+		{&MCResponse{Status: ROLLBACK}, false},
+		{&MCResponse{Status: SUBDOC_PATH_ENOENT}, false},
+		{&MCResponse{Status: SUBDOC_MULTI_PATH_FAILURE}, false},
 	}
 
 	for i, x := range tests {
@@ -350,6 +354,44 @@ func TestReceiveResponseNoContent(t *testing.T) {
 	}
 }
 
+func TestReceiveResponseDataType(t *testing.T) {
+	res := MCResponse{
+		Opcode:   GET,
+		Extras:   []byte{0, 0, 0, 0},
+		DataType: DATATYPE_JSON,
+		Body:     []byte("{}"),
+	}
+
+	data := res.Bytes()
+	if data[5] != 0x01 {
+		t.Errorf("Expected datatype 1 in the header, got %v", data[5])
+	}
+
+	res2 := MCResponse{}
+	if _, err := res2.Receive(bytes.NewReader(data), nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if res2.DataType != DATATYPE_JSON {
+		t.Errorf("Expected JSON, got %v", res2.DataType)
+	}
+}
+
+func TestReceiveResponseBodyOnly(t *testing.T) {
+	res := MCResponse{
+		Opcode: VERSION,
+		Body:   []byte("1.4.0"),
+	}
+
+	res2 := MCResponse{}
+	_, err := res2.Receive(bytes.NewReader(res.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if string(res2.Body) != "1.4.0" {
+		t.Fatalf("Expected body 1.4.0, got %q", res2.Body)
+	}
+}
+
 func BenchmarkReceiveResponse(b *testing.B) {
 	req := MCResponse{
 		Opcode: SET,
@@ -0,0 +1,546 @@
+package gomemcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Meta protocol docs: <https://github.com/memcached/memcached/wiki/MetaCommands>
+
+// A single meta command flag and its (possibly empty) token.
+type MetaFlag struct {
+	Flag  byte
+	Token string
+}
+
+func (f MetaFlag) String() string {
+	return string(f.Flag) + f.Token
+}
+
+// MetaFlags are the flags of a meta command or response, in order.
+type MetaFlags []MetaFlag
+
+// Has is true if the flag is present.
+func (fs MetaFlags) Has(flag byte) bool {
+	_, ok := fs.Token(flag)
+	return ok
+}
+
+// Token gets the token of the first instance of a flag.
+func (fs MetaFlags) Token(flag byte) (string, bool) {
+	for _, f := range fs {
+		if f.Flag == flag {
+			return f.Token, true
+		}
+	}
+	return "", false
+}
+
+func parseMetaFlags(fields []string) (MetaFlags, error) {
+	rv := make(MetaFlags, 0, len(fields))
+	for _, f := range fields {
+		c := f[0]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return nil, TextClientError("invalid flag")
+		}
+		rv = append(rv, MetaFlag{c, f[1:]})
+	}
+	return rv, nil
+}
+
+func (fs MetaFlags) writeTo(buf *bytes.Buffer) {
+	for _, f := range fs {
+		buf.WriteByte(' ')
+		buf.WriteString(f.String())
+	}
+}
+
+// A meta protocol command: mg, ms, md, ma or mn.
+type MetaCommand struct {
+	// The command as sent ("mg", "ms", ...)
+	Name string
+	// The key, base64 encoded if the b flag is set.
+	Key   string
+	Flags MetaFlags
+	// The value being stored by ms.
+	Data []byte
+}
+
+// IsMetaCommand is true if the next command waiting to be read is a
+// meta command.
+func IsMetaCommand(r *bufio.Reader) bool {
+	b, err := r.Peek(3)
+	if err != nil || b[0] != 'm' {
+		return false
+	}
+	switch b[1] {
+	case 'g', 's', 'd', 'a', 'n':
+		return b[2] == ' ' || b[2] == '\r' || b[2] == '\n'
+	}
+	return false
+}
+
+// ReadMetaCommand reads the next meta command (including any data
+// block).  Errors are the same as for ReadTextCommand.
+func ReadMetaCommand(r *bufio.Reader) (*MetaCommand, error) {
+	line, _, err := readTextLine(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, ErrUnknownCommand
+	}
+
+	m := &MetaCommand{Name: fields[0]}
+	args := fields[1:]
+	switch m.Name {
+	case "mn":
+		return m, nil
+	case "mg", "ms", "md", "ma":
+	default:
+		return nil, ErrUnknownCommand
+	}
+
+	if len(args) == 0 {
+		return nil, TextClientError("bad command line format")
+	}
+	m.Key, args = args[0], args[1:]
+	if len(m.Key) > MaxTextKeyLen {
+		return nil, TextClientError("key too long")
+	}
+
+	size := uint64(0)
+	if m.Name == "ms" {
+		if len(args) == 0 {
+			return nil, TextClientError("bad command line format")
+		}
+		if size, err = parseTextUint(args[0], 31); err != nil {
+			return nil, TextClientError("bad data chunk")
+		}
+		args = args[1:]
+	}
+
+	if m.Flags, err = parseMetaFlags(args); err != nil {
+		return nil, err
+	}
+	if _, err := m.key(); err != nil {
+		return nil, err
+	}
+
+	if m.Name == "ms" {
+		if int(size) > MaxBodyLen {
+			io.CopyN(ioutil.Discard, r, int64(size)+2)
+			return nil, TextClientError("object too large for cache")
+		}
+		m.Data = make([]byte, size+2)
+		if _, err := io.ReadFull(r, m.Data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(m.Data, []byte("\r\n")) {
+			return nil, TextClientError("bad data chunk")
+		}
+		m.Data = m.Data[:size]
+	}
+	return m, nil
+}
+
+// key is the decoded key.
+func (m *MetaCommand) key() ([]byte, error) {
+	if !m.Flags.Has('b') {
+		if !validTextKey(m.Key) {
+			return nil, TextClientError("bad command line format")
+		}
+		return []byte(m.Key), nil
+	}
+	k, err := base64.StdEncoding.DecodeString(m.Key)
+	if err != nil || len(k) == 0 {
+		return nil, TextClientError("error decoding key")
+	}
+	return k, nil
+}
+
+// Bytes is the wire representation of this command.
+func (m *MetaCommand) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(m.Name)
+	if m.Name != "mn" {
+		buf.WriteString(" " + m.Key)
+	}
+	if m.Name == "ms" {
+		fmt.Fprintf(buf, " %d", len(m.Data))
+	}
+	m.Flags.writeTo(buf)
+	buf.WriteString("\r\n")
+	if m.Name == "ms" {
+		buf.Write(m.Data)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// Transmit sends this command.
+func (m *MetaCommand) Transmit(w io.Writer) (int, error) {
+	return w.Write(m.Bytes())
+}
+
+func metaUint(fs MetaFlags, flag byte, def uint64, bits int) (uint64, error) {
+	tok, ok := fs.Token(flag)
+	if !ok {
+		return def, nil
+	}
+	v, err := strconv.ParseUint(tok, 10, bits)
+	if err != nil {
+		return 0, TextClientError("bad token in command line format")
+	}
+	return v, nil
+}
+
+var metaStoreModes = map[string]CommandCode{
+	"":  SET,
+	"S": SET,
+	"E": ADD,
+	"A": APPEND,
+	"P": PREPEND,
+	"R": REPLACE,
+}
+
+// NeedsState is true if this command has flags that can only be
+// answered by a store that keeps meta state: remaining TTLs (t),
+// leases (mg N and R) and invalidation (ms and md I).
+func (m *MetaCommand) NeedsState() bool {
+	switch m.Name {
+	case "mg":
+		return m.Flags.Has('t') || m.Flags.Has('N') || m.Flags.Has('R')
+	case "ma":
+		return m.Flags.Has('t')
+	case "ms", "md":
+		return m.Flags.Has('I')
+	}
+	return false
+}
+
+// Request is the binary request equivalent to this command.
+//
+// Flags that have no binary equivalent (leases, stale items, touching
+// and so on) are ignored; see NeedsState.  The q flag maps to the quiet opcodes, which
+// suppress the same replies meta commands do.
+func (m *MetaCommand) Request() (*MCRequest, error) {
+	req := &MCRequest{}
+	if m.Name == "mn" {
+		req.Opcode = NOOP
+		return req, nil
+	}
+
+	key, err := m.key()
+	if err != nil {
+		return nil, err
+	}
+	req.Key = key
+	if req.Cas, err = metaUint(m.Flags, 'C', 0, 64); err != nil {
+		return nil, err
+	}
+
+	switch m.Name {
+	case "mg":
+		req.Opcode = GET
+		if m.Flags.Has('q') {
+			req.Opcode = GETQ
+		}
+		return req, nil
+
+	case "ms":
+		mode, _ := m.Flags.Token('M')
+		op, ok := metaStoreModes[strings.ToUpper(mode)]
+		if !ok {
+			return nil, TextClientError("invalid mode for ms STORE")
+		}
+		req.Opcode = op
+		req.Body = m.Data
+		if op != APPEND && op != PREPEND {
+			flags, err := metaUint(m.Flags, 'F', 0, 32)
+			if err != nil {
+				return nil, err
+			}
+			ttl, err := metaUint(m.Flags, 'T', 0, 32)
+			if err != nil {
+				return nil, err
+			}
+			req.Extras = make([]byte, 8)
+			binary.BigEndian.PutUint32(req.Extras, uint32(flags))
+			binary.BigEndian.PutUint32(req.Extras[4:], uint32(ttl))
+		}
+
+	case "md":
+		req.Opcode = DELETE
+
+	case "ma":
+		mode, _ := m.Flags.Token('M')
+		switch strings.ToUpper(mode) {
+		case "", "I", "+":
+			req.Opcode = INCREMENT
+		case "D", "-":
+			req.Opcode = DECREMENT
+		default:
+			return nil, TextClientError("invalid mode for ma")
+		}
+		delta, err := metaUint(m.Flags, 'D', 1, 64)
+		if err != nil {
+			return nil, err
+		}
+		initial, err := metaUint(m.Flags, 'J', 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		// Only create missing values when asked to with N.
+		ttl, err := metaUint(m.Flags, 'N', 0xffffffff, 32)
+		if err != nil {
+			return nil, err
+		}
+		req.Extras = make([]byte, 20)
+		binary.BigEndian.PutUint64(req.Extras, delta)
+		binary.BigEndian.PutUint64(req.Extras[8:], initial)
+		binary.BigEndian.PutUint32(req.Extras[16:], uint32(ttl))
+	}
+
+	if m.Flags.Has('q') {
+		req.Opcode = textQuietCommands[req.Opcode]
+	}
+	return req, nil
+}
+
+// A reply to a meta command.
+type MetaResponse struct {
+	// HD, VA, EN, NF, NS, EX or MN, or ERROR, CLIENT_ERROR or
+	// SERVER_ERROR.
+	Code  string
+	Flags MetaFlags
+	// The value returned with VA.
+	Data []byte
+	// The description given with CLIENT_ERROR and SERVER_ERROR.
+	Message string
+}
+
+// Status is the binary status equivalent to this response's code.
+func (r *MetaResponse) Status() Status {
+	switch r.Code {
+	case "HD", "VA", "MN":
+		return SUCCESS
+	case "EN", "NF":
+		return KEY_ENOENT
+	case "NS":
+		return NOT_STORED
+	case "EX":
+		return KEY_EEXISTS
+	case "ERROR":
+		return UNKNOWN_COMMAND
+	case "CLIENT_ERROR":
+		return EINVAL
+	}
+	return EINTERNAL
+}
+
+// MetaState is what a store knows about an item beyond what a binary
+// response says, for answering meta commands.
+type MetaState struct {
+	// Seconds until the item expires, or -1 if it never does.
+	TTL int64
+	// This client won the right to recache the item (W).
+	Win bool
+	// The item is stale (X).
+	Stale bool
+	// Another client already won the right to recache it (Z).
+	Pending bool
+}
+
+// Response converts a binary response to a request made from this
+// command into a meta response.
+//
+// Only the flags asking for information a binary response has (c, f,
+// k, O, s and v) are honored.  A nil result means nothing should be
+// sent.
+func (m *MetaCommand) Response(res *MCResponse) *MetaResponse {
+	return m.StateResponse(res, nil)
+}
+
+// StateResponse is like Response, but also answers t and reports
+// leases from the item's state, if there is one.
+func (m *MetaCommand) StateResponse(res *MCResponse, st *MetaState) *MetaResponse {
+	if res == nil {
+		return nil
+	}
+	if m.Name == "mn" {
+		return &MetaResponse{Code: "MN"}
+	}
+
+	rv := &MetaResponse{}
+	if res.Status != SUCCESS {
+		mode, _ := m.Flags.Token('M')
+		switch {
+		case m.Name == "mg" && res.Status == KEY_ENOENT:
+			if m.Flags.Has('q') {
+				return nil
+			}
+			return &MetaResponse{Code: "EN"}
+		case res.Status == KEY_ENOENT:
+			rv.Code = "NF"
+			if m.Name == "ms" && !m.Flags.Has('C') {
+				rv.Code = "NS"
+			}
+		case res.Status == KEY_EEXISTS:
+			rv.Code = "EX"
+			if m.Name == "ms" && strings.ToUpper(mode) == "E" {
+				rv.Code = "NS"
+			}
+		case res.Status == NOT_STORED:
+			rv.Code = "NS"
+		default:
+			parts := strings.SplitN(textStatusLine(m.Name, res), " ", 2)
+			rv.Code = parts[0]
+			if len(parts) > 1 {
+				rv.Message = parts[1]
+			}
+			return rv
+		}
+	} else {
+		rv.Code = "HD"
+		if m.Flags.Has('q') && m.Name != "mg" {
+			return nil
+		}
+		if st != nil && m.Name == "mg" {
+			for _, f := range []struct {
+				set  bool
+				flag byte
+			}{{st.Win, 'W'}, {st.Stale, 'X'}, {st.Pending, 'Z'}} {
+				if f.set {
+					rv.Flags = append(rv.Flags, MetaFlag{f.flag, ""})
+				}
+			}
+		}
+	}
+
+	for _, f := range m.Flags {
+		switch f.Flag {
+		case 'O', 'b':
+			rv.Flags = append(rv.Flags, f)
+		case 'k':
+			rv.Flags = append(rv.Flags, MetaFlag{'k', m.Key})
+		}
+		if rv.Code != "HD" {
+			continue
+		}
+		switch f.Flag {
+		case 'c':
+			rv.Flags = append(rv.Flags, MetaFlag{'c', strconv.FormatUint(res.Cas, 10)})
+		case 'f':
+			if m.Name == "mg" {
+				var flags uint32
+				if len(res.Extras) >= 4 {
+					flags = binary.BigEndian.Uint32(res.Extras)
+				}
+				rv.Flags = append(rv.Flags, MetaFlag{'f', strconv.FormatUint(uint64(flags), 10)})
+			}
+		case 's':
+			if m.Name == "mg" {
+				rv.Flags = append(rv.Flags, MetaFlag{'s', strconv.Itoa(len(res.Body))})
+			}
+		case 't':
+			if st != nil && (m.Name == "mg" || m.Name == "ma") {
+				rv.Flags = append(rv.Flags, MetaFlag{'t', strconv.FormatInt(st.TTL, 10)})
+			}
+		}
+	}
+
+	if rv.Code == "HD" && m.Flags.Has('v') {
+		switch m.Name {
+		case "mg":
+			rv.Code, rv.Data = "VA", res.Body
+		case "ma":
+			if len(res.Body) >= 8 {
+				rv.Code = "VA"
+				rv.Data = []byte(strconv.FormatUint(binary.BigEndian.Uint64(res.Body), 10))
+			}
+		}
+	}
+	return rv
+}
+
+// Bytes is the wire representation of this response.
+func (r *MetaResponse) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(r.Code)
+	switch {
+	case r.Code == "VA":
+		fmt.Fprintf(buf, " %d", len(r.Data))
+	case r.Message != "":
+		buf.WriteString(" " + r.Message)
+	}
+	r.Flags.writeTo(buf)
+	buf.WriteString("\r\n")
+	if r.Code == "VA" {
+		buf.Write(r.Data)
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
+
+// Transmit sends this response.
+func (r *MetaResponse) Transmit(w io.Writer) (int, error) {
+	return w.Write(r.Bytes())
+}
+
+// Receive reads the next meta response.
+func (r *MetaResponse) Receive(rd *bufio.Reader) (int, error) {
+	line, n, err := readTextLine(rd)
+	if err != nil {
+		return n, err
+	}
+	*r = MetaResponse{}
+
+	for _, code := range []string{"CLIENT_ERROR", "SERVER_ERROR"} {
+		if strings.HasPrefix(line, code) {
+			r.Code = code
+			r.Message = strings.TrimSpace(line[len(code):])
+			return n, nil
+		}
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return n, fmt.Errorf("empty meta response")
+	}
+	r.Code, fields = fields[0], fields[1:]
+	switch r.Code {
+	case "HD", "EN", "NF", "NS", "EX", "MN", "ERROR":
+	case "VA":
+		if len(fields) == 0 {
+			return n, fmt.Errorf("missing VA size: %q", line)
+		}
+		size, err := strconv.ParseUint(fields[0], 10, 31)
+		if err != nil {
+			return n, fmt.Errorf("bad VA size: %q", line)
+		}
+		fields = fields[1:]
+		r.Data = make([]byte, size+2)
+		m, err := io.ReadFull(rd, r.Data)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		r.Data = r.Data[:size]
+	default:
+		return n, fmt.Errorf("unexpected meta response: %q", line)
+	}
+
+	if r.Flags, err = parseMetaFlags(fields); err != nil {
+		return n, fmt.Errorf("bad meta response flags: %q", line)
+	}
+	return n, nil
+}
@@ -0,0 +1,275 @@
+package gomemcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readMeta(t *testing.T, s string) *MetaCommand {
+	r := bufio.NewReader(strings.NewReader(s))
+	if !IsMetaCommand(r) {
+		t.Errorf("Expected %q to be a meta command", s)
+	}
+	m, err := ReadMetaCommand(r)
+	if err != nil {
+		t.Fatalf("Error reading %q: %v", s, err)
+	}
+	return m
+}
+
+func TestReadMetaCommand(t *testing.T) {
+	m := readMeta(t, "ms k 5 T30 F3 c Oabc\r\nhello\r\n")
+	exp := &MetaCommand{
+		Name: "ms",
+		Key:  "k",
+		Flags: MetaFlags{
+			{'T', "30"}, {'F', "3"}, {'c', ""}, {'O', "abc"},
+		},
+		Data: []byte("hello"),
+	}
+	if !reflect.DeepEqual(m, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, m)
+	}
+	if got := string(m.Bytes()); got != "ms k 5 T30 F3 c Oabc\r\nhello\r\n" {
+		t.Errorf("Expected the command back, got %q", got)
+	}
+	if tok, ok := m.Flags.Token('O'); !ok || tok != "abc" {
+		t.Errorf("Expected opaque abc, got %q/%v", tok, ok)
+	}
+	if m.Flags.Has('q') {
+		t.Errorf("Expected no q flag")
+	}
+
+	if m := readMeta(t, "mn\r\n"); m.Name != "mn" || m.Key != "" {
+		t.Errorf("Expected mn, got %#v", m)
+	}
+
+	for _, s := range []string{"get a\r\n", "mdx k\r\n", "mz a\r\n", "\r\n"} {
+		if IsMetaCommand(bufio.NewReader(strings.NewReader(s))) {
+			t.Errorf("Didn't expect %q to be a meta command", s)
+		}
+	}
+}
+
+func TestReadMetaCommandErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err error
+	}{
+		{"mx k\r\n", ErrUnknownCommand},
+		{"mg\r\n", TextClientError("bad command line format")},
+		{"mg k 1\r\n", TextClientError("invalid flag")},
+		{"mg !!! b\r\n", TextClientError("error decoding key")},
+		{"ms k x\r\n", TextClientError("bad data chunk")},
+		{"ms k 1\r\nxyz\r\n", TextClientError("bad data chunk")},
+	}
+	for _, test := range tests {
+		_, err := ReadMetaCommand(bufio.NewReader(strings.NewReader(test.in)))
+		if err != test.err {
+			t.Errorf("Expected %v from %q, got %v", test.err, test.in, err)
+		}
+	}
+}
+
+func TestMetaRequest(t *testing.T) {
+	tests := []struct {
+		in   string
+		op   CommandCode
+		key  string
+		cas  uint64
+		body string
+	}{
+		{"mg k v\r\n", GET, "k", 0, ""},
+		{"mg k q v\r\n", GETQ, "k", 0, ""},
+		{"mg aGVsbG8= b v\r\n", GET, "hello", 0, ""},
+		{"ms k 1\r\nx\r\n", SET, "k", 0, "x"},
+		{"ms k 1 ME\r\nx\r\n", ADD, "k", 0, "x"},
+		{"ms k 1 MA q\r\nx\r\n", APPENDQ, "k", 0, "x"},
+		{"ms k 1 C99\r\nx\r\n", SET, "k", 99, "x"},
+		{"md k q\r\n", DELETEQ, "k", 0, ""},
+		{"ma k MD\r\n", DECREMENT, "k", 0, ""},
+		{"mn\r\n", NOOP, "", 0, ""},
+	}
+	for _, test := range tests {
+		req, err := readMeta(t, test.in).Request()
+		if err != nil {
+			t.Errorf("Error converting %q: %v", test.in, err)
+			continue
+		}
+		if req.Opcode != test.op || string(req.Key) != test.key ||
+			req.Cas != test.cas || string(req.Body) != test.body {
+			t.Errorf("Expected %v %q cas=%v %q from %q, got %v",
+				test.op, test.key, test.cas, test.body, test.in, req)
+		}
+	}
+
+	req, _ := readMeta(t, "ms k 1 F7 T60\r\nx\r\n").Request()
+	if !bytes.Equal(req.Extras, []byte{0, 0, 0, 7, 0, 0, 0, 60}) {
+		t.Errorf("Expected flags and ttl in extras, got %v", req.Extras)
+	}
+
+	req, _ = readMeta(t, "ma k D5 J10 N30\r\n").Request()
+	if binary.BigEndian.Uint64(req.Extras) != 5 ||
+		binary.BigEndian.Uint64(req.Extras[8:]) != 10 ||
+		binary.BigEndian.Uint32(req.Extras[16:]) != 30 {
+		t.Errorf("Expected delta 5, initial 10, ttl 30, got %v", req.Extras)
+	}
+	req, _ = readMeta(t, "ma k\r\n").Request()
+	if binary.BigEndian.Uint64(req.Extras) != 1 ||
+		binary.BigEndian.Uint32(req.Extras[16:]) != 0xffffffff {
+		t.Errorf("Expected delta 1 and no create, got %v", req.Extras)
+	}
+
+	if _, err := readMeta(t, "ms k 1 MX\r\nx\r\n").Request(); err == nil {
+		t.Errorf("Expected an error for a bad mode")
+	}
+}
+
+func TestMetaResponse(t *testing.T) {
+	hit := &MCResponse{
+		Cas:    42,
+		Extras: []byte{0, 0, 0, 7},
+		Body:   []byte("hello"),
+	}
+	tests := []struct {
+		in  string
+		res *MCResponse
+		exp string
+	}{
+		{"mg k v c f s k Oxx\r\n", hit,
+			"VA 5 c42 f7 s5 kk Oxx\r\nhello\r\n"},
+		{"mg k t\r\n", hit, "HD\r\n"},
+		{"mg k v\r\n", &MCResponse{Status: KEY_ENOENT}, "EN\r\n"},
+		{"mg k q v\r\n", &MCResponse{Status: KEY_ENOENT}, ""},
+		{"ms k 1 c\r\nx\r\n", &MCResponse{Cas: 3}, "HD c3\r\n"},
+		{"ms k 1 q\r\nx\r\n", &MCResponse{}, ""},
+		{"ms k 1 ME O1\r\nx\r\n", &MCResponse{Status: KEY_EEXISTS}, "NS O1\r\n"},
+		{"ms k 1 C5\r\nx\r\n", &MCResponse{Status: KEY_EEXISTS}, "EX\r\n"},
+		{"ms k 1 C5\r\nx\r\n", &MCResponse{Status: KEY_ENOENT}, "NF\r\n"},
+		{"ms k 1 MR\r\nx\r\n", &MCResponse{Status: KEY_ENOENT}, "NS\r\n"},
+		{"ms k 1\r\nx\r\n", &MCResponse{Status: ENOMEM},
+			"SERVER_ERROR out of memory storing object\r\n"},
+		{"md k\r\n", &MCResponse{Status: KEY_ENOENT}, "NF\r\n"},
+		{"ma k v\r\n", &MCResponse{Body: []byte{0, 0, 0, 0, 0, 0, 0, 9}},
+			"VA 1\r\n9\r\n"},
+		{"mn\r\n", &MCResponse{}, "MN\r\n"},
+	}
+	for _, test := range tests {
+		mr := readMeta(t, test.in).Response(test.res)
+		got := ""
+		if mr != nil {
+			got = string(mr.Bytes())
+		}
+		if got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+}
+
+func TestMetaStateResponse(t *testing.T) {
+	hit := &MCResponse{Body: []byte("old")}
+	tests := []struct {
+		in  string
+		st  MetaState
+		exp string
+	}{
+		{"mg k t\r\n", MetaState{TTL: -1}, "HD t-1\r\n"},
+		{"mg k t v\r\n", MetaState{TTL: 30}, "VA 3 t30\r\nold\r\n"},
+		{"mg k v Oa\r\n", MetaState{TTL: 5, Win: true, Stale: true},
+			"VA 3 W X Oa\r\nold\r\n"},
+		{"mg k\r\n", MetaState{Pending: true}, "HD Z\r\n"},
+		{"ma k t\r\n", MetaState{TTL: 9}, "HD t9\r\n"},
+		{"ms k 1 t\r\nx\r\n", MetaState{TTL: 9, Win: true}, "HD\r\n"},
+	}
+	for _, test := range tests {
+		mr := readMeta(t, test.in).StateResponse(hit, &test.st)
+		if got := string(mr.Bytes()); got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, got)
+		}
+	}
+
+	mr := readMeta(t, "mg k t\r\n").StateResponse(&MCResponse{Status: KEY_ENOENT},
+		&MetaState{Win: true})
+	if got := string(mr.Bytes()); got != "EN\r\n" {
+		t.Errorf("Expected a plain miss, got %q", got)
+	}
+}
+
+func TestMetaNeedsState(t *testing.T) {
+	tests := map[string]bool{
+		"mg k v\r\n":         false,
+		"mg k t\r\n":         true,
+		"mg k N30\r\n":       true,
+		"mg k R10\r\n":       true,
+		"ma k N30\r\n":       false,
+		"ma k t\r\n":         true,
+		"ms k 1 I\r\nx\r\n":  true,
+		"ms k 1 T5\r\nx\r\n": false,
+		"md k I\r\n":         true,
+		"md k\r\n":           false,
+		"mn\r\n":             false,
+	}
+	for in, exp := range tests {
+		if got := readMeta(t, in).NeedsState(); got != exp {
+			t.Errorf("Expected %v for %q, got %v", exp, in, got)
+		}
+	}
+}
+
+func TestReceiveMetaResponse(t *testing.T) {
+	tests := []struct {
+		in     string
+		code   string
+		status Status
+		data   string
+	}{
+		{"VA 5 c42 Oxx\r\nhello\r\n", "VA", SUCCESS, "hello"},
+		{"HD\r\n", "HD", SUCCESS, ""},
+		{"EN\r\n", "EN", KEY_ENOENT, ""},
+		{"NS\r\n", "NS", NOT_STORED, ""},
+		{"EX c1\r\n", "EX", KEY_EEXISTS, ""},
+		{"MN\r\n", "MN", SUCCESS, ""},
+		{"CLIENT_ERROR bad data chunk\r\n", "CLIENT_ERROR", EINVAL, ""},
+		{"SERVER_ERROR oops\r\n", "SERVER_ERROR", EINTERNAL, ""},
+	}
+	for _, test := range tests {
+		res := &MetaResponse{}
+		n, err := res.Receive(bufio.NewReader(strings.NewReader(test.in)))
+		if err != nil {
+			t.Errorf("Error receiving %q: %v", test.in, err)
+			continue
+		}
+		if n != len(test.in) {
+			t.Errorf("Expected to read %v bytes of %q, read %v",
+				len(test.in), test.in, n)
+		}
+		if res.Code != test.code || res.Status() != test.status ||
+			string(res.Data) != test.data {
+			t.Errorf("Expected %v/%v/%q from %q, got %#v",
+				test.code, test.status, test.data, test.in, res)
+		}
+		if string(res.Bytes()) != test.in {
+			t.Errorf("Expected %q back, got %q", test.in, res.Bytes())
+		}
+	}
+
+	res := &MetaResponse{}
+	_, err := res.Receive(bufio.NewReader(strings.NewReader("VA 5 c42 Oxx\r\nhello\r\n")))
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if tok, _ := res.Flags.Token('c'); tok != "42" {
+		t.Errorf("Expected cas 42, got %q", tok)
+	}
+
+	for _, s := range []string{"WAT\r\n", "VA\r\n", "VA 5\r\nhi\r\n"} {
+		res := &MetaResponse{}
+		if _, err := res.Receive(bufio.NewReader(strings.NewReader(s))); err == nil {
+			t.Errorf("Expected an error receiving %q", s)
+		}
+	}
+}
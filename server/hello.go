@@ -0,0 +1,35 @@
+package memcached
+
+import (
+	"github.com/dustin/gomemcached"
+)
+
+// HelloResponse answers a HELLO request, enabling those of the
+// requested features that are supported.
+func HelloResponse(req *gomemcached.MCRequest,
+	supported ...gomemcached.Feature) *gomemcached.MCResponse {
+
+	requested, err := gomemcached.DecodeFeatures(req.Body)
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	ok := map[gomemcached.Feature]bool{}
+	for _, f := range supported {
+		ok[f] = true
+	}
+	enabled := []gomemcached.Feature{}
+	for _, f := range requested {
+		if ok[f] {
+			enabled = append(enabled, f)
+			// Only report each once.
+			delete(ok, f)
+		}
+	}
+	return &gomemcached.MCResponse{
+		Body: gomemcached.EncodeFeatures(enabled),
+	}
+}
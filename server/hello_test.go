@@ -0,0 +1,35 @@
+package memcached
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestHelloResponse(t *testing.T) {
+	req := &gomemcached.MCRequest{
+		Opcode: gomemcached.HELLO,
+		Key:    []byte("test"),
+		Body: gomemcached.EncodeFeatures([]gomemcached.Feature{
+			gomemcached.FEATURE_SNAPPY,
+			gomemcached.FEATURE_XATTR,
+			gomemcached.FEATURE_JSON,
+			gomemcached.FEATURE_JSON,
+		}),
+	}
+	res := HelloResponse(req, gomemcached.FEATURE_JSON, gomemcached.FEATURE_SNAPPY)
+	if res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected success, got %v", res)
+	}
+	got, _ := gomemcached.DecodeFeatures(res.Body)
+	exp := []gomemcached.Feature{gomemcached.FEATURE_SNAPPY, gomemcached.FEATURE_JSON}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	req.Body = []byte{1}
+	if res := HelloResponse(req); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected EINVAL for a bad body, got %v", res)
+	}
+}
@@ -0,0 +1,33 @@
+package memcached
+
+import (
+	"io"
+
+	"github.com/dustin/gomemcached"
+)
+
+type inflateHandler struct {
+	h RequestHandler
+}
+
+func (ih inflateHandler) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.DataType&gomemcached.DATATYPE_SNAPPY != 0 {
+		body, err := gomemcached.SnappyDecode(req.Body)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.EINVAL,
+				Body:   []byte(err.Error()),
+			}
+		}
+		req.Body = body
+		req.DataType &^= gomemcached.DATATYPE_SNAPPY
+	}
+	return ih.h.HandleMessage(w, req)
+}
+
+// InflateHandler wraps a handler so it only ever sees uncompressed
+// requests.  Snappy compressed bodies are decompressed before it's
+// called, and corrupt ones are rejected with EINVAL.
+func InflateHandler(h RequestHandler) RequestHandler {
+	return inflateHandler{h}
+}
@@ -0,0 +1,42 @@
+package memcached
+
+import (
+	"io"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+func TestInflateHandler(t *testing.T) {
+	var got *gomemcached.MCRequest
+	h := InflateHandler(FuncHandler(func(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+		got = req
+		return &gomemcached.MCResponse{}
+	}))
+
+	body := []byte("hello hello hello hello")
+	req := &gomemcached.MCRequest{
+		Opcode:   gomemcached.SET,
+		DataType: gomemcached.DATATYPE_SNAPPY | gomemcached.DATATYPE_JSON,
+		Body:     gomemcached.SnappyEncode(body),
+	}
+	if res := h.HandleMessage(nil, req); res.Status != gomemcached.SUCCESS {
+		t.Fatalf("Expected success, got %v", res)
+	}
+	if string(got.Body) != string(body) || got.DataType != gomemcached.DATATYPE_JSON {
+		t.Errorf("Expected an inflated JSON body, got %q/%v", got.Body, got.DataType)
+	}
+
+	got = nil
+	req = &gomemcached.MCRequest{
+		Opcode:   gomemcached.SET,
+		DataType: gomemcached.DATATYPE_SNAPPY,
+		Body:     []byte{0xff},
+	}
+	if res := h.HandleMessage(nil, req); res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected EINVAL for a corrupt body, got %v", res)
+	}
+	if got != nil {
+		t.Errorf("Expected the handler not to be called, got %v", got)
+	}
+}
@@ -0,0 +1,141 @@
+package mcstore
+
+import (
+	"strconv"
+
+	"github.com/dustin/gomemcached"
+)
+
+// metaNumber parses the token of a numeric flag, or returns -1 if the
+// flag isn't there.
+func metaNumber(m *gomemcached.MetaCommand, flag byte) (int64, error) {
+	tok, ok := m.Flags.Token(flag)
+	if !ok {
+		return -1, nil
+	}
+	v, err := strconv.ParseUint(tok, 10, 32)
+	if err != nil {
+		return 0, gomemcached.TextClientError("bad token in command line format")
+	}
+	return int64(v), nil
+}
+
+// HandleMeta answers a meta command, including remaining TTLs and
+// leases:
+//
+// mg N vivifies a missing item as an empty placeholder with the token
+// as its TTL, and tells the client it won (W) the right to fill it in.
+// mg R wins a recache when fewer seconds than its token are left.
+// md I, and ms I with an older C than the item's, mark the item stale
+// (X) rather than removing or refusing it; the next mg wins its
+// recache.  T sets the TTL of an item invalidated by md.
+//
+// Only one client wins an item at a time.  Others are told another
+// has (Z) until it's stored again.
+func (s *Store) HandleMeta(m *gomemcached.MetaCommand) *gomemcached.MetaResponse {
+	clientError := func(err error) *gomemcached.MetaResponse {
+		return &gomemcached.MetaResponse{Code: "CLIENT_ERROR", Message: err.Error()}
+	}
+	req, err := m.Request()
+	if err != nil {
+		return clientError(err)
+	}
+	vivify, err := metaNumber(m, 'N')
+	if err != nil {
+		return clientError(err)
+	}
+	recache, err := metaNumber(m, 'R')
+	if err != nil {
+		return clientError(err)
+	}
+	ttl, err := metaNumber(m, 'T')
+	if err != nil {
+		return clientError(err)
+	}
+	key := string(req.Key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := &gomemcached.MetaState{TTL: -1}
+	var res *gomemcached.MCResponse
+	switch {
+	case m.Name == "mg":
+		s.lease(key, req.VBucket, vivify, recache, st)
+		res = s.handleGet(req)
+	case m.Name == "md" && m.Flags.Has('I'):
+		res = s.invalidate(key, req.Cas, ttl)
+	case m.Name == "ms" && m.Flags.Has('I'):
+		item, exists := s.lookup(key)
+		stale := exists && req.Cas != 0 && req.Cas < item.Cas
+		if stale {
+			req.Cas = 0
+		}
+		res = s.handle(req)
+		if stale && res.Status == gomemcached.SUCCESS {
+			item = s.items[key]
+			item.stale = true
+			s.items[key] = item
+		}
+	default:
+		res = s.handle(req)
+	}
+
+	if item, ok := s.lookup(key); ok && item.Expiration != 0 {
+		st.TTL = int64(item.Expiration) - s.now().Unix()
+	}
+	return m.StateResponse(res, st)
+}
+
+// lease works out the lease flags for a get, creating a placeholder
+// for a missing item if vivify isn't -1.
+//
+// Must be called with s.mu held.
+func (s *Store) lease(key string, vb uint16, vivify, recache int64,
+	st *gomemcached.MetaState) {
+	item, exists := s.lookup(key)
+	switch {
+	case !exists && vivify < 0:
+		return
+	case !exists:
+		s.store(key, vb, gomemcached.MCItem{
+			Expiration: s.absExpiry(uint32(vivify)),
+			Data:       []byte{},
+		})
+		item = s.items[key]
+		st.Win = true
+	case item.tokenSent:
+		st.Pending = true
+	case item.stale:
+		st.Win = true
+	case recache >= 0 && item.Expiration != 0 &&
+		int64(item.Expiration)-s.now().Unix() < recache:
+		st.Win = true
+	}
+	st.Stale = item.stale
+	if st.Win {
+		item.tokenSent = true
+		s.items[key] = item
+	}
+}
+
+// invalidate marks an item stale, optionally giving it a new TTL.
+//
+// Must be called with s.mu held.
+func (s *Store) invalidate(key string, cas uint64, ttl int64) *gomemcached.MCResponse {
+	item, exists := s.lookup(key)
+	switch {
+	case !exists:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	case cas != 0 && cas != item.Cas:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	}
+	s.cas++
+	item.Cas = s.cas
+	item.stale = true
+	item.tokenSent = false
+	if ttl >= 0 {
+		item.Expiration = s.absExpiry(uint32(ttl))
+	}
+	s.items[key] = item
+	return &gomemcached.MCResponse{Cas: item.Cas}
+}
@@ -0,0 +1,105 @@
+package mcstore
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+// meta runs a meta command against the store and returns the reply.
+func meta(t *testing.T, s *Store, cmd string) string {
+	m, err := gomemcached.ReadMetaCommand(bufio.NewReader(strings.NewReader(cmd)))
+	if err != nil {
+		t.Fatalf("Error reading %q: %v", cmd, err)
+	}
+	mr := s.HandleMeta(m)
+	if mr == nil {
+		return ""
+	}
+	return string(mr.Bytes())
+}
+
+func TestStoreMeta(t *testing.T) {
+	s := New()
+	now := time.Unix(1000000000, 0)
+	s.Now = func() time.Time { return now }
+
+	steps := []struct {
+		cmd, exp string
+	}{
+		{"mg k t v\r\n", "EN\r\n"},
+		{"mg k q v\r\n", ""},
+		{"ms k 1 T100\r\nx\r\n", "HD\r\n"},
+		{"mg k t v\r\n", "VA 1 t100\r\nx\r\n"},
+		{"ms n 1\r\ny\r\n", "HD\r\n"},
+		{"mg n t\r\n", "HD t-1\r\n"},
+		{"ma c N0 J5 t v\r\n", "VA 1 t-1\r\n5\r\n"},
+		{"mg k Nx\r\n", "CLIENT_ERROR bad token in command line format\r\n"},
+		{"mn\r\n", "MN\r\n"},
+	}
+	for _, step := range steps {
+		if got := meta(t, s, step.cmd); got != step.exp {
+			t.Errorf("Expected %q for %q, got %q", step.exp, step.cmd, got)
+		}
+	}
+
+	now = now.Add(40 * time.Second)
+	if got := meta(t, s, "mg k t\r\n"); got != "HD t60\r\n" {
+		t.Errorf("Expected 60 seconds left, got %q", got)
+	}
+}
+
+func TestStoreMetaLeases(t *testing.T) {
+	s := New()
+	now := time.Unix(1000000000, 0)
+	s.Now = func() time.Time { return now }
+
+	steps := []struct {
+		cmd, exp string
+	}{
+		// A miss vivifies a placeholder; only the first client wins.
+		{"mg v N30 t v\r\n", "VA 0 W t30\r\n\r\n"},
+		{"mg v N30 v\r\n", "VA 0 Z\r\n\r\n"},
+		{"ms v 3\r\nnew\r\n", "HD\r\n"},
+		{"mg v N30 v\r\n", "VA 3\r\nnew\r\n"},
+
+		// Invalidated items are served stale while one client
+		// recaches.
+		{"md v I T20\r\n", "HD\r\n"},
+		{"mg v t v\r\n", "VA 3 W X t20\r\nnew\r\n"},
+		{"mg v v\r\n", "VA 3 X Z\r\nnew\r\n"},
+		{"ms v 5\r\nnewer\r\n", "HD\r\n"},
+		{"mg v v\r\n", "VA 5\r\nnewer\r\n"},
+		{"md missing I\r\n", "NF\r\n"},
+
+		// Items close to expiring are recached early.
+		{"ms r 1 T10\r\nx\r\n", "HD\r\n"},
+		{"mg r R5\r\n", "HD\r\n"},
+		{"mg r R30\r\n", "HD W\r\n"},
+		{"mg r R30\r\n", "HD Z\r\n"},
+	}
+	for _, step := range steps {
+		if got := meta(t, s, step.cmd); got != step.exp {
+			t.Errorf("Expected %q for %q, got %q", step.exp, step.cmd, got)
+		}
+	}
+
+	// A store with I and an outdated CAS lands, but stale.
+	old, _ := s.Item("v")
+	meta(t, s, "ms v 1\r\na\r\n")
+	cmd := fmt.Sprintf("ms v 1 I C%d\r\nb\r\n", old.Cas)
+	if got := meta(t, s, cmd); got != "HD\r\n" {
+		t.Errorf("Expected an invalid store to be accepted, got %q", got)
+	}
+	if got := meta(t, s, "mg v v\r\n"); got != "VA 1 W X\r\nb\r\n" {
+		t.Errorf("Expected a stale item, got %q", got)
+	}
+	cmd = fmt.Sprintf("ms v 1 C%d\r\nc\r\n", old.Cas)
+	if got := meta(t, s, cmd); got != "EX\r\n" {
+		t.Errorf("Expected a plain outdated store to fail, got %q", got)
+	}
+}
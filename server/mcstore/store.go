@@ -0,0 +1,448 @@
+// Package mcstore is an in-memory item store with memcached
+// semantics, for serving binary protocol requests.
+package mcstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	"github.com/dustin/gomemcached/server"
+)
+
+// Expiration values larger than this are absolute unix times rather
+// than a number of seconds from now.
+const maxRelativeExpiry = 60 * 60 * 24 * 30
+
+// Store is an in-memory item store with memcached semantics.
+//
+// It implements the server package's RequestHandler interface, so it
+// can answer binary protocol requests directly.  It is safe for
+// concurrent use.
+type Store struct {
+	// Now is used as the current time for expiration.  It
+	// defaults to time.Now.
+	Now func() time.Time
+
+	mu       sync.Mutex
+	items    map[string]storedItem
+	cas      uint64
+	watchers map[chan memcached.TapChange]bool
+}
+
+// storedItem is an item along with where and when it was stored.
+type storedItem struct {
+	gomemcached.MCItem
+	vb    uint16
+	mtime int64
+	// Lease state for meta commands.
+	stale     bool
+	tokenSent bool
+}
+
+// tapChange describes an item for watchers.
+func tapChange(key string, item storedItem) memcached.TapChange {
+	return memcached.TapChange{
+		Key:     key,
+		VBucket: item.vb,
+		MCItem:  item.MCItem,
+		Mtime:   item.mtime,
+	}
+}
+
+// New creates an empty store.
+func New() *Store {
+	return &Store{
+		Now:      time.Now,
+		items:    map[string]storedItem{},
+		watchers: map[chan memcached.TapChange]bool{},
+	}
+}
+
+func (s *Store) now() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// absExpiry converts a protocol expiration into a unix time (or 0).
+func (s *Store) absExpiry(exp uint32) uint32 {
+	if exp == 0 || exp > maxRelativeExpiry {
+		return exp
+	}
+	return uint32(s.now().Unix()) + exp
+}
+
+// lookup finds a live item, deleting it if it has expired.
+//
+// Must be called with s.mu held.
+func (s *Store) lookup(key string) (storedItem, bool) {
+	item, ok := s.items[key]
+	if ok && item.Expiration != 0 &&
+		int64(item.Expiration) <= s.now().Unix() {
+		s.remove(key, item)
+		return item, false
+	}
+	return item, ok
+}
+
+// store an item under a new CAS.
+//
+// Must be called with s.mu held.
+func (s *Store) store(key string, vb uint16, item gomemcached.MCItem) uint64 {
+	s.cas++
+	item.Cas = s.cas
+	stored := storedItem{MCItem: item, vb: vb, mtime: s.now().Unix()}
+	s.items[key] = stored
+	s.notify(tapChange(key, stored))
+	return item.Cas
+}
+
+// remove an item.
+//
+// Must be called with s.mu held.
+func (s *Store) remove(key string, item storedItem) {
+	delete(s.items, key)
+	s.cas++
+	item.Cas = s.cas
+	c := tapChange(key, item)
+	c.Deleted = true
+	s.notify(c)
+}
+
+// Size of the buffer of changes kept for each watcher.
+const watchBuffer = 1024
+
+// TapWatch returns the live items, and a channel on which all changes
+// from then on will be delivered, so the store can be served with a
+// TapProducer.
+//
+// A watcher that falls more than watchBuffer changes behind has its
+// channel closed.
+func (s *Store) TapWatch() ([]memcached.TapChange, <-chan memcached.TapChange, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []memcached.TapChange{}
+	for k := range s.items {
+		if item, ok := s.lookup(k); ok {
+			items = append(items, tapChange(k, item))
+		}
+	}
+	ch := make(chan memcached.TapChange, watchBuffer)
+	s.watchers[ch] = true
+	return items, ch, func() { s.unwatch(ch) }
+}
+
+// unwatch stops delivery of changes to a channel from TapWatch.
+func (s *Store) unwatch(ch chan memcached.TapChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watchers[ch] {
+		delete(s.watchers, ch)
+		close(ch)
+	}
+}
+
+// Must be called with s.mu held.
+func (s *Store) notify(c memcached.TapChange) {
+	for ch := range s.watchers {
+		select {
+		case ch <- c:
+		default:
+			delete(s.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Len is the number of live items in the store.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for k := range s.items {
+		if _, ok := s.lookup(k); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Item returns the live item stored under key, if any.
+func (s *Store) Item(key string) (gomemcached.MCItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.lookup(key)
+	return item.MCItem, ok
+}
+
+// HandleMessage applies a single request to the store.
+//
+// The response is nil when a quiet command has nothing to say.
+func (s *Store) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.Opcode == gomemcached.STAT {
+		// Written without the lock held, so a slow reader
+		// doesn't hold up everyone else.
+		return s.handleStat(w, req)
+	}
+	s.mu.Lock()
+	res := s.handle(req)
+	s.mu.Unlock()
+	if res == nil || !req.Opcode.IsQuiet() {
+		return res
+	}
+	// Quiet gets only keep quiet about misses, everything else
+	// only about success.
+	switch req.Opcode {
+	case gomemcached.GETQ, gomemcached.GETKQ:
+		if res.Status == gomemcached.KEY_ENOENT {
+			return nil
+		}
+	default:
+		if res.Status == gomemcached.SUCCESS {
+			return nil
+		}
+	}
+	return res
+}
+
+// Must be called with s.mu held.
+func (s *Store) handle(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.GET, gomemcached.GETQ, gomemcached.GETK, gomemcached.GETKQ:
+		return s.handleGet(req)
+	case gomemcached.SET, gomemcached.SETQ,
+		gomemcached.ADD, gomemcached.ADDQ,
+		gomemcached.REPLACE, gomemcached.REPLACEQ:
+		return s.handleStore(req)
+	case gomemcached.APPEND, gomemcached.APPENDQ,
+		gomemcached.PREPEND, gomemcached.PREPENDQ:
+		return s.handleConcat(req)
+	case gomemcached.DELETE, gomemcached.DELETEQ:
+		return s.handleDelete(req)
+	case gomemcached.INCREMENT, gomemcached.INCREMENTQ,
+		gomemcached.DECREMENT, gomemcached.DECREMENTQ:
+		return s.handleArith(req)
+	case gomemcached.FLUSH, gomemcached.FLUSHQ:
+		s.flush()
+		return &gomemcached.MCResponse{}
+	case gomemcached.NOOP:
+		return &gomemcached.MCResponse{}
+	case gomemcached.VERSION:
+		return &gomemcached.MCResponse{Body: []byte("mcstore")}
+	case gomemcached.SASL_LIST_MECHS:
+		return &gomemcached.MCResponse{Body: []byte("PLAIN")}
+	case gomemcached.SASL_AUTH:
+		return &gomemcached.MCResponse{Body: []byte("Authenticated")}
+	case gomemcached.OBSERVE:
+		return s.handleObserve(req)
+	case gomemcached.QUIT, gomemcached.QUITQ:
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+	return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+}
+
+// Flush removes every item.
+func (s *Store) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+}
+
+// Must be called with s.mu held.
+func (s *Store) flush() {
+	s.items = map[string]storedItem{}
+	s.notify(memcached.TapChange{Flushed: true})
+}
+
+func (s *Store) handleGet(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	item, ok := s.lookup(string(req.Key))
+	if !ok {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+	res := &gomemcached.MCResponse{
+		Cas:    item.Cas,
+		Extras: make([]byte, 4),
+		Body:   append([]byte{}, item.Data...),
+	}
+	binary.BigEndian.PutUint32(res.Extras, item.Flags)
+	if req.Opcode == gomemcached.GETK || req.Opcode == gomemcached.GETKQ {
+		res.Key = req.Key
+	}
+	return res
+}
+
+func (s *Store) handleStore(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) != 8 {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	key := string(req.Key)
+
+	old, exists := s.lookup(key)
+	switch {
+	case (req.Opcode == gomemcached.ADD || req.Opcode == gomemcached.ADDQ) && exists:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	case (req.Opcode == gomemcached.REPLACE || req.Opcode == gomemcached.REPLACEQ) && !exists:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	case req.Cas != 0 && !exists:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	case req.Cas != 0 && req.Cas != old.Cas:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	}
+
+	cas := s.store(key, req.VBucket, gomemcached.MCItem{
+		Flags:      binary.BigEndian.Uint32(req.Extras),
+		Expiration: s.absExpiry(binary.BigEndian.Uint32(req.Extras[4:])),
+		Data:       append([]byte{}, req.Body...),
+	})
+	return &gomemcached.MCResponse{Cas: cas}
+}
+
+func (s *Store) handleConcat(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	key := string(req.Key)
+
+	item, exists := s.lookup(key)
+	switch {
+	case !exists:
+		return &gomemcached.MCResponse{Status: gomemcached.NOT_STORED}
+	case req.Cas != 0 && req.Cas != item.Cas:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	}
+
+	if req.Opcode == gomemcached.APPEND || req.Opcode == gomemcached.APPENDQ {
+		item.Data = append(append([]byte{}, item.Data...), req.Body...)
+	} else {
+		item.Data = append(append([]byte{}, req.Body...), item.Data...)
+	}
+	return &gomemcached.MCResponse{Cas: s.store(key, req.VBucket, item.MCItem)}
+}
+
+func (s *Store) handleDelete(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	key := string(req.Key)
+
+	item, exists := s.lookup(key)
+	switch {
+	case !exists:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	case req.Cas != 0 && req.Cas != item.Cas:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	}
+	s.remove(key, item)
+	return &gomemcached.MCResponse{}
+}
+
+func (s *Store) handleArith(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Extras) != 20 {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	amt := binary.BigEndian.Uint64(req.Extras)
+	initial := binary.BigEndian.Uint64(req.Extras[8:])
+	exp := binary.BigEndian.Uint32(req.Extras[16:])
+	key := string(req.Key)
+
+	item, exists := s.lookup(key)
+	var val uint64
+	switch {
+	case req.Cas != 0 && (!exists || req.Cas != item.Cas):
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_EEXISTS}
+	case !exists && exp == 0xffffffff:
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	case !exists:
+		val = initial
+		item.Expiration = s.absExpiry(exp)
+	default:
+		old, err := strconv.ParseUint(string(bytes.TrimSpace(item.Data)), 10, 64)
+		if err != nil {
+			return &gomemcached.MCResponse{
+				Status: gomemcached.DELTA_BADVAL,
+				Body:   []byte("Non-numeric server-side value for incr or decr"),
+			}
+		}
+		switch {
+		case req.Opcode == gomemcached.INCREMENT || req.Opcode == gomemcached.INCREMENTQ:
+			val = old + amt
+		case amt > old:
+			val = 0
+		default:
+			val = old - amt
+		}
+	}
+
+	item.Data = []byte(strconv.FormatUint(val, 10))
+	res := &gomemcached.MCResponse{
+		Cas:  s.store(key, req.VBucket, item.MCItem),
+		Body: make([]byte, 8),
+	}
+	binary.BigEndian.PutUint64(res.Body, val)
+	return res
+}
+
+// Stats reports a few statistics about the store.
+func (s *Store) Stats() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats()
+}
+
+// Must be called with s.mu held.
+func (s *Store) stats() map[string]string {
+	items, size := 0, 0
+	for k := range s.items {
+		if item, ok := s.lookup(k); ok {
+			items++
+			size += len(k) + len(item.Data)
+		}
+	}
+	return map[string]string{
+		"curr_items": strconv.Itoa(items),
+		"bytes":      strconv.Itoa(size),
+		"time":       strconv.FormatInt(s.now().Unix(), 10),
+		"version":    "mcstore",
+	}
+}
+
+func (s *Store) handleStat(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Key) > 0 {
+		return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+	}
+	for k, v := range s.Stats() {
+		res := &gomemcached.MCResponse{
+			Opcode: req.Opcode,
+			Opaque: req.Opaque,
+			Key:    []byte(k),
+			Body:   []byte(v),
+		}
+		if _, err := res.Transmit(w); err != nil {
+			return &gomemcached.MCResponse{Fatal: true}
+		}
+	}
+	return &gomemcached.MCResponse{}
+}
+
+func (s *Store) handleObserve(req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if len(req.Body) < 4 {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	klen := int(binary.BigEndian.Uint16(req.Body[2:]))
+	if len(req.Body) < 4+klen {
+		return &gomemcached.MCResponse{Status: gomemcached.EINVAL}
+	}
+	key := req.Body[4 : 4+klen]
+
+	item, exists := s.lookup(string(key))
+
+	body := make([]byte, 4+klen+1+8)
+	copy(body, req.Body[:4+klen])
+	// Everything is as persisted as it's ever going to be.
+	body[4+klen] = 0x01
+	if !exists {
+		body[4+klen] = 0x80
+	}
+	binary.BigEndian.PutUint64(body[5+klen:], item.Cas)
+	return &gomemcached.MCResponse{Body: body}
+}
@@ -0,0 +1,123 @@
+package mcstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+)
+
+func setRequest(opcode gomemcached.CommandCode, key, val string, exp uint32) *gomemcached.MCRequest {
+	req := &gomemcached.MCRequest{
+		Opcode: opcode,
+		Key:    []byte(key),
+		Extras: make([]byte, 8),
+		Body:   []byte(val),
+	}
+	binary.BigEndian.PutUint32(req.Extras[4:], exp)
+	return req
+}
+
+func TestStoreHandleMessage(t *testing.T) {
+	s := New()
+	w := &bytes.Buffer{}
+
+	res := s.HandleMessage(w, setRequest(gomemcached.SET, "k", "v", 0))
+	if res.Status != gomemcached.SUCCESS || res.Cas == 0 {
+		t.Fatalf("Expected a stored item, got %v", res)
+	}
+	res = s.HandleMessage(w, &gomemcached.MCRequest{Opcode: gomemcached.GET, Key: []byte("k")})
+	if string(res.Body) != "v" {
+		t.Errorf("Expected v, got %v", res)
+	}
+
+	// Quiet commands only speak up when there's something wrong.
+	if res := s.HandleMessage(w, setRequest(gomemcached.SETQ, "k", "w", 0)); res != nil {
+		t.Errorf("Expected a quiet set, got %v", res)
+	}
+	res = s.HandleMessage(w, setRequest(gomemcached.ADDQ, "k", "x", 0))
+	if res == nil || res.Status != gomemcached.KEY_EEXISTS {
+		t.Errorf("Expected the failed add to be reported, got %v", res)
+	}
+	if res := s.HandleMessage(w, &gomemcached.MCRequest{Opcode: gomemcached.GETQ,
+		Key: []byte("missing")}); res != nil {
+		t.Errorf("Expected a quiet miss, got %v", res)
+	}
+	if item, _ := s.Item("k"); string(item.Data) != "w" {
+		t.Errorf("Expected w, got %q", item.Data)
+	}
+}
+
+func TestStoreExpiry(t *testing.T) {
+	s := New()
+	now := time.Unix(1000000000, 0)
+	s.Now = func() time.Time { return now }
+
+	s.HandleMessage(nil, setRequest(gomemcached.SET, "k", "v", 10))
+	if s.Len() != 1 {
+		t.Fatalf("Expected one item, got %v", s.Len())
+	}
+	now = now.Add(10 * time.Second)
+	if _, ok := s.Item("k"); ok || s.Len() != 0 {
+		t.Errorf("Expected the item to have expired")
+	}
+}
+
+func TestStoreTapWatch(t *testing.T) {
+	s := New()
+	s.HandleMessage(nil, setRequest(gomemcached.SET, "a", "1", 0))
+	items, changes, stop := s.TapWatch()
+	defer stop()
+	if len(items) != 1 || items[0].Key != "a" {
+		t.Fatalf("Expected a, got %v", items)
+	}
+
+	s.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.DELETE, Key: []byte("a")})
+	s.Flush()
+	if c := <-changes; c.Key != "a" || !c.Deleted {
+		t.Errorf("Expected a deletion, got %v", c)
+	}
+	if c := <-changes; !c.Flushed {
+		t.Errorf("Expected a flush, got %v", c)
+	}
+}
+
+// stalledWriter blocks writes until it's released.
+type stalledWriter struct {
+	writing, release chan bool
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case w.writing <- true:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestStoreStatDoesNotBlock(t *testing.T) {
+	s := New()
+	w := &stalledWriter{writing: make(chan bool, 1), release: make(chan bool)}
+	statted := make(chan bool)
+	go func() {
+		s.HandleMessage(w, &gomemcached.MCRequest{Opcode: gomemcached.STAT})
+		close(statted)
+	}()
+	<-w.writing
+
+	got := make(chan bool)
+	go func() {
+		s.HandleMessage(nil, setRequest(gomemcached.SET, "k", "v", 0))
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected a stalled STAT reader not to block other requests")
+	}
+	close(w.release)
+	<-statted
+}
@@ -151,6 +151,9 @@ func TestMust(t *testing.T) {
 		defer func() { _, errored = recover().(error) }()
 		must(&gomemcached.MCResponse{})
 	}()
+	if !errored {
+		t.Errorf("Expected must to panic with an error")
+	}
 }
 
 func TestFuncHandler(t *testing.T) {
@@ -0,0 +1,701 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/dustin/gomemcached"
+)
+
+// TapChange is an item or a change to one, as streamed by a
+// TapProducer.
+type TapChange struct {
+	Key     string
+	VBucket uint16
+	gomemcached.MCItem
+	// When the item was last changed, in unix seconds.  Compared
+	// with the BACKFILL time.
+	Mtime   int64
+	Deleted bool
+	// If true, everything was deleted and the other fields are
+	// unused.
+	Flushed bool
+}
+
+// TapSource is a store that can be streamed by a TapProducer.
+type TapSource interface {
+	// TapWatch returns the current items and a channel of every
+	// change made after them.  The channel is closed if its reader
+	// falls too far behind.  Call stop when finished with it.
+	TapWatch() (items []TapChange, changes <-chan TapChange, stop func())
+}
+
+// Defaults for a TapProducer.
+const (
+	DefaultTapAckInterval    = 10
+	DefaultTapCheckpointSize = 100
+	DefaultTapLogSize        = 1000
+)
+
+// TapProducer answers TAP_CONNECT with a feed of a TapSource's items
+// and changes.  Other requests get UNKNOWN_COMMAND, so a
+// RequestHandler can pass it just the TAP_CONNECTs.
+//
+// The stream takes over the connection until the client hangs up,
+// the source drops it, or Done is closed.  Hangups between changes
+// are only noticed if the handler's io.Writer is also an io.Reader,
+// which must then be the reader the connection's requests come from,
+// as with HandleIO and HandleAnyIO.  Since the stream may have read
+// past its end, it always ends with a Fatal response, so the
+// connection is closed as memcached does.
+//
+// From the first TAP_CONNECT until Done is closed, the producer
+// watches the source and keeps the last LogSize changes to each
+// vbucket, so a client resuming from a checkpoint is sent what it
+// missed.  Clients resuming from a checkpoint that is no longer kept
+// are backfilled instead.  Checkpoint ids only mean something to the
+// producer that sent them.
+type TapProducer struct {
+	Source TapSource
+	// With SUPPORT_ACK, ask for an ack every AckInterval packets.
+	// Acks can only be read if the handler's io.Writer is also an
+	// io.Reader.
+	AckInterval int
+	// Start a new checkpoint after this many changes to a vbucket.
+	CheckpointSize int
+	// How many changes to keep for each vbucket.
+	LogSize int
+	// Closing Done ends all streams and stops watching the source.
+	Done <-chan bool
+
+	mu      sync.Mutex
+	seq     uint64
+	items   map[string]TapChange
+	logs    map[uint16]*tapLog
+	streams map[chan tapEntry]bool
+	// Where each REGISTERED_CLIENT would resume each vbucket.
+	registered map[string]map[uint16]uint64
+}
+
+// NewTapProducer makes a TapProducer with default settings.
+func NewTapProducer(src TapSource) *TapProducer {
+	return &TapProducer{
+		Source:         src,
+		AckInterval:    DefaultTapAckInterval,
+		CheckpointSize: DefaultTapCheckpointSize,
+		LogSize:        DefaultTapLogSize,
+	}
+}
+
+// The TTL of TAP packets we send.
+const tapTTL = 255
+
+// How many changes a stream may fall behind before it's dropped.
+const tapStreamBuffer = 1024
+
+// tapEntry is a change as logged by a TapProducer.
+type tapEntry struct {
+	TapChange
+	seq        uint64 // order among all changes
+	checkpoint uint64
+	closes     bool // the last change in its checkpoint
+}
+
+// tapLog is the recent history of a vbucket.
+type tapLog struct {
+	entries []tapEntry
+	current uint64 // the open checkpoint
+	size    int    // changes in the open checkpoint
+	oldest  uint64 // the oldest checkpoint still kept whole
+	flushed uint64 // the first checkpoint after the last flush
+	// Checkpoints that were backfills rather than changes.
+	snapshots map[uint64]bool
+}
+
+func newTapLog(first uint64) *tapLog {
+	if first == 0 {
+		first = 1
+	}
+	return &tapLog{
+		current:   first,
+		oldest:    first,
+		snapshots: map[uint64]bool{},
+	}
+}
+
+// rotate ends the open checkpoint, unless it's empty.
+func (l *tapLog) rotate() {
+	if l.size > 0 {
+		l.current++
+		l.size = 0
+	}
+}
+
+// forget makes everything before the open checkpoint unreplayable.
+func (l *tapLog) forget() {
+	l.rotate()
+	l.entries = nil
+	l.oldest = l.current
+}
+
+func (l *tapLog) add(e tapEntry, checkpointSize, logSize int) tapEntry {
+	e.checkpoint = l.current
+	l.size++
+	if checkpointSize > 0 && l.size >= checkpointSize {
+		e.closes = true
+		l.current++
+		l.size = 0
+	}
+	l.entries = append(l.entries, e)
+	for len(l.entries) > logSize {
+		if l.entries[0].checkpoint >= l.oldest {
+			l.oldest = l.entries[0].checkpoint + 1
+		}
+		l.entries = l.entries[1:]
+	}
+	for id := range l.snapshots {
+		if id < l.oldest {
+			delete(l.snapshots, id)
+		}
+	}
+	return e
+}
+
+// snapshot returns the checkpoint a backfill of the vbucket's current
+// items should be sent as, numbered no lower than atLeast.
+func (l *tapLog) snapshot(atLeast uint64) uint64 {
+	if l.size == 0 && l.current > l.oldest && l.current-1 >= atLeast &&
+		l.snapshots[l.current-1] {
+		// Nothing has changed since the last one.
+		return l.current - 1
+	}
+	l.rotate()
+	if l.current < atLeast {
+		l.current = atLeast
+	}
+	id := l.current
+	l.snapshots[id] = true
+	l.current++
+	return id
+}
+
+// replay returns the changes from the start of a checkpoint, if
+// they're all still kept.
+func (l *tapLog) replay(from uint64) ([]tapEntry, bool) {
+	if from < l.oldest || from > l.current || l.snapshots[from] {
+		return nil, false
+	}
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].checkpoint >= from
+	})
+	return append([]tapEntry{}, l.entries[i:]...), true
+}
+
+// Must be called with p.mu held.
+func (p *TapProducer) log(vb uint16, first uint64) *tapLog {
+	l := p.logs[vb]
+	if l == nil {
+		l = newTapLog(first)
+		p.logs[vb] = l
+	}
+	return l
+}
+
+// Must be called with p.mu held.
+func (p *TapProducer) watch() {
+	if p.logs != nil {
+		return
+	}
+	p.logs = map[uint16]*tapLog{}
+	p.streams = map[chan tapEntry]bool{}
+	p.registered = map[string]map[uint16]uint64{}
+	items, changes, stop := p.Source.TapWatch()
+	p.reset(items)
+	go p.record(changes, stop)
+}
+
+// reset replaces the items after changes may have been missed.  Must
+// be called with p.mu held.
+func (p *TapProducer) reset(items []TapChange) {
+	p.items = map[string]TapChange{}
+	for _, c := range items {
+		p.items[c.Key] = c
+	}
+	for _, l := range p.logs {
+		l.forget()
+	}
+	for ch := range p.streams {
+		p.unsubscribe(ch)
+	}
+}
+
+// record logs the source's changes until Done is closed.
+func (p *TapProducer) record(changes <-chan TapChange, stop func()) {
+	for {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				// We fell too far behind; start again.
+				stop()
+				var items []TapChange
+				items, changes, stop = p.Source.TapWatch()
+				p.mu.Lock()
+				p.reset(items)
+				p.mu.Unlock()
+				continue
+			}
+			p.mu.Lock()
+			p.add(c)
+			p.mu.Unlock()
+		case <-p.Done:
+			stop()
+			return
+		}
+	}
+}
+
+// Must be called with p.mu held.
+func (p *TapProducer) add(c TapChange) {
+	p.seq++
+	e := tapEntry{TapChange: c, seq: p.seq}
+	switch {
+	case c.Flushed:
+		p.items = map[string]TapChange{}
+		for _, l := range p.logs {
+			l.forget()
+			l.flushed = l.current
+		}
+	default:
+		if c.Deleted {
+			delete(p.items, c.Key)
+		} else {
+			p.items[c.Key] = c
+		}
+		logSize := p.LogSize
+		if logSize <= 0 {
+			logSize = DefaultTapLogSize
+		}
+		e = p.log(c.VBucket, 1).add(e, p.CheckpointSize, logSize)
+	}
+	for ch := range p.streams {
+		select {
+		case ch <- e:
+		default:
+			p.unsubscribe(ch)
+		}
+	}
+}
+
+// Must be called with p.mu held.
+func (p *TapProducer) unsubscribe(ch chan tapEntry) {
+	if p.streams[ch] {
+		delete(p.streams, ch)
+		close(ch)
+	}
+}
+
+// tapStream is the state of one TAP_CONNECT.
+type tapStream struct {
+	p        *TapProducer
+	w        io.Writer
+	keysOnly bool
+	name     string // if registered
+
+	seq      uint32 // opaque of the last packet
+	sinceAck int
+	acking   bool
+	acks     chan *gomemcached.MCResponse // nil if we can't read
+	stop     chan bool
+
+	checkpoint bool
+	open       map[uint16]uint64 // open checkpoint per vbucket
+}
+
+// send writes a packet, waiting for an ack if it asks for one.
+func (s *tapStream) send(pkt *gomemcached.MCRequest) bool {
+	s.seq++
+	pkt.Opaque = s.seq
+	needAck := false
+	if s.acking && len(pkt.Extras) >= 4 {
+		s.sinceAck++
+		if s.sinceAck >= s.p.AckInterval {
+			s.sinceAck = 0
+			needAck = true
+			flags := binary.BigEndian.Uint16(pkt.Extras[2:])
+			binary.BigEndian.PutUint16(pkt.Extras[2:], flags|gomemcached.TAP_ACK)
+		}
+	}
+	if _, err := pkt.Transmit(s.w); err != nil {
+		return false
+	}
+	if !needAck {
+		return true
+	}
+
+	for {
+		select {
+		case res, ok := <-s.acks:
+			if !ok || res.Status != gomemcached.SUCCESS {
+				return false
+			}
+			if res.Opaque == pkt.Opaque {
+				return true
+			}
+		case <-s.p.Done:
+			return false
+		}
+	}
+}
+
+// readAcks delivers the client's acks until the connection fails or
+// the stream stops.
+func (s *tapStream) readAcks(r io.Reader) {
+	defer close(s.acks)
+	for {
+		res := &gomemcached.MCResponse{}
+		if _, err := res.Receive(r, nil); err != nil {
+			return
+		}
+		select {
+		case s.acks <- res:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *tapStream) opaque(vb uint16, op uint32) bool {
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_OPAQUE,
+		VBucket: vb,
+		Extras:  make([]byte, 12),
+	}
+	pkt.Extras[4] = tapTTL
+	binary.BigEndian.PutUint32(pkt.Extras[8:], op)
+	return s.send(pkt)
+}
+
+// mark opens or ends a checkpoint, telling the client if it asked.
+func (s *tapStream) mark(op gomemcached.CommandCode, vb uint16, id uint64) bool {
+	next := id
+	if op == gomemcached.TAP_CHECKPOINT_START {
+		s.open[vb] = id
+	} else {
+		delete(s.open, vb)
+		next++
+	}
+	if s.name != "" {
+		s.p.mu.Lock()
+		s.p.registered[s.name][vb] = next
+		s.p.mu.Unlock()
+	}
+	if !s.checkpoint {
+		return true
+	}
+
+	pkt := &gomemcached.MCRequest{
+		Opcode:  op,
+		VBucket: vb,
+		Extras:  make([]byte, 8),
+		Body:    make([]byte, 8),
+	}
+	pkt.Extras[4] = tapTTL
+	binary.BigEndian.PutUint64(pkt.Body, id)
+	return s.send(pkt)
+}
+
+// entry sends a logged change, moving to its checkpoint first.
+func (s *tapStream) entry(e tapEntry) bool {
+	if e.Flushed {
+		return s.item(e.TapChange)
+	}
+	vb := e.VBucket
+	if id, ok := s.open[vb]; ok && id != e.checkpoint {
+		if !s.mark(gomemcached.TAP_CHECKPOINT_END, vb, id) {
+			return false
+		}
+	}
+	if id, ok := s.open[vb]; !ok || id != e.checkpoint {
+		if !s.mark(gomemcached.TAP_CHECKPOINT_START, vb, e.checkpoint) {
+			return false
+		}
+	}
+	if !s.item(e.TapChange) {
+		return false
+	}
+	if e.closes {
+		return s.mark(gomemcached.TAP_CHECKPOINT_END, vb, e.checkpoint)
+	}
+	return true
+}
+
+// item sends a change.
+func (s *tapStream) item(c TapChange) bool {
+	if c.Flushed {
+		pkt := &gomemcached.MCRequest{
+			Opcode: gomemcached.TAP_FLUSH,
+			Extras: make([]byte, 8),
+		}
+		pkt.Extras[4] = tapTTL
+		return s.send(pkt)
+	}
+
+	pkt := &gomemcached.MCRequest{
+		Opcode:  gomemcached.TAP_MUTATION,
+		VBucket: c.VBucket,
+		Cas:     c.Cas,
+		Key:     []byte(c.Key),
+		Extras:  make([]byte, 16),
+		Body:    c.Data,
+	}
+	pkt.Extras[4] = tapTTL
+	if c.Deleted {
+		pkt.Opcode = gomemcached.TAP_DELETE
+		pkt.Extras = pkt.Extras[:8]
+		pkt.Body = nil
+	} else {
+		binary.BigEndian.PutUint32(pkt.Extras[8:], c.Flags)
+		binary.BigEndian.PutUint32(pkt.Extras[12:], c.Expiration)
+	}
+	if s.keysOnly {
+		binary.BigEndian.PutUint16(pkt.Extras[2:], gomemcached.TAP_NO_VALUE)
+		pkt.Body = nil
+	}
+	return s.send(pkt)
+}
+
+// tapBackfill is a vbucket's items, sent as one checkpoint.
+type tapBackfill struct {
+	vb         uint16
+	checkpoint uint64
+	items      []TapChange
+}
+
+// tapPlan is what a stream sends before its live changes.
+type tapPlan struct {
+	flush     bool
+	backfills []tapBackfill
+	replay    []tapEntry
+	live      chan tapEntry
+}
+
+// plan works out what a new stream must send, and subscribes it to
+// changes from then on.
+func (p *TapProducer) plan(wanted func(uint16) bool, since uint64,
+	backfill, dump bool, resume map[uint16]uint64, name string) tapPlan {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.watch()
+
+	if name != "" {
+		reg := p.registered[name]
+		if reg == nil {
+			reg = map[uint16]uint64{}
+			p.registered[name] = reg
+		}
+		if resume == nil {
+			resume = map[uint16]uint64{}
+		}
+		for vb, id := range reg {
+			if _, ok := resume[vb]; !ok {
+				resume[vb] = id
+			}
+		}
+	}
+
+	rv := tapPlan{}
+	// Resumed vbuckets that need all their items.
+	fallback := map[uint16]bool{}
+	replays := map[uint16][]tapEntry{}
+	for vb, id := range resume {
+		if !wanted(vb) {
+			continue
+		}
+		l := p.logs[vb]
+		if l == nil {
+			// Carry on numbering from where the client was.
+			p.log(vb, id)
+			fallback[vb] = true
+			continue
+		}
+		if id < l.flushed {
+			rv.flush = true
+		}
+		if es, ok := l.replay(id); ok && !dump {
+			replays[vb] = es
+		} else {
+			fallback[vb] = true
+		}
+	}
+	if rv.flush {
+		// The client's copy of everything is out of date.
+		replays = map[uint16][]tapEntry{}
+		backfill, since = true, 0
+	}
+
+	filled := map[uint16]bool{}
+	for vb := range fallback {
+		filled[vb] = true
+	}
+	byvb := map[uint16][]TapChange{}
+	for _, c := range p.items {
+		if !wanted(c.VBucket) {
+			continue
+		}
+		if _, ok := replays[c.VBucket]; ok {
+			continue
+		}
+		if fallback[c.VBucket] || ((backfill || dump) && uint64(c.Mtime) >= since) {
+			byvb[c.VBucket] = append(byvb[c.VBucket], c)
+			filled[c.VBucket] = true
+		}
+	}
+	vbs := []int{}
+	for vb := range filled {
+		vbs = append(vbs, int(vb))
+	}
+	sort.Ints(vbs)
+	for _, vb := range vbs {
+		cs := byvb[uint16(vb)]
+		sort.Slice(cs, func(i, j int) bool { return cs[i].Key < cs[j].Key })
+		rv.backfills = append(rv.backfills, tapBackfill{
+			vb:         uint16(vb),
+			checkpoint: p.log(uint16(vb), 1).snapshot(resume[uint16(vb)]),
+			items:      cs,
+		})
+	}
+
+	for _, es := range replays {
+		rv.replay = append(rv.replay, es...)
+	}
+	sort.Slice(rv.replay, func(i, j int) bool { return rv.replay[i].seq < rv.replay[j].seq })
+
+	if !dump {
+		rv.live = make(chan tapEntry, tapStreamBuffer)
+		p.streams[rv.live] = true
+	}
+	return rv
+}
+
+// HandleMessage streams the TapSource to a client that sent
+// TAP_CONNECT.
+//
+// A client resuming from a checkpoint is sent the changes since it
+// began, or a backfill of the vbucket if they're no longer kept.  A
+// REGISTERED_CLIENT that doesn't say where to resume a vbucket carries
+// on from the last checkpoint it was sent under the same name.
+func (p *TapProducer) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	if req.Opcode != gomemcached.TAP_CONNECT {
+		return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+	}
+	tc, err := req.ParseTapCommands()
+	if err != nil {
+		return &gomemcached.MCResponse{
+			Status: gomemcached.EINVAL,
+			Body:   []byte(err.Error()),
+		}
+	}
+
+	var vbuckets map[uint16]bool
+	if vbs, ok := tc.Flags[gomemcached.LIST_VBUCKETS].([]uint16); ok {
+		vbuckets = map[uint16]bool{}
+		for _, vb := range vbs {
+			vbuckets[vb] = true
+		}
+	}
+	wanted := func(vb uint16) bool {
+		return vbuckets == nil || vbuckets[vb]
+	}
+	since, backfill := uint64(0), false
+	if v, ok := tc.Flags[gomemcached.BACKFILL].(uint64); ok {
+		since, backfill = v, v != math.MaxUint64
+	}
+	_, dump := tc.Flags[gomemcached.DUMP]
+	_, keysOnly := tc.Flags[gomemcached.REQUEST_KEYS_ONLY]
+	resume, checkpoint := tc.Flags[gomemcached.CHECKPOINT].(map[uint16]uint64)
+	name := ""
+	if _, ok := tc.Flags[gomemcached.REGISTERED_CLIENT]; ok {
+		name = tc.Name
+	}
+
+	s := &tapStream{
+		p:          p,
+		w:          w,
+		keysOnly:   keysOnly,
+		name:       name,
+		stop:       make(chan bool),
+		checkpoint: checkpoint,
+		open:       map[uint16]uint64{},
+	}
+	defer close(s.stop)
+	if r, ok := w.(io.Reader); ok {
+		// Reading also notices when the client hangs up.
+		s.acks = make(chan *gomemcached.MCResponse, 1)
+		go s.readAcks(r)
+		_, ack := tc.Flags[gomemcached.SUPPORT_ACK]
+		s.acking = ack && p.AckInterval > 0
+	}
+
+	plan := p.plan(wanted, since, backfill, dump, resume, name)
+	if plan.live != nil {
+		defer func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.unsubscribe(plan.live)
+		}()
+	}
+	hangup := &gomemcached.MCResponse{Fatal: true}
+
+	if plan.flush && !s.item(TapChange{Flushed: true}) {
+		return hangup
+	}
+	for _, b := range plan.backfills {
+		if !s.opaque(b.vb, gomemcached.TAP_OPAQUE_INITIAL_VBUCKET_STREAM) ||
+			!s.mark(gomemcached.TAP_CHECKPOINT_START, b.vb, b.checkpoint) {
+			return hangup
+		}
+		for _, c := range b.items {
+			if !s.item(c) {
+				return hangup
+			}
+		}
+		if !s.mark(gomemcached.TAP_CHECKPOINT_END, b.vb, b.checkpoint) ||
+			!s.opaque(b.vb, gomemcached.TAP_OPAQUE_CLOSE_BACKFILL) {
+			return hangup
+		}
+	}
+
+	if dump {
+		s.opaque(0, gomemcached.TAP_OPAQUE_CLOSE_TAP_STREAM)
+		return hangup
+	}
+
+	for _, e := range plan.replay {
+		if !s.entry(e) {
+			return hangup
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-plan.live:
+			if !ok {
+				// We fell too far behind.
+				return hangup
+			}
+			if (e.Flushed || wanted(e.VBucket)) && !s.entry(e) {
+				return hangup
+			}
+		case _, ok := <-s.acks:
+			if !ok {
+				return hangup
+			}
+		case <-p.Done:
+			return hangup
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package memcached
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/gomemcached"
+	mcclient "github.com/dustin/gomemcached/client"
+)
+
+type fakeTapSource struct {
+	items   []TapChange
+	changes chan TapChange
+	stopped chan bool
+}
+
+func newFakeTapSource(items ...TapChange) *fakeTapSource {
+	return &fakeTapSource{
+		items:   items,
+		changes: make(chan TapChange),
+		stopped: make(chan bool),
+	}
+}
+
+func (f *fakeTapSource) TapWatch() ([]TapChange, <-chan TapChange, func()) {
+	return f.items, f.changes, func() { close(f.stopped) }
+}
+
+func startTap(t *testing.T, p *TapProducer, args mcclient.TapArguments) *mcclient.TapFeed {
+	cli, srv := net.Pipe()
+	go HandleIO(srv, p)
+	c, err := mcclient.Wrap(cli)
+	if err != nil {
+		t.Fatalf("Error wrapping: %v", err)
+	}
+	feed, err := c.StartTapFeed(args)
+	if err != nil {
+		t.Fatalf("Error starting feed: %v", err)
+	}
+	return feed
+}
+
+func tapEvents(t *testing.T, feed *mcclient.TapFeed, n int) []mcclient.TapEvent {
+	rv := []mcclient.TapEvent{}
+	for len(rv) < n {
+		select {
+		case e, ok := <-feed.C:
+			if !ok {
+				return rv
+			}
+			rv = append(rv, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %v", rv)
+		}
+	}
+	return rv
+}
+
+func expectTapEvents(t *testing.T, got []mcclient.TapEvent, exp []string) {
+	if len(got) != len(exp) {
+		t.Fatalf("Expected %v, got %v", exp, got)
+	}
+	for i := range exp {
+		if s := got[i].Opcode.String() + ":" + string(got[i].Key); s != exp[i] {
+			t.Fatalf("Expected %v at %v, got %v", exp[i], i, got)
+		}
+	}
+}
+
+func TestTapProducerDump(t *testing.T) {
+	src := newFakeTapSource(
+		TapChange{Key: "b", VBucket: 1, MCItem: gomemcached.MCItem{Data: []byte("B")}},
+		TapChange{Key: "a", VBucket: 1, MCItem: gomemcached.MCItem{Data: []byte("A")}},
+		TapChange{Key: "c", VBucket: 2},
+	)
+	done := make(chan bool)
+	p := NewTapProducer(src)
+	p.CheckpointSize = 2
+	p.Done = done
+
+	args := mcclient.DefaultTapArguments()
+	args.Backfill = 0
+	args.Dump = true
+	args.KeysOnly = true
+	args.Checkpoint = true
+	args.Checkpoints = map[uint16]uint64{1: 5}
+	args.VBuckets = []uint16{1}
+	feed := startTap(t, p, args)
+
+	got := tapEvents(t, feed, 100)
+	expectTapEvents(t, got, []string{
+		"BeginBackfill:",
+		"TapCheckpointStart:",
+		"Mutation:a",
+		"Mutation:b",
+		"TapCheckpointEnd:",
+		"EndBackfill:",
+	})
+	if got[1].Checkpoint != 5 || got[4].Checkpoint != 5 {
+		t.Errorf("Expected to resume at checkpoint 5, got %v and %v", got[1], got[4])
+	}
+	for _, e := range got[2:4] {
+		if e.TapFlags&gomemcached.TAP_NO_VALUE == 0 || len(e.Value) != 0 || e.TTL != tapTTL {
+			t.Errorf("Expected a keys only event, got %#v", e)
+		}
+	}
+	if feed.Error != nil {
+		t.Errorf("Expected a clean end, got %v", feed.Error)
+	}
+	close(done)
+	<-src.stopped
+}
+
+func TestTapProducerResume(t *testing.T) {
+	src := newFakeTapSource(TapChange{Key: "a", Mtime: 10})
+	done := make(chan bool)
+	defer close(done)
+	p := NewTapProducer(src)
+	p.CheckpointSize = 2
+	p.LogSize = 3
+	p.Done = done
+
+	change := func(keys ...string) {
+		for _, k := range keys {
+			src.changes <- TapChange{Key: k}
+		}
+	}
+	expectCheckpoints := func(got []mcclient.TapEvent, exp ...uint64) {
+		ids := []uint64{}
+		for _, e := range got {
+			if e.Opcode == mcclient.TapCheckpointStart || e.Opcode == mcclient.TapCheckpointEnd {
+				ids = append(ids, e.Checkpoint)
+			}
+		}
+		if !reflect.DeepEqual(ids, exp) {
+			t.Fatalf("Expected checkpoints %v, got %v in %v", exp, ids, got)
+		}
+	}
+
+	args := mcclient.DefaultTapArguments()
+	args.Backfill = 1
+	args.Checkpoint = true
+	args.RegisteredClient = true
+	args.ClientName = "r"
+	feed := startTap(t, p, args)
+	go change("b", "c", "d")
+	got := tapEvents(t, feed, 11)
+	expectTapEvents(t, got, []string{
+		"BeginBackfill:",
+		"TapCheckpointStart:",
+		"Mutation:a",
+		"TapCheckpointEnd:",
+		"EndBackfill:",
+		"TapCheckpointStart:",
+		"Mutation:b",
+		"Mutation:c",
+		"TapCheckpointEnd:",
+		"TapCheckpointStart:",
+		"Mutation:d",
+	})
+	expectCheckpoints(got, 1, 1, 2, 2, 3)
+	feed.Close()
+
+	// Missed while disconnected.
+	change("e", "f")
+
+	args.Backfill = 0
+	args.Checkpoints = map[uint16]uint64{0: 3}
+	feed = startTap(t, p, args)
+	got = tapEvents(t, feed, 6)
+	expectTapEvents(t, got, []string{
+		"TapCheckpointStart:",
+		"Mutation:d",
+		"Mutation:e",
+		"TapCheckpointEnd:",
+		"TapCheckpointStart:",
+		"Mutation:f",
+	})
+	expectCheckpoints(got, 3, 3, 4)
+	feed.Close()
+
+	// The registered client carries on where it was.
+	args.Checkpoints = nil
+	feed = startTap(t, p, args)
+	got = tapEvents(t, feed, 2)
+	expectTapEvents(t, got, []string{"TapCheckpointStart:", "Mutation:f"})
+	expectCheckpoints(got, 4)
+	feed.Close()
+
+	// Checkpoint 2 is no longer kept, so we get a backfill.
+	args.Checkpoints = map[uint16]uint64{0: 2}
+	feed = startTap(t, p, args)
+	got = tapEvents(t, feed, 10)
+	expectTapEvents(t, got, []string{
+		"BeginBackfill:",
+		"TapCheckpointStart:",
+		"Mutation:a",
+		"Mutation:b",
+		"Mutation:c",
+		"Mutation:d",
+		"Mutation:e",
+		"Mutation:f",
+		"TapCheckpointEnd:",
+		"EndBackfill:",
+	})
+	expectCheckpoints(got, 5, 5)
+	feed.Close()
+}
+
+func TestTapProducerLive(t *testing.T) {
+	src := newFakeTapSource(
+		TapChange{Key: "old", Mtime: 50},
+		TapChange{Key: "new", Mtime: 150, MCItem: gomemcached.MCItem{Flags: 3, Data: []byte("N")}},
+	)
+	done := make(chan bool)
+	p := NewTapProducer(src)
+	p.AckInterval = 2
+	p.Done = done
+
+	args := mcclient.DefaultTapArguments()
+	args.Backfill = 100
+	args.SupportAck = true
+	feed := startTap(t, p, args)
+
+	go func() {
+		src.changes <- TapChange{Key: "x", MCItem: gomemcached.MCItem{Data: []byte("X")}}
+		src.changes <- TapChange{Key: "x", Deleted: true}
+		src.changes <- TapChange{Flushed: true}
+	}()
+
+	got := tapEvents(t, feed, 6)
+	expectTapEvents(t, got, []string{
+		"BeginBackfill:",
+		"Mutation:new",
+		"EndBackfill:",
+		"Mutation:x",
+		"Deletion:x",
+		"Flush:",
+	})
+	if got[1].Flags != 3 || string(got[1].Value) != "N" {
+		t.Errorf("Expected the item's flags and value, got %#v", got[1])
+	}
+	for i, e := range got {
+		acked := e.TapFlags&gomemcached.TAP_ACK != 0
+		if acked != (i%2 == 1) {
+			t.Errorf("Expected every second packet to ask for an ack, got %v at %v",
+				e.TapFlags, i)
+		}
+	}
+
+	close(done)
+	<-src.stopped
+}
+
+func TestTapProducerOtherCommands(t *testing.T) {
+	p := NewTapProducer(newFakeTapSource())
+	res := p.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.GET})
+	if res.Status != gomemcached.UNKNOWN_COMMAND {
+		t.Errorf("Expected UNKNOWN_COMMAND, got %v", res)
+	}
+	res = p.HandleMessage(nil, &gomemcached.MCRequest{Opcode: gomemcached.TAP_CONNECT})
+	if res.Status != gomemcached.EINVAL {
+		t.Errorf("Expected EINVAL for a connect without flags, got %v", res)
+	}
+}
+
+func TestTapProducerBufferedAcks(t *testing.T) {
+	src := newFakeTapSource(TapChange{Key: "a"})
+	done := make(chan bool)
+	defer close(done)
+	p := NewTapProducer(src)
+	p.AckInterval = 1
+	p.Done = done
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go HandleAnyIO(srv, p)
+
+	req, err := gomemcached.TapConnect{Flags: map[gomemcached.TapConnectFlag]interface{}{
+		gomemcached.DUMP:        true,
+		gomemcached.SUPPORT_ACK: true,
+	}}.Request()
+	if err != nil {
+		t.Fatalf("Error making request: %v", err)
+	}
+	// Acks sent along with the connect end up in the connection's
+	// read buffer.
+	data := req.Bytes()
+	for i := uint32(1); i <= 4; i++ {
+		data = append(data, (&gomemcached.MCResponse{Opcode: gomemcached.TAP_OPAQUE, Opaque: i}).Bytes()...)
+	}
+	go cli.Write(data)
+
+	ops := []string{}
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		pkt := &gomemcached.MCRequest{}
+		if _, err := pkt.Receive(cli, nil); err != nil {
+			break
+		}
+		ops = append(ops, pkt.Opcode.String())
+	}
+	exp := []string{"TAP_OPAQUE", "TAP_MUTATION", "TAP_OPAQUE", "TAP_OPAQUE"}
+	if !reflect.DeepEqual(ops, exp) {
+		t.Errorf("Expected %v, got %v", exp, ops)
+	}
+}
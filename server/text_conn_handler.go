@@ -0,0 +1,155 @@
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dustin/gomemcached"
+)
+
+// HandleAnyIO is like HandleIO, but also serves clients speaking the
+// text and meta protocols.  The protocol is chosen by the first byte
+// the client sends.
+func HandleAnyIO(s io.ReadWriteCloser, handler RequestHandler) error {
+	defer func() { must(s.Close()) }()
+
+	r := bufio.NewReader(s)
+	b, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case b[0] == gomemcached.REQ_MAGIC, b[0] == gomemcached.ALT_REQ_MAGIC:
+		rw := bufferedConn{r, s}
+		for err == nil {
+			err = HandleMessage(r, rw, handler)
+		}
+	case b[0] >= ' ' && b[0] < 0x7f, b[0] == '\r', b[0] == '\n':
+		for err == nil {
+			err = HandleTextMessage(r, s, handler)
+		}
+	default:
+		err = fmt.Errorf("Bad magic: 0x%02x", b[0])
+	}
+	return err
+}
+
+// bufferedConn writes to a connection, but reads from the buffered
+// reader its requests come from, so a handler that reads the rest of
+// the connection itself, like a TapProducer, doesn't miss anything.
+type bufferedConn struct {
+	io.Reader
+	io.Writer
+}
+
+// HandleTextMessage handles an individual text or meta command,
+// translating it to and from binary requests for the handler.
+//
+// Anything the handler writes to its io.Writer is read back as binary
+// responses for stats, and otherwise discarded.
+func HandleTextMessage(r *bufio.Reader, w io.Writer, handler RequestHandler) error {
+	if gomemcached.IsMetaCommand(r) {
+		return handleMetaMessage(r, w, handler)
+	}
+
+	cmd, err := gomemcached.ReadTextCommand(r)
+	if err != nil {
+		return textError(w, err)
+	}
+
+	res := make([]*gomemcached.MCResponse, 0, len(cmd.Requests))
+	for i := range cmd.Requests {
+		req := &cmd.Requests[i]
+		out := &bytes.Buffer{}
+		rv := handler.HandleMessage(out, req)
+		if rv != nil && rv.Fatal {
+			return io.EOF
+		}
+		if req.Opcode == gomemcached.STAT {
+			written, err := readResponses(out)
+			if err != nil {
+				return err
+			}
+			res = append(res, written...)
+		}
+		if rv != nil {
+			rv.Opcode = req.Opcode
+			rv.Opaque = req.Opaque
+		}
+		res = append(res, rv)
+	}
+	return cmd.WriteResponse(w, res)
+}
+
+// MetaHandler is a RequestHandler that can answer meta commands
+// itself, including those that need state the binary protocol has no
+// room for, such as TTLs and leases.
+type MetaHandler interface {
+	RequestHandler
+	// HandleMeta answers a meta command.  A nil response means
+	// nothing should be sent.
+	HandleMeta(*gomemcached.MetaCommand) *gomemcached.MetaResponse
+}
+
+func handleMetaMessage(r *bufio.Reader, w io.Writer, handler RequestHandler) error {
+	m, err := gomemcached.ReadMetaCommand(r)
+	if err != nil {
+		return textError(w, err)
+	}
+	if mh, ok := handler.(MetaHandler); ok {
+		if mr := mh.HandleMeta(m); mr != nil {
+			_, err = mr.Transmit(w)
+		}
+		return err
+	}
+	if m.NeedsState() {
+		return textError(w, gomemcached.TextClientError("unsupported flag"))
+	}
+	req, err := m.Request()
+	if err != nil {
+		return textError(w, err)
+	}
+
+	rv := handler.HandleMessage(ioutil.Discard, req)
+	if rv != nil && rv.Fatal {
+		return io.EOF
+	}
+	if rv != nil {
+		rv.Opcode = req.Opcode
+		rv.Opaque = req.Opaque
+	}
+	if mr := m.Response(rv); mr != nil {
+		_, err = mr.Transmit(w)
+	}
+	return err
+}
+
+// textError tells the client about a bad command, returning only
+// errors that should end the connection.
+func textError(w io.Writer, err error) error {
+	switch e := err.(type) {
+	case gomemcached.TextClientError:
+		_, err = fmt.Fprintf(w, "CLIENT_ERROR %s\r\n", e)
+	default:
+		if err == gomemcached.ErrUnknownCommand {
+			_, err = io.WriteString(w, "ERROR\r\n")
+		}
+	}
+	return err
+}
+
+func readResponses(r *bytes.Buffer) ([]*gomemcached.MCResponse, error) {
+	rv := []*gomemcached.MCResponse{}
+	for r.Len() > 0 {
+		res := &gomemcached.MCResponse{}
+		if _, err := res.Receive(r, nil); err != nil {
+			return rv, err
+		}
+		rv = append(rv, res)
+	}
+	return rv, nil
+}
@@ -0,0 +1,166 @@
+package memcached
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dustin/gomemcached"
+)
+
+// mapHandler is a tiny in-memory server.
+type mapHandler map[string][]byte
+
+func (m mapHandler) HandleMessage(w io.Writer, req *gomemcached.MCRequest) *gomemcached.MCResponse {
+	switch req.Opcode {
+	case gomemcached.GET, gomemcached.GETQ:
+		v, ok := m[string(req.Key)]
+		if !ok {
+			if req.Opcode == gomemcached.GETQ {
+				return nil
+			}
+			return &gomemcached.MCResponse{Status: gomemcached.KEY_ENOENT}
+		}
+		return &gomemcached.MCResponse{
+			Extras: []byte{0, 0, 0, 0},
+			Body:   v,
+			Cas:    1,
+		}
+	case gomemcached.SET, gomemcached.SETQ:
+		m[string(req.Key)] = req.Body
+		if req.Opcode == gomemcached.SETQ {
+			return nil
+		}
+		return &gomemcached.MCResponse{Cas: 1}
+	case gomemcached.STAT:
+		for _, k := range []string{"a", "b"} {
+			transmitResponse(w, &gomemcached.MCResponse{
+				Opcode: gomemcached.STAT,
+				Key:    []byte(k),
+				Body:   []byte(strings.ToUpper(k)),
+			})
+		}
+		return &gomemcached.MCResponse{}
+	case gomemcached.NOOP:
+		return &gomemcached.MCResponse{}
+	case gomemcached.QUIT:
+		return &gomemcached.MCResponse{Fatal: true}
+	}
+	return &gomemcached.MCResponse{Status: gomemcached.UNKNOWN_COMMAND}
+}
+
+func serveAny(t *testing.T) (net.Conn, chan error) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() { errs <- HandleAnyIO(server, mapHandler{}) }()
+	return client, errs
+}
+
+func TestHandleAnyText(t *testing.T) {
+	c, errs := serveAny(t)
+	defer c.Close()
+
+	in := "set a 0 0 1\r\nA\r\n" +
+		"set b 0 0 1 noreply\r\nB\r\n" +
+		"get a b c\r\n" +
+		"bogus\r\n" +
+		"set a x\r\n" +
+		"stats\r\n" +
+		"ms c 1 q\r\nC\r\n" +
+		"mg c v\r\n" +
+		"mg d v q\r\n" +
+		"mg c t\r\n" +
+		"mn\r\n" +
+		"quit\r\n"
+	go io.WriteString(c, in)
+
+	r := bufio.NewReader(c)
+	for _, exp := range []string{
+		"STORED",
+		"VALUE a 0 1", "A", "VALUE b 0 1", "B", "END",
+		"ERROR",
+		"CLIENT_ERROR bad command line format",
+		"STAT a A", "STAT b B", "END",
+		"VA 1", "C",
+		"CLIENT_ERROR unsupported flag",
+		"MN",
+	} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", exp, err)
+		}
+		if line != exp+"\r\n" {
+			t.Errorf("Expected %q, got %q", exp, line)
+		}
+	}
+
+	if err := <-errs; err != io.EOF {
+		t.Errorf("Expected EOF after quit, got %v", err)
+	}
+}
+
+// metaMapHandler answers meta commands itself.
+type metaMapHandler struct {
+	mapHandler
+}
+
+func (m metaMapHandler) HandleMeta(c *gomemcached.MetaCommand) *gomemcached.MetaResponse {
+	if c.Flags.Has('q') {
+		return nil
+	}
+	return &gomemcached.MetaResponse{Code: "HD", Flags: gomemcached.MetaFlags{{Flag: 't', Token: "5"}}}
+}
+
+func TestHandleAnyMetaHandler(t *testing.T) {
+	c, server := net.Pipe()
+	defer c.Close()
+	go HandleAnyIO(server, metaMapHandler{mapHandler{}})
+
+	go io.WriteString(c, "mg a q\r\nmg a t\r\nget a\r\n")
+	r := bufio.NewReader(c)
+	for _, exp := range []string{"HD t5", "END"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", exp, err)
+		}
+		if line != exp+"\r\n" {
+			t.Errorf("Expected %q, got %q", exp, line)
+		}
+	}
+}
+
+func TestHandleAnyBinary(t *testing.T) {
+	c, errs := serveAny(t)
+	defer c.Close()
+
+	go (&gomemcached.MCRequest{
+		Opcode: gomemcached.GET,
+		Key:    []byte("x"),
+		Opaque: 7,
+	}).Transmit(c)
+
+	res := gomemcached.MCResponse{}
+	if _, err := res.Receive(c, nil); err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if res.Status != gomemcached.KEY_ENOENT || res.Opaque != 7 {
+		t.Errorf("Expected a miss for opaque 7, got %v", res)
+	}
+
+	c.Close()
+	if err := <-errs; err == nil {
+		t.Errorf("Expected an error after hanging up")
+	}
+}
+
+func TestHandleAnyBadMagic(t *testing.T) {
+	c, errs := serveAny(t)
+	defer c.Close()
+
+	go c.Write([]byte{0x81})
+	if err := <-errs; err == nil || err.Error() != "Bad magic: 0x81" {
+		t.Errorf("Expected bad magic, got %v", err)
+	}
+}
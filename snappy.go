@@ -0,0 +1,190 @@
+package gomemcached
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Snappy block format docs:
+// <https://github.com/google/snappy/blob/main/format_description.txt>
+
+// ErrCorruptSnappy is returned when decoding invalid snappy data.
+var ErrCorruptSnappy = errors.New("corrupt snappy data")
+
+const (
+	snappyLiteral = 0x00
+	snappyCopy1   = 0x01
+	snappyCopy2   = 0x02
+	snappyCopy4   = 0x03
+
+	snappyTableBits = 14
+	snappyMaxOffset = 1<<16 - 1
+)
+
+func snappyLoad32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i:])
+}
+
+func snappyHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyLiteral, byte(n), byte(n>>8),
+			byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyLiteral, byte(n), byte(n>>8),
+			byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyCopy2,
+			byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyCopy1,
+		byte(offset))
+}
+
+// SnappyEncode compresses src in the snappy block format.
+func SnappyEncode(src []byte) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, len(src)+len(src)/6+32)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+
+	var table [1 << snappyTableBits]int32
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		v := snappyLoad32(src, i)
+		h := snappyHash(v)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || i-cand > snappyMaxOffset || snappyLoad32(src, cand) != v {
+			i++
+			continue
+		}
+
+		if lit < i {
+			dst = snappyEmitLiteral(dst, src[lit:i])
+		}
+		length := 4
+		for i+length < len(src) && src[cand+length] == src[i+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, i-cand, length)
+		i += length
+		lit = i
+	}
+	if lit < len(src) {
+		dst = snappyEmitLiteral(dst, src[lit:])
+	}
+	return dst
+}
+
+// SnappyDecodedLen is the length src will have once decoded.
+func SnappyDecodedLen(src []byte) (int, error) {
+	n, hdr := binary.Uvarint(src)
+	if hdr <= 0 || n > 1<<32-1 {
+		return 0, ErrCorruptSnappy
+	}
+	if n > uint64(MaxBodyLen) {
+		return 0, fmt.Errorf("%d is too big (max %d)", n, MaxBodyLen)
+	}
+	return int(n), nil
+}
+
+// SnappyDecode decompresses snappy block format data.
+func SnappyDecode(src []byte) ([]byte, error) {
+	dlen, err := SnappyDecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	_, hdr := binary.Uvarint(src)
+	src = src[hdr:]
+	dst := make([]byte, 0, dlen)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, length int
+		switch tag & 0x03 {
+		case snappyLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, ErrCorruptSnappy
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || len(dst)+length > dlen {
+				return nil, ErrCorruptSnappy
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+
+		case snappyCopy1:
+			if len(src) < 2 {
+				return nil, ErrCorruptSnappy
+			}
+			length = 4 + int(tag>>2)&0x07
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+
+		case snappyCopy2:
+			if len(src) < 3 {
+				return nil, ErrCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+
+		case snappyCopy4:
+			if len(src) < 5 {
+				return nil, ErrCorruptSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+length > dlen {
+			return nil, ErrCorruptSnappy
+		}
+		// Copies may overlap what they're producing.
+		start := len(dst) - offset
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != dlen {
+		return nil, ErrCorruptSnappy
+	}
+	return dst, nil
+}
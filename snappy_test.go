@@ -0,0 +1,86 @@
+package gomemcached
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSnappyDecodeSpec(t *testing.T) {
+	// A literal "abcde" and a one byte offset copy of it.
+	in := []byte{0x0a, 0x10, 'a', 'b', 'c', 'd', 'e', 0x05, 0x05}
+	got, err := SnappyDecode(in)
+	if err != nil || string(got) != "abcdeabcde" {
+		t.Errorf("Expected abcdeabcde, got %q/%v", got, err)
+	}
+
+	// An overlapping copy repeats the tail.
+	in = []byte{0x08, 0x00, 'x', 0x0d, 0x01}
+	got, err = SnappyDecode(in)
+	if err != nil || string(got) != "xxxxxxxx" {
+		t.Errorf("Expected xxxxxxxx, got %q/%v", got, err)
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+	random := make([]byte, 100000)
+	r.Read(random)
+
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcd"),
+		[]byte(strings.Repeat("hello, world ", 1000)),
+		[]byte(strings.Repeat("x", 70000)),
+		random,
+		append(append([]byte{}, random[:5000]...), random[:5000]...),
+	}
+	for _, in := range inputs {
+		enc := SnappyEncode(in)
+		got, err := SnappyDecode(enc)
+		if err != nil {
+			t.Errorf("Error decoding %d bytes: %v", len(in), err)
+			continue
+		}
+		if !bytes.Equal(got, in) {
+			t.Errorf("Round trip of %d bytes failed", len(in))
+		}
+	}
+
+	in := []byte(strings.Repeat("hello, world ", 1000))
+	if enc := SnappyEncode(in); len(enc) > len(in)/10 {
+		t.Errorf("Expected good compression, got %d -> %d", len(in), len(enc))
+	}
+}
+
+func TestSnappyDecodeCorrupt(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0x05, 0x10, 'a'}, // short literal
+		{0x0a, 0x10, 'a', 'b', 'c', 'd', 'e', 0x05, 0x06}, // offset too far
+		{0x0a, 0x00, 'a', 0x05},                           // short copy
+		{0x03, 0x00, 'a'},                                 // short output
+		{0x01, 0x04, 'a', 'b'},                            // long output
+	}
+	for _, in := range inputs {
+		if got, err := SnappyDecode(in); err == nil {
+			t.Errorf("Expected an error decoding %v, got %q", in, got)
+		}
+	}
+
+	defer func(n int) { MaxBodyLen = n }(MaxBodyLen)
+	MaxBodyLen = 10
+	if _, err := SnappyDecode(SnappyEncode(make([]byte, 11))); err == nil {
+		t.Errorf("Expected an error decoding more than MaxBodyLen")
+	}
+}
+
+func BenchmarkSnappyEncode(b *testing.B) {
+	in := []byte(strings.Repeat("hello, world ", 1000))
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		SnappyEncode(in)
+	}
+}
@@ -0,0 +1,33 @@
+package gomemcached
+
+// SubdocFlag modifies a single subdoc path operation.
+type SubdocFlag uint8
+
+// Subdoc path flags
+const (
+	SUBDOC_FLAG_MKDIR_P       = SubdocFlag(0x01) // Create missing parents
+	SUBDOC_FLAG_XATTR         = SubdocFlag(0x04) // The path is in the extended attributes
+	SUBDOC_FLAG_EXPAND_MACROS = SubdocFlag(0x10) // Expand macros like ${Mutation.CAS}
+)
+
+// SubdocDocFlag modifies how a subdoc request treats the document.
+type SubdocDocFlag uint8
+
+// Subdoc document flags
+const (
+	SUBDOC_DOC_MKDOC          = SubdocDocFlag(0x01) // Create the document if missing
+	SUBDOC_DOC_ADD            = SubdocDocFlag(0x02) // Fail if the document exists
+	SUBDOC_DOC_ACCESS_DELETED = SubdocDocFlag(0x04) // Operate on deleted documents
+)
+
+// IsSubdocMutation is true for subdoc opcodes that change a document.
+func (o CommandCode) IsSubdocMutation() bool {
+	switch o {
+	case SUBDOC_DICT_ADD, SUBDOC_DICT_UPSERT, SUBDOC_DELETE,
+		SUBDOC_REPLACE, SUBDOC_ARRAY_PUSH_LAST, SUBDOC_ARRAY_PUSH_FIRST,
+		SUBDOC_ARRAY_INSERT, SUBDOC_ARRAY_ADD_UNIQUE, SUBDOC_COUNTER,
+		SUBDOC_MULTI_MUTATION:
+		return true
+	}
+	return false
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"sort"
 	"strings"
 )
 
@@ -90,9 +92,116 @@ func TapParseVBList(r io.Reader) (interface{}, error) {
 	return rv, err
 }
 
+// TapParseCheckpoints parses a list of vbucket checkpoints to resume
+// from into a map[uint16]uint64.  A missing list is empty, as older
+// clients only sent one when they had checkpoints.
+func TapParseCheckpoints(r io.Reader) (interface{}, error) {
+	num, err := TapParseUint16(r)
+	if err == io.EOF {
+		return map[uint16]uint64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := int(num.(uint16))
+
+	rv := make(map[uint16]uint64, n)
+	for i := 0; i < n; i++ {
+		vb, err := TapParseUint16(r)
+		if err != nil {
+			return nil, err
+		}
+		id, err := TapParseUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		rv[vb.(uint16)] = id.(uint64)
+	}
+
+	return rv, nil
+}
+
 var TapFlagParsers = map[TapConnectFlag]TapItemParser{
 	BACKFILL:      TapParseUint64,
 	LIST_VBUCKETS: TapParseVBList,
+	CHECKPOINT:    TapParseCheckpoints,
+}
+
+// A function to encode a single tap extra
+type TapItemEncoder func(io.Writer, interface{}) error
+
+func tapEncodeError(want string, v interface{}) error {
+	return fmt.Errorf("expected %v, got %T", want, v)
+}
+
+func TapEncodeUint64(w io.Writer, v interface{}) error {
+	x, ok := v.(uint64)
+	if !ok {
+		return tapEncodeError("uint64", v)
+	}
+	return binary.Write(w, binary.BigEndian, x)
+}
+
+func TapEncodeUint16(w io.Writer, v interface{}) error {
+	x, ok := v.(uint16)
+	if !ok {
+		return tapEncodeError("uint16", v)
+	}
+	return binary.Write(w, binary.BigEndian, x)
+}
+
+func TapEncodeBool(w io.Writer, v interface{}) error {
+	return nil
+}
+
+func TapEncodeVBList(w io.Writer, v interface{}) error {
+	vbs, ok := v.([]uint16)
+	if !ok {
+		return tapEncodeError("[]uint16", v)
+	}
+	if len(vbs) > math.MaxUint16 {
+		return fmt.Errorf("too many vbuckets: %v", len(vbs))
+	}
+	if err := binary.Write(w, binary.BigEndian, uint16(len(vbs))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, vbs)
+}
+
+// TapEncodeCheckpoints writes a map[uint16]uint64 of checkpoints in
+// vbucket order.
+func TapEncodeCheckpoints(w io.Writer, v interface{}) error {
+	cps, ok := v.(map[uint16]uint64)
+	if !ok {
+		return tapEncodeError("map[uint16]uint64", v)
+	}
+	if len(cps) > math.MaxUint16 {
+		return fmt.Errorf("too many checkpoints: %v", len(cps))
+	}
+	vbs := make([]int, 0, len(cps))
+	for vb := range cps {
+		vbs = append(vbs, int(vb))
+	}
+	sort.Ints(vbs)
+
+	if err := binary.Write(w, binary.BigEndian, uint16(len(vbs))); err != nil {
+		return err
+	}
+	for _, vb := range vbs {
+		if err := binary.Write(w, binary.BigEndian, uint16(vb)); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, cps[uint16(vb)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var TapFlagEncoders = map[TapConnectFlag]TapItemEncoder{
+	BACKFILL:      TapEncodeUint64,
+	LIST_VBUCKETS: TapEncodeVBList,
+	CHECKPOINT:    TapEncodeCheckpoints,
 }
 
 // Split the ORed flags into the individual bit flags.
@@ -159,3 +268,34 @@ func (req *MCRequest) ParseTapCommands() (TapConnect, error) {
 
 	return rv, err
 }
+
+// Build the TAP_CONNECT request for these settings.  Flags are
+// encoded in bit order with TapFlagEncoders, followed by the
+// RemainingBody.
+func (tc TapConnect) Request() (*MCRequest, error) {
+	var flags TapConnectFlag
+	for f := range tc.Flags {
+		flags |= f
+	}
+
+	buf := &bytes.Buffer{}
+	for _, f := range flags.SplitFlags() {
+		fun := TapFlagEncoders[f]
+		if fun == nil {
+			fun = TapEncodeBool
+		}
+		if err := fun(buf, tc.Flags[f]); err != nil {
+			return nil, fmt.Errorf("encoding %v: %v", f, err)
+		}
+	}
+	buf.Write(tc.RemainingBody)
+
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, uint32(flags))
+	return &MCRequest{
+		Opcode: TAP_CONNECT,
+		Key:    []byte(tc.Name),
+		Extras: extras,
+		Body:   buf.Bytes(),
+	}, nil
+}
@@ -159,3 +159,119 @@ func TestParseTapCommands(t *testing.T) {
 			c.Flags[LIST_VBUCKETS])
 	}
 }
+
+func TestTapParseCheckpoints(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		exp  interface{}
+		errs bool
+	}{
+		{[]byte{}, map[uint16]uint64{}, false},
+		{[]byte{0}, nil, true},
+		{[]byte{0, 0}, map[uint16]uint64{}, false},
+		{[]byte{0, 1, 0, 3}, nil, true},
+		{[]byte{0, 1, 0, 3, 0, 0, 0, 0, 0, 0, 0, 9},
+			map[uint16]uint64{3: 9}, false},
+	}
+
+	for _, x := range tests {
+		got, err := TapParseCheckpoints(bytes.NewReader(x.in))
+		if (err != nil) != x.errs {
+			t.Errorf("Error fail, got %v on %v", err, x)
+		} else if !x.errs && !reflect.DeepEqual(got, x.exp) {
+			t.Errorf("Expected %v, got %v for %v", x.exp, got, x)
+		}
+	}
+}
+
+func TestTapConnectRoundTrip(t *testing.T) {
+	tests := []TapConnect{
+		{Flags: map[TapConnectFlag]interface{}{}},
+		{
+			Name: "everything",
+			Flags: map[TapConnectFlag]interface{}{
+				BACKFILL:           uint64(824859588116),
+				DUMP:               true,
+				LIST_VBUCKETS:      []uint16{1, 2, 4},
+				TAKEOVER_VBUCKETS:  true,
+				SUPPORT_ACK:        true,
+				REQUEST_KEYS_ONLY:  true,
+				CHECKPOINT:         map[uint16]uint64{4: 7, 1: 3},
+				REGISTERED_CLIENT:  true,
+				FIX_FLAG_BYTEORDER: true,
+			},
+		},
+		{
+			Name: "leftovers",
+			Flags: map[TapConnectFlag]interface{}{
+				LIST_VBUCKETS: []uint16{},
+				CHECKPOINT:    map[uint16]uint64{},
+			},
+			RemainingBody: []byte{13},
+		},
+	}
+
+	for _, tc := range tests {
+		req, err := tc.Request()
+		if err != nil {
+			t.Fatalf("Error encoding %v: %v", tc, err)
+		}
+		if req.Opcode != TAP_CONNECT {
+			t.Errorf("Expected TAP_CONNECT, got %v", req.Opcode)
+		}
+		got, err := req.ParseTapCommands()
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", req, err)
+		}
+		if len(tc.RemainingBody) == 0 {
+			tc.RemainingBody = []byte{}
+		}
+		if !reflect.DeepEqual(got, tc) {
+			t.Errorf("Expected %#v, got %#v", tc, got)
+		}
+	}
+}
+
+func TestTapConnectEncoding(t *testing.T) {
+	tc := TapConnect{
+		Name: "hi",
+		Flags: map[TapConnectFlag]interface{}{
+			CHECKPOINT:    map[uint16]uint64{2: 1, 1: 0x0102},
+			LIST_VBUCKETS: []uint16{1, 2},
+			BACKFILL:      uint64(5),
+		},
+	}
+	req, err := tc.Request()
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	if !reflect.DeepEqual(req.Extras, []byte{0, 0, 0, 0x45}) {
+		t.Errorf("Expected BACKFILL|LIST_VBUCKETS|CHECKPOINT, got %x", req.Extras)
+	}
+	exp := []byte{
+		0, 0, 0, 0, 0, 0, 0, 5, // backfill
+		0, 2, 0, 1, 0, 2, // vbuckets
+		0, 2, // checkpoints, in vbucket order
+		0, 1, 0, 0, 0, 0, 0, 0, 1, 2,
+		0, 2, 0, 0, 0, 0, 0, 0, 0, 1,
+	}
+	if !reflect.DeepEqual(req.Body, exp) {
+		t.Errorf("Expected body %v, got %v", exp, req.Body)
+	}
+	if string(req.Key) != "hi" {
+		t.Errorf("Expected the name as the key, got %s", req.Key)
+	}
+}
+
+func TestTapConnectEncodingErrors(t *testing.T) {
+	for f, v := range map[TapConnectFlag]interface{}{
+		BACKFILL:      5,
+		LIST_VBUCKETS: []int{1},
+		CHECKPOINT:    true,
+	} {
+		tc := TapConnect{Flags: map[TapConnectFlag]interface{}{f: v}}
+		if req, err := tc.Request(); err == nil {
+			t.Errorf("Expected an error encoding %v=%#v, got %v", f, v, req)
+		}
+	}
+}
@@ -0,0 +1,633 @@
+package gomemcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Text protocol docs: <https://github.com/memcached/memcached/blob/master/doc/protocol.txt>
+
+// The longest key the text protocol allows.
+const MaxTextKeyLen = 250
+
+// ErrUnknownCommand is returned when reading a text command that has
+// no binary equivalent.  Servers should reply with "ERROR".
+var ErrUnknownCommand = errors.New("unknown command")
+
+// TextClientError is a malformed text command.  Servers should reply
+// with "CLIENT_ERROR" and the message.
+type TextClientError string
+
+func (e TextClientError) Error() string {
+	return string(e)
+}
+
+// A text protocol command and the binary requests it maps to.
+type TextCommand struct {
+	// The command as sent ("get", "set", "incr", ...)
+	Name string
+	// The equivalent requests, one per key for multi-key gets.
+	Requests []MCRequest
+	// If true, the client doesn't want a reply.
+	NoReply bool
+}
+
+var textStoreCommands = map[string]CommandCode{
+	"set":     SET,
+	"add":     ADD,
+	"replace": REPLACE,
+	"append":  APPEND,
+	"prepend": PREPEND,
+	"cas":     SET,
+}
+
+var textQuietCommands = map[CommandCode]CommandCode{
+	SET:       SETQ,
+	ADD:       ADDQ,
+	REPLACE:   REPLACEQ,
+	APPEND:    APPENDQ,
+	PREPEND:   PREPENDQ,
+	DELETE:    DELETEQ,
+	INCREMENT: INCREMENTQ,
+	DECREMENT: DECREMENTQ,
+	FLUSH:     FLUSHQ,
+	QUIT:      QUITQ,
+}
+
+// readTextLine reads a single CRLF (or LF) terminated line.
+func readTextLine(r *bufio.Reader) (string, int, error) {
+	line, err := r.ReadSlice('\n')
+	n := len(line)
+	if err == bufio.ErrBufferFull {
+		return "", n, TextClientError("line too long")
+	}
+	if err != nil {
+		return "", n, err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), n, nil
+}
+
+func validTextKey(k string) bool {
+	if len(k) == 0 || len(k) > MaxTextKeyLen {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTextUint(s string, bits int) (uint64, error) {
+	v, err := strconv.ParseUint(s, 10, bits)
+	if err != nil {
+		return 0, TextClientError("bad command line format")
+	}
+	return v, nil
+}
+
+// ReadTextCommand reads the next text protocol command (including
+// any data block) and converts it into binary requests.
+func ReadTextCommand(r *bufio.Reader) (*TextCommand, error) {
+	line, _, err := readTextLine(r)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, ErrUnknownCommand
+	}
+
+	cmd := &TextCommand{Name: fields[0]}
+	args := fields[1:]
+	if n := len(args); n > 0 && args[n-1] == "noreply" {
+		switch cmd.Name {
+		case "get", "gets", "stats", "version":
+		default:
+			cmd.NoReply = true
+			args = args[:n-1]
+		}
+	}
+	for _, k := range args {
+		if len(k) > MaxTextKeyLen {
+			return nil, TextClientError("key too long")
+		}
+	}
+
+	badFormat := TextClientError("bad command line format")
+	req := MCRequest{}
+	switch cmd.Name {
+	case "get", "gets":
+		if len(args) == 0 {
+			return nil, badFormat
+		}
+		for i, k := range args {
+			cmd.Requests = append(cmd.Requests, MCRequest{
+				Opcode: GET,
+				Key:    []byte(k),
+				Opaque: uint32(i),
+			})
+		}
+		return cmd, nil
+
+	case "set", "add", "replace", "append", "prepend", "cas":
+		want := 4
+		if cmd.Name == "cas" {
+			want = 5
+		}
+		if len(args) != want {
+			return nil, badFormat
+		}
+		req.Opcode = textStoreCommands[cmd.Name]
+		req.Key = []byte(args[0])
+		flags, err := parseTextUint(args[1], 32)
+		if err != nil {
+			return nil, err
+		}
+		exp, err := parseTextUint(args[2], 32)
+		if err != nil {
+			return nil, err
+		}
+		n, err := parseTextUint(args[3], 31)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.Name == "cas" {
+			if req.Cas, err = parseTextUint(args[4], 64); err != nil {
+				return nil, err
+			}
+		}
+		if req.Opcode != APPEND && req.Opcode != PREPEND {
+			req.Extras = make([]byte, 8)
+			binary.BigEndian.PutUint32(req.Extras, uint32(flags))
+			binary.BigEndian.PutUint32(req.Extras[4:], uint32(exp))
+		}
+		if int(n) > MaxBodyLen {
+			io.CopyN(ioutil.Discard, r, int64(n)+2)
+			return nil, TextClientError("object too large for cache")
+		}
+		req.Body = make([]byte, n+2)
+		if _, err := io.ReadFull(r, req.Body); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(req.Body, []byte("\r\n")) {
+			return nil, TextClientError("bad data chunk")
+		}
+		req.Body = req.Body[:n]
+
+	case "delete":
+		// A trailing "0" is allowed for compatibility.
+		if len(args) == 2 && args[1] == "0" {
+			args = args[:1]
+		}
+		if len(args) != 1 {
+			return nil, badFormat
+		}
+		req.Opcode = DELETE
+		req.Key = []byte(args[0])
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			return nil, badFormat
+		}
+		req.Opcode = INCREMENT
+		if cmd.Name == "decr" {
+			req.Opcode = DECREMENT
+		}
+		req.Key = []byte(args[0])
+		amt, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return nil, TextClientError("invalid numeric delta argument")
+		}
+		req.Extras = make([]byte, 20)
+		binary.BigEndian.PutUint64(req.Extras, amt)
+		// Never create missing values.
+		binary.BigEndian.PutUint32(req.Extras[16:], 0xffffffff)
+
+	case "stats":
+		req.Opcode = STAT
+		req.Key = []byte(strings.Join(args, " "))
+
+	case "flush_all":
+		if len(args) > 1 {
+			return nil, badFormat
+		}
+		req.Opcode = FLUSH
+		req.Extras = make([]byte, 4)
+		if len(args) == 1 {
+			delay, err := parseTextUint(args[0], 32)
+			if err != nil {
+				return nil, err
+			}
+			binary.BigEndian.PutUint32(req.Extras, uint32(delay))
+		}
+
+	case "version":
+		req.Opcode = VERSION
+
+	case "quit":
+		req.Opcode = QUIT
+
+	default:
+		return nil, ErrUnknownCommand
+	}
+
+	if len(req.Key) > 0 && !validTextKey(string(req.Key)) {
+		return nil, badFormat
+	}
+	if cmd.NoReply {
+		if q, ok := textQuietCommands[req.Opcode]; ok {
+			req.Opcode = q
+		}
+	}
+	cmd.Requests = []MCRequest{req}
+	return cmd, nil
+}
+
+func textStatusLine(cmd string, res *MCResponse) string {
+	switch res.Status {
+	case KEY_ENOENT:
+		if cmd == "add" || cmd == "replace" || cmd == "append" ||
+			cmd == "prepend" {
+			return "NOT_STORED"
+		}
+		return "NOT_FOUND"
+	case KEY_EEXISTS:
+		if cmd == "cas" {
+			return "EXISTS"
+		}
+		return "NOT_STORED"
+	case NOT_STORED:
+		return "NOT_STORED"
+	case E2BIG:
+		return "SERVER_ERROR object too large for cache"
+	case ENOMEM:
+		return "SERVER_ERROR out of memory storing object"
+	case DELTA_BADVAL:
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	case EINVAL:
+		return "CLIENT_ERROR " + string(res.Body)
+	case UNKNOWN_COMMAND:
+		return "ERROR"
+	}
+	msg := string(res.Body)
+	if msg == "" {
+		msg = res.Status.String()
+	}
+	return "SERVER_ERROR " + msg
+}
+
+// WriteResponse renders the responses to this command's requests as
+// a text protocol reply.
+//
+// res is matched up with Requests, except for stats, where it holds
+// every stat response (the final, empty one is optional).  Nothing is
+// written for noreply commands.
+func (cmd *TextCommand) WriteResponse(w io.Writer, res []*MCResponse) error {
+	if cmd.NoReply || cmd.Name == "quit" {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	switch cmd.Name {
+	case "get", "gets":
+		for i, r := range res {
+			if r == nil || r.Status != SUCCESS || i >= len(cmd.Requests) {
+				continue
+			}
+			var flags uint32
+			if len(r.Extras) >= 4 {
+				flags = binary.BigEndian.Uint32(r.Extras)
+			}
+			fmt.Fprintf(buf, "VALUE %s %d %d", cmd.Requests[i].Key,
+				flags, len(r.Body))
+			if cmd.Name == "gets" {
+				fmt.Fprintf(buf, " %d", r.Cas)
+			}
+			buf.WriteString("\r\n")
+			buf.Write(r.Body)
+			buf.WriteString("\r\n")
+		}
+		buf.WriteString("END\r\n")
+
+	case "stats":
+		for _, r := range res {
+			if r.Status != SUCCESS {
+				buf.Reset()
+				buf.WriteString(textStatusLine(cmd.Name, r) + "\r\n")
+				break
+			}
+			if len(r.Key) == 0 {
+				continue
+			}
+			fmt.Fprintf(buf, "STAT %s %s\r\n", r.Key, r.Body)
+		}
+		if buf.Len() == 0 || bytes.HasPrefix(buf.Bytes(), []byte("STAT ")) {
+			buf.WriteString("END\r\n")
+		}
+
+	default:
+		if len(res) == 0 || res[0] == nil {
+			return errors.New("no response to render")
+		}
+		r := res[0]
+		switch {
+		case r.Status != SUCCESS:
+			buf.WriteString(textStatusLine(cmd.Name, r))
+		case cmd.Name == "delete":
+			buf.WriteString("DELETED")
+		case cmd.Name == "incr" || cmd.Name == "decr":
+			if len(r.Body) < 8 {
+				return fmt.Errorf("short %s response: %v", cmd.Name, r)
+			}
+			buf.WriteString(strconv.FormatUint(binary.BigEndian.Uint64(r.Body), 10))
+		case cmd.Name == "flush_all":
+			buf.WriteString("OK")
+		case cmd.Name == "version":
+			buf.WriteString("VERSION " + string(r.Body))
+		default:
+			buf.WriteString("STORED")
+		}
+		buf.WriteString("\r\n")
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var textRequestNames = map[CommandCode]string{
+	SET:        "set",
+	SETQ:       "set",
+	ADD:        "add",
+	ADDQ:       "add",
+	REPLACE:    "replace",
+	REPLACEQ:   "replace",
+	APPEND:     "append",
+	APPENDQ:    "append",
+	PREPEND:    "prepend",
+	PREPENDQ:   "prepend",
+	DELETE:     "delete",
+	DELETEQ:    "delete",
+	INCREMENT:  "incr",
+	INCREMENTQ: "incr",
+	DECREMENT:  "decr",
+	DECREMENTQ: "decr",
+}
+
+// TextBytes is the text protocol representation of this request.
+//
+// Gets always ask for the CAS.  Quiet commands are sent as noreply.
+func (req *MCRequest) TextBytes() ([]byte, error) {
+	if len(req.Key) > 0 && !validTextKey(string(req.Key)) {
+		return nil, fmt.Errorf("invalid text protocol key: %q", req.Key)
+	}
+	noreply := ""
+	if req.Opcode.IsQuiet() {
+		noreply = " noreply"
+	}
+
+	buf := &bytes.Buffer{}
+	switch req.Opcode {
+	case GET, GETQ, GETK, GETKQ:
+		fmt.Fprintf(buf, "gets %s\r\n", req.Key)
+
+	case SET, SETQ, ADD, ADDQ, REPLACE, REPLACEQ,
+		APPEND, APPENDQ, PREPEND, PREPENDQ:
+		var flags, exp uint32
+		if len(req.Extras) >= 8 {
+			flags = binary.BigEndian.Uint32(req.Extras)
+			exp = binary.BigEndian.Uint32(req.Extras[4:])
+		}
+		name := textRequestNames[req.Opcode]
+		if req.Cas != 0 {
+			if name != "set" {
+				return nil, fmt.Errorf("no text protocol %s with CAS", name)
+			}
+			fmt.Fprintf(buf, "cas %s %d %d %d %d%s\r\n", req.Key,
+				flags, exp, len(req.Body), req.Cas, noreply)
+		} else {
+			fmt.Fprintf(buf, "%s %s %d %d %d%s\r\n", name, req.Key,
+				flags, exp, len(req.Body), noreply)
+		}
+		buf.Write(req.Body)
+		buf.WriteString("\r\n")
+
+	case DELETE, DELETEQ:
+		fmt.Fprintf(buf, "delete %s%s\r\n", req.Key, noreply)
+
+	case INCREMENT, INCREMENTQ, DECREMENT, DECREMENTQ:
+		if len(req.Extras) < 8 {
+			return nil, fmt.Errorf("missing %s amount", req.Opcode)
+		}
+		fmt.Fprintf(buf, "%s %s %d%s\r\n", textRequestNames[req.Opcode],
+			req.Key, binary.BigEndian.Uint64(req.Extras), noreply)
+
+	case STAT:
+		if len(req.Key) > 0 {
+			fmt.Fprintf(buf, "stats %s\r\n", req.Key)
+		} else {
+			buf.WriteString("stats\r\n")
+		}
+
+	case FLUSH, FLUSHQ:
+		buf.WriteString("flush_all")
+		if len(req.Extras) >= 4 {
+			if delay := binary.BigEndian.Uint32(req.Extras); delay > 0 {
+				fmt.Fprintf(buf, " %d", delay)
+			}
+		}
+		buf.WriteString(noreply + "\r\n")
+
+	case VERSION:
+		buf.WriteString("version\r\n")
+
+	case QUIT, QUITQ:
+		buf.WriteString("quit\r\n")
+
+	default:
+		return nil, fmt.Errorf("no text protocol equivalent for %v", req.Opcode)
+	}
+	return buf.Bytes(), nil
+}
+
+// TransmitText sends this request as a text protocol command.
+func (req *MCRequest) TransmitText(w io.Writer) (int, error) {
+	data, err := req.TextBytes()
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(data)
+}
+
+// textErrorResponse converts error replies, returning false if the
+// line isn't one.
+func (res *MCResponse) textErrorResponse(line string) bool {
+	switch {
+	case line == "ERROR":
+		res.Status = UNKNOWN_COMMAND
+	case strings.HasPrefix(line, "CLIENT_ERROR"):
+		res.Status = EINVAL
+		res.Body = []byte(strings.TrimSpace(line[len("CLIENT_ERROR"):]))
+	case strings.HasPrefix(line, "SERVER_ERROR"):
+		msg := strings.TrimSpace(line[len("SERVER_ERROR"):])
+		switch {
+		case strings.Contains(msg, "out of memory"):
+			res.Status = ENOMEM
+		case strings.Contains(msg, "too large"):
+			res.Status = E2BIG
+		default:
+			res.Status = EINTERNAL
+		}
+		res.Body = []byte(msg)
+	default:
+		return false
+	}
+	return true
+}
+
+// ReceiveText reads the text protocol reply to req into this response.
+//
+// The reply to stats is read one STAT line at a time, with END
+// giving a response with an empty key, just like the binary protocol.
+// Unlike Receive, the response status is set from the reply, so
+// errors returned are only for communication problems.
+func (res *MCResponse) ReceiveText(r *bufio.Reader, req *MCRequest) (int, error) {
+	res.Opcode = req.Opcode
+	res.Opaque = req.Opaque
+
+	line, n, err := readTextLine(r)
+	if err != nil {
+		return n, err
+	}
+	if res.textErrorResponse(line) {
+		return n, nil
+	}
+
+	bad := func() (int, error) {
+		return n, fmt.Errorf("unexpected reply to %v: %q", req.Opcode, line)
+	}
+
+	switch req.Opcode {
+	case GET, GETQ, GETK, GETKQ:
+		if line == "END" {
+			res.Status = KEY_ENOENT
+			return n, nil
+		}
+		f := strings.Fields(line)
+		if len(f) < 4 || len(f) > 5 || f[0] != "VALUE" {
+			return bad()
+		}
+		flags, err := strconv.ParseUint(f[2], 10, 32)
+		if err != nil {
+			return bad()
+		}
+		size, err := strconv.ParseUint(f[3], 10, 31)
+		if err != nil {
+			return bad()
+		}
+		if len(f) == 5 {
+			if res.Cas, err = strconv.ParseUint(f[4], 10, 64); err != nil {
+				return bad()
+			}
+		}
+		res.Extras = make([]byte, 4)
+		binary.BigEndian.PutUint32(res.Extras, uint32(flags))
+		if req.Opcode == GETK || req.Opcode == GETKQ {
+			res.Key = []byte(f[1])
+		}
+		data := make([]byte, size+2)
+		m, err := io.ReadFull(r, data)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		res.Body = data[:size]
+		end, m, err := readTextLine(r)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if end != "END" {
+			return n, fmt.Errorf("expected END, got %q", end)
+		}
+		res.Status = SUCCESS
+
+	case SET, SETQ, ADD, ADDQ, REPLACE, REPLACEQ,
+		APPEND, APPENDQ, PREPEND, PREPENDQ:
+		switch line {
+		case "STORED":
+			res.Status = SUCCESS
+		case "NOT_STORED":
+			res.Status = NOT_STORED
+		case "EXISTS":
+			res.Status = KEY_EEXISTS
+		case "NOT_FOUND":
+			res.Status = KEY_ENOENT
+		default:
+			return bad()
+		}
+
+	case DELETE, DELETEQ:
+		switch line {
+		case "DELETED":
+			res.Status = SUCCESS
+		case "NOT_FOUND":
+			res.Status = KEY_ENOENT
+		default:
+			return bad()
+		}
+
+	case INCREMENT, INCREMENTQ, DECREMENT, DECREMENTQ:
+		if line == "NOT_FOUND" {
+			res.Status = KEY_ENOENT
+			return n, nil
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(line), 10, 64)
+		if err != nil {
+			return bad()
+		}
+		res.Status = SUCCESS
+		res.Body = make([]byte, 8)
+		binary.BigEndian.PutUint64(res.Body, v)
+
+	case STAT:
+		if line == "END" {
+			res.Status = SUCCESS
+			return n, nil
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) < 2 || f[0] != "STAT" {
+			return bad()
+		}
+		res.Status = SUCCESS
+		res.Key = []byte(f[1])
+		if len(f) == 3 {
+			res.Body = []byte(f[2])
+		}
+
+	case FLUSH, FLUSHQ:
+		if line != "OK" {
+			return bad()
+		}
+		res.Status = SUCCESS
+
+	case VERSION:
+		if !strings.HasPrefix(line, "VERSION ") {
+			return bad()
+		}
+		res.Status = SUCCESS
+		res.Body = []byte(line[len("VERSION "):])
+
+	default:
+		return bad()
+	}
+	return n, nil
+}
@@ -0,0 +1,287 @@
+package gomemcached
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readText(t *testing.T, s string) *TextCommand {
+	cmd, err := ReadTextCommand(bufio.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatalf("Error reading %q: %v", s, err)
+	}
+	return cmd
+}
+
+func TestReadTextGet(t *testing.T) {
+	cmd := readText(t, "gets a bb\r\n")
+	if cmd.Name != "gets" || len(cmd.Requests) != 2 {
+		t.Fatalf("Expected two gets, got %+v", cmd)
+	}
+	for i, k := range []string{"a", "bb"} {
+		req := cmd.Requests[i]
+		if req.Opcode != GET || string(req.Key) != k ||
+			req.Opaque != uint32(i) {
+			t.Errorf("Expected get of %v, got %v", k, req)
+		}
+	}
+}
+
+func TestReadTextStore(t *testing.T) {
+	cmd := readText(t, "cas k 3 100 5 42 noreply\r\nhello\r\n")
+	if !cmd.NoReply || len(cmd.Requests) != 1 {
+		t.Fatalf("Expected one noreply request, got %+v", cmd)
+	}
+	req := cmd.Requests[0]
+	exp := MCRequest{
+		Opcode: SETQ,
+		Cas:    42,
+		Key:    []byte("k"),
+		Extras: []byte{0, 0, 0, 3, 0, 0, 0, 100},
+		Body:   []byte("hello"),
+	}
+	if !reflect.DeepEqual(req, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, req)
+	}
+
+	req = readText(t, "append k 0 0 1\r\nx\r\n").Requests[0]
+	if req.Opcode != APPEND || len(req.Extras) != 0 {
+		t.Errorf("Expected an append without extras, got %v", req)
+	}
+}
+
+func TestReadTextOthers(t *testing.T) {
+	tests := []struct {
+		in  string
+		op  CommandCode
+		key string
+	}{
+		{"delete k\r\n", DELETE, "k"},
+		{"delete k 0 noreply\r\n", DELETEQ, "k"},
+		{"incr k 5\n", INCREMENT, "k"},
+		{"decr k 5\r\n", DECREMENT, "k"},
+		{"stats items\r\n", STAT, "items"},
+		{"stats\r\n", STAT, ""},
+		{"flush_all 10\r\n", FLUSH, ""},
+		{"version\r\n", VERSION, ""},
+		{"quit\r\n", QUIT, ""},
+	}
+	for _, test := range tests {
+		req := readText(t, test.in).Requests[0]
+		if req.Opcode != test.op || string(req.Key) != test.key {
+			t.Errorf("Expected %v %q from %q, got %v",
+				test.op, test.key, test.in, req)
+		}
+	}
+
+	req := readText(t, "incr k 5\r\n").Requests[0]
+	if binary.BigEndian.Uint64(req.Extras) != 5 ||
+		binary.BigEndian.Uint32(req.Extras[16:]) != 0xffffffff {
+		t.Errorf("Expected an amount of 5 and no create, got %v", req.Extras)
+	}
+}
+
+func TestReadTextErrors(t *testing.T) {
+	tests := []struct {
+		in  string
+		err error
+	}{
+		{"bogus\r\n", ErrUnknownCommand},
+		{"\r\n", ErrUnknownCommand},
+		{"get\r\n", TextClientError("bad command line format")},
+		{"set k 0 0\r\n", TextClientError("bad command line format")},
+		{"set k x 0 1\r\nx\r\n", TextClientError("bad command line format")},
+		{"set k 0 0 1\r\nxyz\r\n", TextClientError("bad data chunk")},
+		{"incr k -1\r\n", TextClientError("invalid numeric delta argument")},
+		{"get " + strings.Repeat("k", 251) + "\r\n", TextClientError("key too long")},
+	}
+	for _, test := range tests {
+		_, err := ReadTextCommand(bufio.NewReader(strings.NewReader(test.in)))
+		if err != test.err {
+			t.Errorf("Expected %v from %q, got %v", test.err, test.in, err)
+		}
+	}
+}
+
+func TestWriteTextResponse(t *testing.T) {
+	flags := []byte{0, 0, 0, 9}
+	tests := []struct {
+		in  string
+		res []*MCResponse
+		exp string
+	}{
+		{"gets a b c\r\n", []*MCResponse{
+			{Status: SUCCESS, Extras: flags, Cas: 7, Body: []byte("A")},
+			{Status: KEY_ENOENT},
+			{Status: SUCCESS, Body: []byte("CC")},
+		}, "VALUE a 9 1 7\r\nA\r\nVALUE c 0 2 0\r\nCC\r\nEND\r\n"},
+		{"get a\r\n", []*MCResponse{
+			{Status: SUCCESS, Extras: flags, Cas: 7, Body: []byte("A")},
+		}, "VALUE a 9 1\r\nA\r\nEND\r\n"},
+		{"set k 0 0 1\r\nx\r\n", []*MCResponse{{}}, "STORED\r\n"},
+		{"add k 0 0 1\r\nx\r\n", []*MCResponse{{Status: KEY_EEXISTS}},
+			"NOT_STORED\r\n"},
+		{"cas k 0 0 1 3\r\nx\r\n", []*MCResponse{{Status: KEY_EEXISTS}},
+			"EXISTS\r\n"},
+		{"cas k 0 0 1 3\r\nx\r\n", []*MCResponse{{Status: KEY_ENOENT}},
+			"NOT_FOUND\r\n"},
+		{"set k 0 0 1 noreply\r\nx\r\n", []*MCResponse{{}}, ""},
+		{"delete k\r\n", []*MCResponse{{}}, "DELETED\r\n"},
+		{"delete k\r\n", []*MCResponse{{Status: KEY_ENOENT}}, "NOT_FOUND\r\n"},
+		{"incr k 1\r\n", []*MCResponse{{Body: []byte{0, 0, 0, 0, 0, 0, 1, 0}}},
+			"256\r\n"},
+		{"stats\r\n", []*MCResponse{
+			{Key: []byte("pid"), Body: []byte("1")},
+			{Key: []byte("uptime"), Body: []byte("2")},
+			{},
+		}, "STAT pid 1\r\nSTAT uptime 2\r\nEND\r\n"},
+		{"flush_all\r\n", []*MCResponse{{}}, "OK\r\n"},
+		{"version\r\n", []*MCResponse{{Body: []byte("1.2.3")}},
+			"VERSION 1.2.3\r\n"},
+		{"set k 0 0 1\r\nx\r\n", []*MCResponse{{Status: ENOMEM}},
+			"SERVER_ERROR out of memory storing object\r\n"},
+		{"set k 0 0 1\r\nx\r\n", []*MCResponse{{Status: TMPFAIL}},
+			"SERVER_ERROR TMPFAIL\r\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := readText(t, test.in).WriteResponse(buf, test.res); err != nil {
+			t.Errorf("Error writing response to %q: %v", test.in, err)
+		}
+		if buf.String() != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.in, buf.String())
+		}
+	}
+}
+
+func TestTextBytes(t *testing.T) {
+	set := MCRequest{
+		Opcode: SET,
+		Key:    []byte("k"),
+		Extras: []byte{0, 0, 0, 3, 0, 0, 0, 100},
+		Body:   []byte("hello"),
+	}
+	setq := set
+	setq.Opcode = SETQ
+	cas := set
+	cas.Cas = 42
+	incr := MCRequest{Opcode: INCREMENT, Key: []byte("n"), Extras: make([]byte, 20)}
+	binary.BigEndian.PutUint64(incr.Extras, 4)
+
+	tests := []struct {
+		req MCRequest
+		exp string
+	}{
+		{MCRequest{Opcode: GETK, Key: []byte("k")}, "gets k\r\n"},
+		{set, "set k 3 100 5\r\nhello\r\n"},
+		{setq, "set k 3 100 5 noreply\r\nhello\r\n"},
+		{cas, "cas k 3 100 5 42\r\nhello\r\n"},
+		{MCRequest{Opcode: DELETE, Key: []byte("k")}, "delete k\r\n"},
+		{incr, "incr n 4\r\n"},
+		{MCRequest{Opcode: STAT}, "stats\r\n"},
+		{MCRequest{Opcode: FLUSH, Extras: make([]byte, 4)}, "flush_all\r\n"},
+		{MCRequest{Opcode: VERSION}, "version\r\n"},
+	}
+	for _, test := range tests {
+		got, err := test.req.TextBytes()
+		if err != nil {
+			t.Errorf("Error encoding %v: %v", test.req, err)
+		}
+		if string(got) != test.exp {
+			t.Errorf("Expected %q, got %q", test.exp, got)
+		}
+
+		// And it should read back in.
+		cmd := readText(t, test.exp)
+		if string(cmd.Requests[0].Key) != string(test.req.Key) {
+			t.Errorf("Expected key %q back from %q, got %q",
+				test.req.Key, test.exp, cmd.Requests[0].Key)
+		}
+	}
+
+	for _, req := range []MCRequest{
+		{Opcode: NOOP},
+		{Opcode: GET, Key: []byte("has space")},
+		{Opcode: ADD, Key: []byte("k"), Cas: 1},
+	} {
+		if _, err := req.TextBytes(); err == nil {
+			t.Errorf("Expected an error encoding %v", req)
+		}
+	}
+}
+
+func receiveText(t *testing.T, s string, req *MCRequest) *MCResponse {
+	res := &MCResponse{}
+	n, err := res.ReceiveText(bufio.NewReader(strings.NewReader(s)), req)
+	if err != nil {
+		t.Fatalf("Error receiving %q: %v", s, err)
+	}
+	if n != len(s) {
+		t.Errorf("Expected to read %v bytes of %q, read %v", len(s), s, n)
+	}
+	return res
+}
+
+func TestReceiveTextGet(t *testing.T) {
+	req := &MCRequest{Opcode: GETK, Key: []byte("k"), Opaque: 5}
+	res := receiveText(t, "VALUE k 9 5 42\r\nhello\r\nEND\r\n", req)
+	exp := &MCResponse{
+		Opcode: GETK,
+		Opaque: 5,
+		Cas:    42,
+		Key:    []byte("k"),
+		Extras: []byte{0, 0, 0, 9},
+		Body:   []byte("hello"),
+	}
+	if !reflect.DeepEqual(res, exp) {
+		t.Errorf("Expected %#v, got %#v", exp, res)
+	}
+
+	res = receiveText(t, "END\r\n", req)
+	if res.Status != KEY_ENOENT {
+		t.Errorf("Expected not found, got %v", res)
+	}
+}
+
+func TestReceiveTextStatus(t *testing.T) {
+	tests := []struct {
+		op     CommandCode
+		in     string
+		status Status
+		body   string
+	}{
+		{SET, "STORED\r\n", SUCCESS, ""},
+		{ADD, "NOT_STORED\r\n", NOT_STORED, ""},
+		{SET, "EXISTS\r\n", KEY_EEXISTS, ""},
+		{DELETE, "DELETED\r\n", SUCCESS, ""},
+		{DELETE, "NOT_FOUND\r\n", KEY_ENOENT, ""},
+		{INCREMENT, "256\r\n", SUCCESS, "\x00\x00\x00\x00\x00\x00\x01\x00"},
+		{STAT, "STAT pid 12\r\n", SUCCESS, "12"},
+		{STAT, "END\r\n", SUCCESS, ""},
+		{FLUSH, "OK\r\n", SUCCESS, ""},
+		{VERSION, "VERSION 1.4.0\r\n", SUCCESS, "1.4.0"},
+		{SET, "ERROR\r\n", UNKNOWN_COMMAND, ""},
+		{SET, "CLIENT_ERROR bad data chunk\r\n", EINVAL, "bad data chunk"},
+		{SET, "SERVER_ERROR out of memory storing object\r\n", ENOMEM,
+			"out of memory storing object"},
+		{SET, "SERVER_ERROR oops\r\n", EINTERNAL, "oops"},
+	}
+	for _, test := range tests {
+		res := receiveText(t, test.in, &MCRequest{Opcode: test.op})
+		if res.Status != test.status || string(res.Body) != test.body {
+			t.Errorf("Expected %v/%q from %q, got %v/%q",
+				test.status, test.body, test.in, res.Status, res.Body)
+		}
+	}
+
+	res := &MCResponse{}
+	_, err := res.ReceiveText(bufio.NewReader(strings.NewReader("HUH\r\n")),
+		&MCRequest{Opcode: SET})
+	if err == nil {
+		t.Errorf("Expected an error for an unexpected reply")
+	}
+}
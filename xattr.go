@@ -0,0 +1,87 @@
+package gomemcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ErrBadXattrs is returned when decoding an invalid xattr blob.
+var ErrBadXattrs = errors.New("invalid xattrs")
+
+// When DATATYPE_XATTR is set, the body starts with a blob of extended
+// attributes:
+//
+//   total length (uint32)
+//   for each attribute:
+//     pair length (uint32), key, 0x00, value, 0x00
+//
+// All lengths are big endian and don't include themselves.
+
+// EncodeXattrs prefixes a body with extended attributes.  Keys are
+// written in sorted order.
+func EncodeXattrs(xattrs map[string]string, body []byte) []byte {
+	keys := make([]string, 0, len(xattrs))
+	total := 0
+	for k, v := range xattrs {
+		keys = append(keys, k)
+		total += 4 + len(k) + 1 + len(v) + 1
+	}
+	sort.Strings(keys)
+
+	rv := make([]byte, 4, 4+total+len(body))
+	binary.BigEndian.PutUint32(rv, uint32(total))
+	for _, k := range keys {
+		v := xattrs[k]
+		pair := make([]byte, 4)
+		binary.BigEndian.PutUint32(pair, uint32(len(k)+1+len(v)+1))
+		rv = append(rv, pair...)
+		rv = append(rv, k...)
+		rv = append(rv, 0)
+		rv = append(rv, v...)
+		rv = append(rv, 0)
+	}
+	return append(rv, body...)
+}
+
+// DecodeXattrs splits a body with DATATYPE_XATTR set into its
+// extended attributes and the document.
+func DecodeXattrs(data []byte) (map[string]string, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, ErrBadXattrs
+	}
+	total := int(binary.BigEndian.Uint32(data))
+	if total > len(data)-4 {
+		return nil, nil, ErrBadXattrs
+	}
+	blob, body := data[4:4+total], data[4+total:]
+
+	rv := map[string]string{}
+	for len(blob) > 0 {
+		if len(blob) < 4 {
+			return nil, nil, ErrBadXattrs
+		}
+		n := int(binary.BigEndian.Uint32(blob))
+		if n > len(blob)-4 || n < 2 {
+			return nil, nil, ErrBadXattrs
+		}
+		pair := blob[4 : 4+n]
+		i := bytes.IndexByte(pair, 0)
+		if i < 0 || pair[n-1] != 0 || i == n-1 {
+			return nil, nil, ErrBadXattrs
+		}
+		rv[string(pair[:i])] = string(pair[i+1 : n-1])
+		blob = blob[4+n:]
+	}
+	return rv, body, nil
+}
+
+// Xattrs gets the extended attributes and document from a response.
+// If the response has no xattrs, the whole body is the document.
+func (res *MCResponse) Xattrs() (map[string]string, []byte, error) {
+	if res.DataType&DATATYPE_XATTR == 0 {
+		return nil, res.Body, nil
+	}
+	return DecodeXattrs(res.Body)
+}
@@ -0,0 +1,66 @@
+package gomemcached
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestXattrsRoundTrip(t *testing.T) {
+	xattrs := map[string]string{
+		"_sync": `{"rev":"1-a"}`,
+		"meta":  `"x"`,
+	}
+	enc := EncodeXattrs(xattrs, []byte(`{"doc":1}`))
+	exp := []byte("\x00\x00\x00\x25" +
+		"\x00\x00\x00\x14_sync\x00{\"rev\":\"1-a\"}\x00" +
+		"\x00\x00\x00\x09meta\x00\"x\"\x00" +
+		`{"doc":1}`)
+	if !bytes.Equal(enc, exp) {
+		t.Fatalf("Expected %q, got %q", exp, enc)
+	}
+
+	got, body, err := DecodeXattrs(enc)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if string(body) != `{"doc":1}` {
+		t.Errorf("Expected the document back, got %q", body)
+	}
+	if len(got) != len(xattrs) {
+		t.Errorf("Expected %v, got %v", xattrs, got)
+	}
+	for k, v := range xattrs {
+		if got[k] != v {
+			t.Errorf("Expected %v=%v, got %q", k, v, got[k])
+		}
+	}
+
+	res := &MCResponse{Body: enc}
+	if x, body, err := res.Xattrs(); x != nil || !bytes.Equal(body, enc) || err != nil {
+		t.Errorf("Expected no xattrs without the datatype, got %v/%q/%v", x, body, err)
+	}
+	res.DataType = DATATYPE_JSON | DATATYPE_XATTR
+	if x, _, err := res.Xattrs(); len(x) != 2 || err != nil {
+		t.Errorf("Expected xattrs, got %v/%v", x, err)
+	}
+}
+
+func TestDecodeBadXattrs(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"\x00\x00",
+		"\x00\x00\x00\x05abc",
+		"\x00\x00\x00\x03\x00\x00\x00",
+		"\x00\x00\x00\x07\x00\x00\x00\x03k\x00v",
+		"\x00\x00\x00\x06\x00\x00\x00\x02kv",
+		"\x00\x00\x00\x06\x00\x00\x00\x02k\x00",
+	} {
+		if _, _, err := DecodeXattrs([]byte(bad)); err != ErrBadXattrs {
+			t.Errorf("Expected an error decoding %q, got %v", bad, err)
+		}
+	}
+	x, body, err := DecodeXattrs([]byte("\x00\x00\x00\x00doc"))
+	if err != nil || len(x) != 0 || string(body) != "doc" {
+		t.Errorf("Expected an empty blob to work, got %v/%q/%v", x, body, err)
+	}
+}